@@ -99,6 +99,10 @@ export const streamAnalysisOpenAI = (
   };
   
   eventSource.onerror = () => {
+    // The browser reconnects with Last-Event-ID and the server resumes the analysis
+    if (eventSource.readyState === EventSource.CONNECTING) {
+      return;
+    }
     if (callbacks?.onError) {
       callbacks.onError('Connection error occurred');
     }
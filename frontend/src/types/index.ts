@@ -25,6 +25,7 @@ export interface LLMAnalysis {
   DeletedAt: string | null;
   Content: string;
   GeneratedAt: string;
+  ProcessedDataID: number | null;
 }
 
 export interface FetchProcessResponse {
@@ -1,8 +1,12 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/arkouda/PipelineIQ/internal/models"
@@ -14,17 +18,41 @@ import (
 
 // Handler contains the dependencies needed for API handlers
 type Handler struct {
-	DB           *gorm.DB
-	Logger       *zap.SugaredLogger
-	IngestionSvc *services.DataIngestionService
-	ProcessorSvc *services.DataProcessorService
-	LLMSvc       *services.LLMService
+	DB             *gorm.DB
+	Logger         *zap.SugaredLogger
+	IngestionSvc   *services.DataIngestionService
+	ProcessorSvc   *services.DataProcessorService
+	LLMSvc         *services.LLMService
+	MetricsSvc     *services.MetricsService
+	CorrelationSvc *services.CorrelationService
+	ForecastSvc    *services.ForecastService
+	PromptSvc      *services.PromptService
 }
 
 // FetchAndProcessHandler handles the request to fetch data, process it, and generate insights asynchronously
 func (h *Handler) FetchAndProcessHandler(c *gin.Context) {
 	h.Logger.Info("Handling fetch and process request")
 
+	// Optional analysis format: markdown (default) or structured JSON insights
+	format := c.DefaultQuery("format", services.AnalysisFormatMarkdown)
+	analysisType := services.AnalysisTypeInsights
+	switch format {
+	case services.AnalysisFormatMarkdown:
+	case services.AnalysisFormatStructured:
+		analysisType = services.AnalysisTypeStructured
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid 'format' parameter. Please use 'markdown' or 'structured'",
+		})
+		return
+	}
+
+	// Validate model parameter and prompt overrides before doing any work
+	opts, ok := h.analysisOptions(c, analysisType)
+	if !ok {
+		return
+	}
+
 	// Fetch data from APIs
 	if err := h.IngestionSvc.FetchData(); err != nil {
 		h.Logger.Errorw("Error fetching data", "error", err)
@@ -44,9 +72,39 @@ func (h *Handler) FetchAndProcessHandler(c *gin.Context) {
 		return
 	}
 
-	// Generate insights using LLM asynchronously
+	// Skip LLM analysis when the processed data failed a quality check
+	if processedData.QualityStatus == services.QualityStatusFailed {
+		h.Logger.Warnw("Skipping LLM analysis for data that failed quality checks", "processed_id", processedData.ID)
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Data processed but failed quality checks; LLM analysis was skipped",
+			"processed_id":   processedData.ID,
+			"analysis_id":    0,
+			"quality_status": processedData.QualityStatus,
+			"completed_at":   time.Now(),
+		})
+		return
+	}
+
+	// Update correlations and forecasts and generate insights using LLM asynchronously
 	go func() {
-		llmAnalysis, err := h.LLMSvc.GenerateInsights()
+		if len(h.CorrelationSvc.Config.Correlations) > 0 {
+			if _, err := h.CorrelationSvc.Run(); err != nil {
+				h.Logger.Errorw("Error computing correlations in background", "error", err)
+			}
+		}
+		if len(h.ForecastSvc.Config.Forecasts) > 0 {
+			if _, err := h.ForecastSvc.Run(); err != nil {
+				h.Logger.Errorw("Error computing forecasts in background", "error", err)
+			}
+		}
+
+		var llmAnalysis *models.LLMAnalysis
+		var err error
+		if format == services.AnalysisFormatStructured {
+			llmAnalysis, _, err = h.LLMSvc.GenerateStructuredInsights(processedData.ID, opts)
+		} else {
+			llmAnalysis, err = h.LLMSvc.GenerateInsights(processedData.ID, opts)
+		}
 		if err != nil {
 			h.Logger.Errorw("Error generating insights in background", "error", err)
 			return
@@ -56,10 +114,11 @@ func (h *Handler) FetchAndProcessHandler(c *gin.Context) {
 
 	// Return success response immediately after processing
 	c.JSON(http.StatusOK, gin.H{
-		"message":       "Data pipeline initiated successfully",
-		"processed_id":  processedData.ID,
-		"analysis_id":   0, // Will be generated asynchronously
-		"completed_at":  time.Now(),
+		"message":        "Data pipeline initiated successfully",
+		"processed_id":   processedData.ID,
+		"analysis_id":    0, // Will be generated asynchronously
+		"quality_status": processedData.QualityStatus,
+		"completed_at":   time.Now(),
 	})
 }
 
@@ -72,6 +131,12 @@ func (h *Handler) GetResultsHandler(c *gin.Context) {
 	var processedData []models.ProcessedData
 	var err error
 
+	// Optional processor version filter
+	query := h.DB
+	if version := c.Query("version"); version != "" {
+		query = query.Where("processor_version = ?", version)
+	}
+
 	if dateFilter != "" {
 		// Parse date string to time.Time
 		date, err := time.Parse("2006-01-02", dateFilter)
@@ -84,10 +149,10 @@ func (h *Handler) GetResultsHandler(c *gin.Context) {
 		}
 
 		// Query with date filter
-		err = h.DB.Where("DATE(processed_at) = DATE(?)", date).Order("processed_at desc").Find(&processedData).Error
+		err = query.Where("DATE(observed_at) = DATE(?)", date).Order(services.LatestProcessedOrder).Find(&processedData).Error
 	} else {
 		// Query without filter
-		err = h.DB.Order("processed_at desc").Limit(10).Find(&processedData).Error
+		err = query.Order(services.LatestProcessedOrder).Limit(10).Find(&processedData).Error
 	}
 
 	if err != nil {
@@ -112,6 +177,146 @@ func (h *Handler) GetResultsHandler(c *gin.Context) {
 	})
 }
 
+// GetResultsDiffHandler compares two processed results key by key
+func (h *Handler) GetResultsDiffHandler(c *gin.Context) {
+	h.Logger.Info("Handling results diff request")
+
+	fromID, err := strconv.ParseUint(c.Query("from"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid or missing 'from' parameter. Please use a processed data ID",
+		})
+		return
+	}
+	toID, err := strconv.ParseUint(c.Query("to"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid or missing 'to' parameter. Please use a processed data ID",
+		})
+		return
+	}
+
+	opts := services.DiffOptions{}
+	for _, prefix := range strings.Split(c.Query("prefix"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			opts.Prefixes = append(opts.Prefixes, prefix)
+		}
+	}
+	if minChange := c.Query("min_change"); minChange != "" {
+		if opts.MinChange, err = strconv.ParseFloat(minChange, 64); err != nil || opts.MinChange < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'min_change' parameter. Please use a non-negative number",
+			})
+			return
+		}
+	}
+	if minChangePct := c.Query("min_change_pct"); minChangePct != "" {
+		if opts.MinChangePct, err = strconv.ParseFloat(minChangePct, 64); err != nil || opts.MinChangePct < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'min_change_pct' parameter. Please use a non-negative number",
+			})
+			return
+		}
+	}
+
+	from, fromResult, ok := h.loadProcessedResult(c, uint(fromID))
+	if !ok {
+		return
+	}
+	to, toResult, ok := h.loadProcessedResult(c, uint(toID))
+	if !ok {
+		return
+	}
+
+	diff := services.DiffResults(fromResult, toResult, opts)
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":      gin.H{"id": from.ID, "processed_at": from.ProcessedAt, "observed_at": fromResult.ObservedAt},
+		"to":        gin.H{"id": to.ID, "processed_at": to.ProcessedAt, "observed_at": toResult.ObservedAt},
+		"added":     diff.Added,
+		"removed":   diff.Removed,
+		"changed":   diff.Changed,
+		"unchanged": diff.Unchanged,
+	})
+}
+
+// loadProcessedResult fetches processed data by ID and decodes its content, writing an error
+// response and returning false when either fails
+func (h *Handler) loadProcessedResult(c *gin.Context, id uint) (*models.ProcessedData, *services.ProcessedResult, bool) {
+	var processedData models.ProcessedData
+	if err := h.DB.First(&processedData, id).Error; err != nil {
+		h.Logger.Errorw("Error fetching processed data", "id", id, "error", err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("No processed data found with ID %d", id),
+		})
+		return nil, nil, false
+	}
+
+	var result services.ProcessedResult
+	if err := json.Unmarshal([]byte(processedData.Content), &result); err != nil {
+		h.Logger.Errorw("Error decoding processed data", "id", id, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to decode processed data: " + err.Error(),
+		})
+		return nil, nil, false
+	}
+	return &processedData, &result, true
+}
+
+// analysisOptions resolves the model, temperature, max_tokens, prompt and prompt_version query
+// overrides of an analysis, writing an error response and returning false when they are invalid
+// or not allowed
+func (h *Handler) analysisOptions(c *gin.Context, analysisType string) (services.AnalysisOptions, bool) {
+	overrides := services.ParamOverrides{Model: c.Query("model")}
+	if temperature := c.Query("temperature"); temperature != "" {
+		value, err := strconv.ParseFloat(temperature, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'temperature' parameter. Please use a number",
+			})
+			return services.AnalysisOptions{}, false
+		}
+		overrides.Temperature = &value
+	}
+	if maxTokens := c.Query("max_tokens"); maxTokens != "" {
+		value, err := strconv.Atoi(maxTokens)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'max_tokens' parameter. Please use an integer",
+			})
+			return services.AnalysisOptions{}, false
+		}
+		overrides.MaxTokens = &value
+	}
+
+	params, err := h.LLMSvc.ResolveParams(overrides)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return services.AnalysisOptions{}, false
+	}
+
+	prompt := services.PromptRef{Name: c.Query("prompt")}
+	if version := c.Query("prompt_version"); version != "" {
+		if prompt.Version, err = strconv.Atoi(version); err != nil || prompt.Version <= 0 || prompt.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'prompt_version' parameter. Please use a positive integer together with 'prompt'",
+			})
+			return services.AnalysisOptions{}, false
+		}
+	}
+	if _, err := h.PromptSvc.Resolve(analysisType, prompt); err != nil {
+		h.promptError(c, err)
+		return services.AnalysisOptions{}, false
+	}
+
+	// Bypass the response cache when asked to
+	noCache := c.Query("no_cache") == "true"
+
+	return services.AnalysisOptions{Params: params, Prompt: prompt, NoCache: noCache}, true
+}
+
 // GetAnalysisHandler returns the LLM-generated insights
 func (h *Handler) GetAnalysisHandler(c *gin.Context) {
 	h.Logger.Info("Handling get analysis request")
@@ -121,12 +326,34 @@ func (h *Handler) GetAnalysisHandler(c *gin.Context) {
 	var llmAnalysis models.LLMAnalysis
 	var err error
 
+	// Structured analyses include their insight rows
+	query := h.DB.Preload("Insights", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	})
 	if analysisID != "" {
-		// Query by ID
-		err = h.DB.First(&llmAnalysis, analysisID).Error
+		id, parseErr := strconv.ParseUint(analysisID, 10, 32)
+		if parseErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid id parameter",
+			})
+			return
+		}
+		// Query by ID, whatever its status
+		err = query.First(&llmAnalysis, id).Error
 	} else {
-		// Get the latest analysis
-		err = h.DB.Order("generated_at desc").First(&llmAnalysis).Error
+		// Get the latest analysis with the requested status; streaming, failed and cancelled
+		// analyses hold partial content, so only completed ones are returned by default
+		status := c.DefaultQuery("status", services.AnalysisStatusCompleted)
+		switch status {
+		case services.AnalysisStatusStreaming, services.AnalysisStatusCompleted,
+			services.AnalysisStatusCancelled, services.AnalysisStatusFailed:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid status parameter",
+			})
+			return
+		}
+		err = query.Where("status = ?", status).Order("generated_at desc").First(&llmAnalysis).Error
 	}
 
 	if err != nil {
@@ -140,10 +367,161 @@ func (h *Handler) GetAnalysisHandler(c *gin.Context) {
 	// Return the analysis
 	c.JSON(http.StatusOK, gin.H{
 		"analysis":     llmAnalysis,
+		"status":       llmAnalysis.Status,
+		"generated_at": llmAnalysis.GeneratedAt,
+	})
+}
+
+// StructuredAnalysisHandler generates a schema-validated JSON analysis of processed data
+func (h *Handler) StructuredAnalysisHandler(c *gin.Context) {
+	h.Logger.Info("Handling structured analysis request")
+
+	// Optional processed data ID parameter, defaulting to the latest run
+	var processedDataID uint
+	if processedID := c.Query("processed_id"); processedID != "" {
+		id, err := strconv.ParseUint(processedID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid processed_id parameter",
+			})
+			return
+		}
+		processedDataID = uint(id)
+	}
+
+	opts, ok := h.analysisOptions(c, services.AnalysisTypeStructured)
+	if !ok {
+		return
+	}
+
+	llmAnalysis, insights, err := h.LLMSvc.GenerateStructuredInsights(processedDataID, opts)
+	if err != nil {
+		h.Logger.Errorw("Error generating structured analysis", "error", err)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, services.ErrQualityGateFailed):
+			status = http.StatusConflict
+		case errors.Is(err, services.ErrBudgetExceeded):
+			status = http.StatusTooManyRequests
+		}
+		c.JSON(status, gin.H{
+			"error": "Failed to generate structured analysis: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"analysis":     llmAnalysis,
+		"insights":     insights,
 		"generated_at": llmAnalysis.GeneratedAt,
 	})
 }
 
+// GetInsightsHandler queries the insights of structured analyses
+func (h *Handler) GetInsightsHandler(c *gin.Context) {
+	h.Logger.Info("Handling get insights request")
+
+	query := h.DB.Order("llm_analysis_id desc, id asc")
+
+	// Optional analysis ID, equality and minimum confidence filters
+	if analysisID := c.Query("analysis_id"); analysisID != "" {
+		id, err := strconv.ParseUint(analysisID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid analysis_id parameter",
+			})
+			return
+		}
+		query = query.Where("llm_analysis_id = ?", id)
+	}
+	for _, column := range []string{"kind", "source", "metric", "priority", "severity"} {
+		if value := c.Query(column); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if minConfidence := c.Query("min_confidence"); minConfidence != "" {
+		value, err := strconv.ParseFloat(minConfidence, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid min_confidence parameter",
+			})
+			return
+		}
+		query = query.Where("confidence >= ?", value)
+	}
+
+	var insights []models.AnalysisInsight
+	if err := query.Limit(200).Find(&insights).Error; err != nil {
+		h.Logger.Errorw("Error fetching insights", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch insights: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"insights": insights,
+		"count":    len(insights),
+	})
+}
+
+// GetUsageHandler reports LLM token usage and cost and the spending against the budgets
+func (h *Handler) GetUsageHandler(c *gin.Context) {
+	h.Logger.Info("Handling get usage request")
+
+	// Optional time range, defaulting to the last 30 days
+	to := time.Now()
+	if toParam := c.Query("to"); toParam != "" {
+		parsed, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'to' parameter. Please use RFC3339 format",
+			})
+			return
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -30)
+	if fromParam := c.Query("from"); fromParam != "" {
+		parsed, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'from' parameter. Please use RFC3339 format",
+			})
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "'from' must be before 'to'",
+		})
+		return
+	}
+
+	report, err := h.LLMSvc.Usage(from, to)
+	if err != nil {
+		h.Logger.Errorw("Error reporting LLM usage", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to report usage: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// lastEventID returns the id of the last stream event a reconnecting client received, from the
+// Last-Event-ID header browsers send or the last_event_id query parameter
+func lastEventID(c *gin.Context) string {
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		return id
+	}
+	return c.Query("last_event_id")
+}
+
 // StreamAnalysisHandler streams LLM-generated insights using Server-Sent Events
 func (h *Handler) StreamAnalysisHandler(c *gin.Context) {
 	h.Logger.Info("Handling stream analysis request")
@@ -151,7 +529,7 @@ func (h *Handler) StreamAnalysisHandler(c *gin.Context) {
 	// Optional processed data ID parameter
 	processedID := c.Query("processed_id")
 	var processedDataID uint = 0
-	
+
 	if processedID != "" {
 		if id, err := strconv.ParseUint(processedID, 10, 32); err == nil {
 			processedDataID = uint(id)
@@ -164,18 +542,23 @@ func (h *Handler) StreamAnalysisHandler(c *gin.Context) {
 		}
 	}
 
-	// Since we're handling a long-running process with SSE, 
+	opts, ok := h.analysisOptions(c, services.AnalysisTypeReport)
+	if !ok {
+		return
+	}
+
+	// Since we're handling a long-running process with SSE,
 	// we need to disable Gin middleware timeouts and buffering
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-	
+
 	// Important to disable buffering for SSE
 	c.Writer.Flush()
 
 	// Stream the LLM analysis
-	h.LLMSvc.StreamLLMAnalysis(c.Writer, processedDataID)
+	h.LLMSvc.StreamLLMAnalysis(c.Request.Context(), c.Writer, processedDataID, opts, lastEventID(c))
 }
 
 // StreamAnalysisOpenAIHandler streams LLM-generated insights using OpenAI compatible format
@@ -185,7 +568,7 @@ func (h *Handler) StreamAnalysisOpenAIHandler(c *gin.Context) {
 	// Optional processed data ID parameter
 	processedID := c.Query("processed_id")
 	var processedDataID uint = 0
-	
+
 	if processedID != "" {
 		if id, err := strconv.ParseUint(processedID, 10, 32); err == nil {
 			processedDataID = uint(id)
@@ -198,15 +581,701 @@ func (h *Handler) StreamAnalysisOpenAIHandler(c *gin.Context) {
 		}
 	}
 
+	opts, ok := h.analysisOptions(c, services.AnalysisTypeReport)
+	if !ok {
+		return
+	}
+
 	// Set headers for streaming response
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-	
+
 	// Important to disable buffering for streaming
 	c.Writer.Flush()
 
 	// Stream the LLM analysis in OpenAI format
-	h.LLMSvc.StreamLLMAnalysisOpenAI(c.Writer, processedDataID)
-}
\ No newline at end of file
+	h.LLMSvc.StreamLLMAnalysisOpenAI(c.Request.Context(), c.Writer, processedDataID, opts, lastEventID(c))
+}
+
+// GetMetricSeriesHandler returns bucketed, aggregated time series for one or more metric keys
+func (h *Handler) GetMetricSeriesHandler(c *gin.Context) {
+	h.Logger.Info("Handling metric series request")
+
+	// Several keys may be requested at once as a comma-separated list
+	var keys []string
+	for _, key := range strings.Split(c.Param("key"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	to := time.Now()
+	if toParam := c.Query("to"); toParam != "" {
+		parsed, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'to' parameter. Please use RFC3339 format",
+			})
+			return
+		}
+		to = parsed
+	}
+
+	step, err := time.ParseDuration(c.DefaultQuery("step", "1h"))
+	if err != nil || step <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid 'step' parameter. Please use a duration such as 5m or 1h",
+		})
+		return
+	}
+
+	// The default window starts on a step boundary so that it can be served from rollups
+	from := to.Add(-24 * time.Hour).Truncate(step)
+	if fromParam := c.Query("from"); fromParam != "" {
+		parsed, err := time.Parse(time.RFC3339, fromParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'from' parameter. Please use RFC3339 format",
+			})
+			return
+		}
+		from = parsed
+	}
+
+	aggregation := c.DefaultQuery("agg", services.AggregationAvg)
+
+	query := services.SeriesQuery{
+		Keys:        keys,
+		From:        from,
+		To:          to,
+		Step:        step,
+		Aggregation: aggregation,
+		Version:     c.Query("version"),
+		Resolution:  c.DefaultQuery("resolution", services.ResolutionAuto),
+	}
+
+	series, err := h.MetricsSvc.QuerySeries(query)
+	if err != nil {
+		h.Logger.Errorw("Error querying metric series", "keys", keys, "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to query metric series: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"series":      series,
+		"from":        from,
+		"to":          to,
+		"step":        step.String(),
+		"aggregation": aggregation,
+	})
+}
+
+// RunRollupHandler recomputes the hourly or daily rollups of a time range, e.g. after late or
+// reprocessed data arrived
+func (h *Handler) RunRollupHandler(c *gin.Context) {
+	h.Logger.Info("Handling metric rollup request")
+
+	from, err := time.Parse(time.RFC3339, c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid or missing 'from' parameter. Please use RFC3339 format",
+		})
+		return
+	}
+
+	to := time.Now()
+	if toParam := c.Query("to"); toParam != "" {
+		parsed, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'to' parameter. Please use RFC3339 format",
+			})
+			return
+		}
+		to = parsed
+	}
+
+	resolutions := []string{services.ResolutionHourly, services.ResolutionDaily}
+	if resolution := c.Query("resolution"); resolution != "" {
+		resolutions = []string{resolution}
+	}
+
+	counts := gin.H{}
+	for _, resolution := range resolutions {
+		count, err := h.MetricsSvc.Rollup(resolution, from, to)
+		if err != nil {
+			h.Logger.Errorw("Error computing metric rollups", "resolution", resolution, "error", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Failed to compute rollups: " + err.Error(),
+			})
+			return
+		}
+		counts[resolution] = count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":    from,
+		"to":      to,
+		"rollups": counts,
+	})
+}
+
+// GetAnomaliesHandler returns the metric anomalies flagged by recent processing runs
+func (h *Handler) GetAnomaliesHandler(c *gin.Context) {
+	h.Logger.Info("Handling get anomalies request")
+
+	query := h.DB.Order("detected_at desc")
+
+	// Optional processed data ID and severity filters
+	if processedID := c.Query("processed_id"); processedID != "" {
+		id, err := strconv.ParseUint(processedID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid processed_id parameter",
+			})
+			return
+		}
+		query = query.Where("processed_data_id = ?", id)
+	}
+	if severity := c.Query("severity"); severity != "" {
+		query = query.Where("severity = ?", severity)
+	}
+
+	var anomalies []models.MetricAnomaly
+	if err := query.Limit(100).Find(&anomalies).Error; err != nil {
+		h.Logger.Errorw("Error fetching anomalies", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch anomalies: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"anomalies": anomalies,
+		"count":     len(anomalies),
+	})
+}
+
+// GetQualityChecksHandler returns the data-quality check results of a processing run
+func (h *Handler) GetQualityChecksHandler(c *gin.Context) {
+	h.Logger.Info("Handling get quality checks request")
+
+	// Optional processed data ID parameter, defaulting to the latest run
+	var processedData models.ProcessedData
+	var err error
+
+	if processedID := c.Query("processed_id"); processedID != "" {
+		id, parseErr := strconv.ParseUint(processedID, 10, 32)
+		if parseErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid processed_id parameter",
+			})
+			return
+		}
+		err = h.DB.First(&processedData, id).Error
+	} else {
+		err = h.DB.Order(services.LatestProcessedOrder).First(&processedData).Error
+	}
+
+	if err != nil {
+		h.Logger.Errorw("Error fetching processed data", "error", err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No processed data found",
+		})
+		return
+	}
+
+	var checks []models.QualityCheck
+	if err := h.DB.Where("processed_data_id = ?", processedData.ID).Order("id asc").Find(&checks).Error; err != nil {
+		h.Logger.Errorw("Error fetching quality checks", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch quality checks: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"processed_id":   processedData.ID,
+		"quality_status": processedData.QualityStatus,
+		"checks":         checks,
+		"count":          len(checks),
+	})
+}
+
+// GetCorrelationsHandler returns the metric correlations of the latest correlation run
+func (h *Handler) GetCorrelationsHandler(c *gin.Context) {
+	h.Logger.Info("Handling get correlations request")
+
+	var latest models.MetricCorrelation
+	if err := h.DB.Order("computed_at desc").First(&latest).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No correlations found",
+		})
+		return
+	}
+
+	query := h.DB.Where("computed_at = ?", latest.ComputedAt)
+
+	// Optional metric and strength filters
+	if metric := c.Query("metric"); metric != "" {
+		query = query.Where("metric_x = ? OR metric_y = ?", metric, metric)
+	}
+	if c.Query("strong") == "true" {
+		query = query.Where("strong = ?", true)
+	}
+
+	var correlations []models.MetricCorrelation
+	if err := query.Order("id asc").Find(&correlations).Error; err != nil {
+		h.Logger.Errorw("Error fetching correlations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch correlations: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"correlations": correlations,
+		"computed_at":  latest.ComputedAt,
+		"count":        len(correlations),
+	})
+}
+
+// RunCorrelationsHandler recomputes the correlations of all configured metric pairs
+func (h *Handler) RunCorrelationsHandler(c *gin.Context) {
+	h.Logger.Info("Handling run correlations request")
+
+	correlations, err := h.CorrelationSvc.Run()
+	if err != nil {
+		h.Logger.Errorw("Error computing correlations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to compute correlations: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"correlations": correlations,
+		"count":        len(correlations),
+	})
+}
+
+// GetForecastsHandler returns the metric forecasts of the latest forecasting run
+func (h *Handler) GetForecastsHandler(c *gin.Context) {
+	h.Logger.Info("Handling get forecasts request")
+
+	var latest models.MetricForecast
+	if err := h.DB.Order("generated_at desc").First(&latest).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No forecasts found",
+		})
+		return
+	}
+
+	query := h.DB.Where("generated_at = ?", latest.GeneratedAt)
+
+	// Optional metric and method filters
+	if metric := c.Query("metric"); metric != "" {
+		query = query.Where("metric = ?", metric)
+	}
+	if method := c.Query("method"); method != "" {
+		query = query.Where("method = ?", method)
+	}
+
+	var forecasts []models.MetricForecast
+	if err := query.Order("metric asc, method asc, steps_ahead asc").Find(&forecasts).Error; err != nil {
+		h.Logger.Errorw("Error fetching forecasts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch forecasts: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"forecasts":    forecasts,
+		"generated_at": latest.GeneratedAt,
+		"count":        len(forecasts),
+	})
+}
+
+// RunForecastsHandler evaluates past forecasts and forecasts all configured metrics
+func (h *Handler) RunForecastsHandler(c *gin.Context) {
+	h.Logger.Info("Handling run forecasts request")
+
+	forecasts, err := h.ForecastSvc.Run()
+	if err != nil {
+		h.Logger.Errorw("Error computing forecasts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to compute forecasts: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"forecasts": forecasts,
+		"count":     len(forecasts),
+	})
+}
+
+// EvaluateForecastsHandler records the actual values of past forecasts whose buckets have ended
+func (h *Handler) EvaluateForecastsHandler(c *gin.Context) {
+	h.Logger.Info("Handling evaluate forecasts request")
+
+	evaluated, err := h.ForecastSvc.Evaluate()
+	if err != nil {
+		h.Logger.Errorw("Error evaluating forecasts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to evaluate forecasts: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"evaluated": evaluated,
+	})
+}
+
+// GetForecastAccuracyHandler compares past forecasts with the actual values recorded for them by
+// the forecasting job or an evaluate request
+func (h *Handler) GetForecastAccuracyHandler(c *gin.Context) {
+	h.Logger.Info("Handling forecast accuracy request")
+
+	accuracy, err := h.ForecastSvc.Accuracy(c.Query("metric"))
+	if err != nil {
+		h.Logger.Errorw("Error computing forecast accuracy", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to compute forecast accuracy: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accuracy": accuracy,
+		"count":    len(accuracy),
+	})
+}
+
+// GetAnalysisLineageHandler walks from an LLM analysis back to the raw payloads behind it
+func (h *Handler) GetAnalysisLineageHandler(c *gin.Context) {
+	h.Logger.Info("Handling analysis lineage request")
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid analysis ID",
+		})
+		return
+	}
+
+	var llmAnalysis models.LLMAnalysis
+	if err := h.DB.Preload("ProcessedData.RawData").First(&llmAnalysis, id).Error; err != nil {
+		h.Logger.Errorw("Error fetching LLM analysis", "id", id, "error", err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No analysis found",
+		})
+		return
+	}
+
+	if llmAnalysis.ProcessedData == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Analysis has no recorded lineage",
+		})
+		return
+	}
+
+	processedData := llmAnalysis.ProcessedData
+	llmAnalysis.ProcessedData = nil
+
+	c.JSON(http.StatusOK, gin.H{
+		"analysis":       llmAnalysis,
+		"processed_data": processedData,
+		"raw_data":       processedData.RawData,
+	})
+}
+
+// GetProcessedLineageHandler returns the raw payloads behind processed data and the analyses made from it
+func (h *Handler) GetProcessedLineageHandler(c *gin.Context) {
+	h.Logger.Info("Handling processed data lineage request")
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid processed data ID",
+		})
+		return
+	}
+
+	var processedData models.ProcessedData
+	if err := h.DB.Preload("RawData").First(&processedData, id).Error; err != nil {
+		h.Logger.Errorw("Error fetching processed data", "id", id, "error", err)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No processed data found",
+		})
+		return
+	}
+
+	var analyses []models.LLMAnalysis
+	if err := h.DB.Where("processed_data_id = ?", processedData.ID).Order("generated_at desc").Find(&analyses).Error; err != nil {
+		h.Logger.Errorw("Error fetching LLM analyses", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch analyses: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"processed_data": processedData,
+		"raw_data":       processedData.RawData,
+		"analyses":       analyses,
+	})
+}
+
+// ReprocessHandler re-runs the raw data fetched within a time range through the current processor
+func (h *Handler) ReprocessHandler(c *gin.Context) {
+	h.Logger.Info("Handling reprocess request")
+
+	from, err := time.Parse(time.RFC3339, c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid or missing 'from' parameter. Please use RFC3339 format",
+		})
+		return
+	}
+
+	to := time.Now()
+	if toParam := c.Query("to"); toParam != "" {
+		parsed, err := time.Parse(time.RFC3339, toParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid 'to' parameter. Please use RFC3339 format",
+			})
+			return
+		}
+		to = parsed
+	}
+
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "'from' must be before 'to'",
+		})
+		return
+	}
+
+	summary, err := h.ProcessorSvc.Reprocess(from, to)
+	if err != nil {
+		h.Logger.Errorw("Error reprocessing raw data", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to reprocess raw data: " + err.Error(),
+		})
+		return
+	}
+
+	// Reprocessed history may lie before the rollup lookback, so its buckets are refreshed here
+	summary.Rollups, err = h.MetricsSvc.RollupProcessed(summary.Processed)
+	if err != nil {
+		h.Logger.Errorw("Error refreshing rollups of reprocessed data", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to refresh rollups: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// ListPromptsHandler lists the latest version of every prompt template, or every version with all=true
+func (h *Handler) ListPromptsHandler(c *gin.Context) {
+	h.Logger.Info("Handling list prompts request")
+
+	templates, err := h.PromptSvc.List(c.Query("all") == "true")
+	if err != nil {
+		h.Logger.Errorw("Error listing prompt templates", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list prompt templates: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"prompts":        templates,
+		"count":          len(templates),
+		"analysis_types": services.AnalysisTypes,
+	})
+}
+
+// GetPromptHandler returns every version of a prompt template, or one version with version=N
+func (h *Handler) GetPromptHandler(c *gin.Context) {
+	name := c.Param("name")
+	h.Logger.Infow("Handling get prompt request", "name", name)
+
+	if c.Query("version") != "" {
+		version, ok := h.promptVersion(c)
+		if !ok {
+			return
+		}
+		tmpl, err := h.PromptSvc.Get(name, version)
+		if err != nil {
+			h.promptError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"prompt": tmpl})
+		return
+	}
+
+	templates, err := h.PromptSvc.Versions(name)
+	if err != nil {
+		h.promptError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":     name,
+		"versions": templates,
+		"count":    len(templates),
+	})
+}
+
+// promptTemplateRequest is the body of the create and update prompt endpoints
+type promptTemplateRequest struct {
+	Name         string `json:"name"`
+	AnalysisType string `json:"analysis_type"`
+	Description  string `json:"description"`
+	System       string `json:"system"`
+	User         string `json:"user"`
+	Default      bool   `json:"default"`
+}
+
+func (r promptTemplateRequest) template() models.PromptTemplate {
+	return models.PromptTemplate{
+		Name:         r.Name,
+		AnalysisType: r.AnalysisType,
+		Description:  r.Description,
+		System:       r.System,
+		User:         r.User,
+		IsDefault:    r.Default,
+	}
+}
+
+// CreatePromptHandler stores version 1 of a new prompt template
+func (h *Handler) CreatePromptHandler(c *gin.Context) {
+	h.Logger.Info("Handling create prompt request")
+
+	var req promptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	tmpl, err := h.PromptSvc.Create(req.template())
+	if err != nil {
+		h.promptError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"prompt": tmpl})
+}
+
+// UpdatePromptHandler stores a new version of a prompt template; omitted fields are copied from
+// the latest version
+func (h *Handler) UpdatePromptHandler(c *gin.Context) {
+	name := c.Param("name")
+	h.Logger.Infow("Handling update prompt request", "name", name)
+
+	var req promptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if req.Name != "" && req.Name != name {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Prompt templates cannot be renamed",
+		})
+		return
+	}
+
+	tmpl, err := h.PromptSvc.Update(name, req.template())
+	if err != nil {
+		h.promptError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"prompt": tmpl})
+}
+
+// SetDefaultPromptHandler makes a prompt template version, the latest unless version=N is given,
+// the default of its analysis type
+func (h *Handler) SetDefaultPromptHandler(c *gin.Context) {
+	name := c.Param("name")
+	h.Logger.Infow("Handling set default prompt request", "name", name)
+
+	version := 0
+	if c.Query("version") != "" {
+		var ok bool
+		if version, ok = h.promptVersion(c); !ok {
+			return
+		}
+	}
+
+	tmpl, err := h.PromptSvc.SetDefault(name, version)
+	if err != nil {
+		h.promptError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"prompt": tmpl})
+}
+
+// DeletePromptHandler deletes a prompt template, or one version of it with version=N
+func (h *Handler) DeletePromptHandler(c *gin.Context) {
+	name := c.Param("name")
+	h.Logger.Infow("Handling delete prompt request", "name", name)
+
+	version := 0
+	if c.Query("version") != "" {
+		var ok bool
+		if version, ok = h.promptVersion(c); !ok {
+			return
+		}
+	}
+
+	deleted, err := h.PromptSvc.Delete(name, version)
+	if err != nil {
+		h.promptError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":    name,
+		"deleted": deleted,
+	})
+}
+
+// promptVersion parses the version query parameter, writing an error response and returning
+// false when it is not a positive integer
+func (h *Handler) promptVersion(c *gin.Context) (int, bool) {
+	version, err := strconv.Atoi(c.Query("version"))
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid 'version' parameter. Please use a positive integer",
+		})
+		return 0, false
+	}
+	return version, true
+}
+
+// promptError writes the response for a prompt service error
+func (h *Handler) promptError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPromptTemplateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidPromptTemplate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.Logger.Errorw("Error handling prompt template", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to handle prompt template: " + err.Error(),
+		})
+	}
+}
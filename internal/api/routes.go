@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/arkouda/PipelineIQ/internal/config"
@@ -17,7 +18,7 @@ func SetupRouter(db *gorm.DB, logger *zap.SugaredLogger, cfg *config.Config) *gi
 	// Health check endpoint
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
-			"status": "ok",
+			"status":  "ok",
 			"message": "pong",
 		})
 	})
@@ -28,24 +29,162 @@ func SetupRouter(db *gorm.DB, logger *zap.SugaredLogger, cfg *config.Config) *gi
 		APIURL2:       cfg.APIURL2,
 		WeatherAPIKey: cfg.WeatherAPIKey,
 	})
-	processorSvc := services.NewDataProcessorService(db, logger)
-	llmSvc := services.NewLLMService(db, logger, cfg.OpenAIAPIKey)
+	pipelineCfg, err := services.LoadPipelineConfig(cfg.PipelineConfigFile)
+	if err != nil {
+		logger.Fatalf("Failed to load pipeline config: %v", err)
+	}
+	processorSvc := services.NewDataProcessorService(db, logger, pipelineCfg)
+	llmProvider, err := services.NewProvider(services.ProviderConfig{
+		Provider:        cfg.LLMProvider,
+		BaseURL:         cfg.LLMBaseURL,
+		APIKey:          cfg.LLMAPIKey,
+		AzureDeployment: cfg.AzureDeployment,
+		AzureAPIVersion: cfg.AzureAPIVersion,
+		Timeout:         cfg.LLMTimeout,
+	})
+	if err != nil {
+		logger.Fatalf("Failed to create LLM provider: %v", err)
+	}
+	llmFallbacks, err := fallbackChain(cfg, llmProvider)
+	if err != nil {
+		logger.Fatalf("Failed to configure LLM fallbacks: %v", err)
+	}
+	llmPrices, err := services.ParsePriceTable(cfg.LLMPrices)
+	if err != nil {
+		logger.Fatalf("Failed to parse LLM prices: %v", err)
+	}
+	llmModel := cfg.LLMModel
+	if llmModel == "" {
+		llmModel = services.DefaultProviderModel(cfg.LLMProvider)
+	}
+	promptSvc := services.NewPromptService(db, logger)
+	if err := promptSvc.SeedDefaults(); err != nil {
+		logger.Fatalf("Failed to seed prompt templates: %v", err)
+	}
+	llmSvc := services.NewLLMService(db, logger, llmProvider, services.LLMSettings{
+		Defaults: services.ModelParams{
+			Model:       llmModel,
+			Temperature: cfg.LLMTemperature,
+			MaxTokens:   cfg.LLMMaxTokens,
+			TopP:        cfg.LLMTopP,
+			Stop:        cfg.LLMStop,
+		},
+		AllowedModels:     cfg.LLMAllowedModels,
+		MaxTokensLimit:    cfg.LLMMaxTokensLimit,
+		PromptBudget:      cfg.LLMPromptBudget,
+		ContextWindow:     cfg.LLMContextWindow,
+		LowPriorityKeys:   cfg.LLMLowPriorityKeys,
+		StructuredRetries: cfg.LLMStructuredRetries,
+		CacheTTL:          cfg.LLMCacheTTL,
+		CacheReplayDelay:  cfg.LLMCacheReplayDelay,
+		Prices:            llmPrices,
+		Budget: services.BudgetSettings{
+			Daily:          cfg.LLMDailyBudget,
+			Monthly:        cfg.LLMMonthlyBudget,
+			Action:         cfg.LLMBudgetAction,
+			DowngradeModel: cfg.LLMDowngradeModel,
+		},
+		Retry: services.RetrySettings{
+			MaxRetries: cfg.LLMMaxRetries,
+			BaseDelay:  cfg.LLMRetryBaseDelay,
+			MaxDelay:   cfg.LLMRetryMaxDelay,
+		},
+		Fallbacks:           llmFallbacks,
+		DiscardCancelled:    cfg.LLMCancelledStreams == "discard",
+		StreamDetachTimeout: cfg.LLMStreamDetachTimeout,
+		StreamFlushInterval: cfg.LLMStreamFlushInterval,
+	}, promptSvc)
+	metricsSvc := services.NewMetricsService(db, logger)
+	metricsSvc.StartRollups(cfg.RollupInterval, cfg.RollupLookback)
+	correlationSvc := services.NewCorrelationService(db, logger, pipelineCfg, metricsSvc)
+	forecastSvc := services.NewForecastService(db, logger, pipelineCfg, metricsSvc)
 
 	// Initialize handler with services
 	handler := &Handler{
-		DB:           db,
-		Logger:       logger,
-		IngestionSvc: ingestionSvc,
-		ProcessorSvc: processorSvc,
-		LLMSvc:       llmSvc,
+		DB:             db,
+		Logger:         logger,
+		IngestionSvc:   ingestionSvc,
+		ProcessorSvc:   processorSvc,
+		LLMSvc:         llmSvc,
+		MetricsSvc:     metricsSvc,
+		CorrelationSvc: correlationSvc,
+		ForecastSvc:    forecastSvc,
+		PromptSvc:      promptSvc,
 	}
 
 	// Set up API routes
 	r.POST("/fetch_and_process", handler.FetchAndProcessHandler)
 	r.GET("/results", handler.GetResultsHandler)
+	r.GET("/results/diff", handler.GetResultsDiffHandler)
 	r.GET("/analysis", handler.GetAnalysisHandler)
+	r.POST("/analysis/structured", handler.StructuredAnalysisHandler)
+	r.GET("/analysis/insights", handler.GetInsightsHandler)
+	r.GET("/usage", handler.GetUsageHandler)
 	r.GET("/stream_analysis", handler.StreamAnalysisHandler)
 	r.GET("/stream_analysis_openai", handler.StreamAnalysisOpenAIHandler)
+	r.GET("/metrics/:key/series", handler.GetMetricSeriesHandler)
+	r.POST("/metrics/rollup", handler.RunRollupHandler)
+	r.GET("/anomalies", handler.GetAnomaliesHandler)
+	r.GET("/quality", handler.GetQualityChecksHandler)
+	r.GET("/correlations", handler.GetCorrelationsHandler)
+	r.POST("/correlations/run", handler.RunCorrelationsHandler)
+	r.GET("/forecasts", handler.GetForecastsHandler)
+	r.POST("/forecasts/run", handler.RunForecastsHandler)
+	r.POST("/forecasts/evaluate", handler.EvaluateForecastsHandler)
+	r.GET("/forecasts/accuracy", handler.GetForecastAccuracyHandler)
+	r.GET("/lineage/analysis/:id", handler.GetAnalysisLineageHandler)
+	r.GET("/lineage/processed/:id", handler.GetProcessedLineageHandler)
+	r.POST("/reprocess", handler.ReprocessHandler)
+	r.GET("/prompts", handler.ListPromptsHandler)
+	r.POST("/prompts", handler.CreatePromptHandler)
+	r.GET("/prompts/:name", handler.GetPromptHandler)
+	r.PUT("/prompts/:name", handler.UpdatePromptHandler)
+	r.DELETE("/prompts/:name", handler.DeletePromptHandler)
+	r.POST("/prompts/:name/default", handler.SetDefaultPromptHandler)
 
 	return r
 }
+
+// fallbackChain creates the providers of the LLM_FALLBACKS chain. Entries for the primary provider
+// share its client; other providers use their own credentials from the environment.
+func fallbackChain(cfg *config.Config, primary services.Provider) ([]services.FallbackTarget, error) {
+	providers := map[string]services.Provider{primary.Name(): primary}
+	var chain []services.FallbackTarget
+	for _, entry := range cfg.LLMFallbacks {
+		name, model := services.ParseFallbackTarget(entry)
+		if name == "" {
+			name = primary.Name()
+		}
+		provider, ok := providers[name]
+		if !ok {
+			var err error
+			provider, err = services.NewProvider(fallbackProviderConfig(cfg, name))
+			if err != nil {
+				return nil, fmt.Errorf("fallback %q: %w", entry, err)
+			}
+			providers[name] = provider
+		}
+		if model == "" {
+			model = services.DefaultProviderModel(name)
+		}
+		chain = append(chain, services.FallbackTarget{Provider: provider, Model: model})
+	}
+	return chain, nil
+}
+
+// fallbackProviderConfig returns the connection settings of a fallback provider
+func fallbackProviderConfig(cfg *config.Config, name string) services.ProviderConfig {
+	pc := services.ProviderConfig{Provider: name, Timeout: cfg.LLMTimeout}
+	switch name {
+	case services.ProviderOpenAI:
+		pc.BaseURL, pc.APIKey = cfg.OpenAIBaseURL, cfg.OpenAIAPIKey
+	case services.ProviderAnthropic:
+		pc.BaseURL, pc.APIKey = cfg.AnthropicBaseURL, cfg.AnthropicAPIKey
+	case services.ProviderOllama:
+		pc.BaseURL = cfg.OllamaBaseURL
+	case services.ProviderAzure:
+		pc.BaseURL, pc.APIKey = cfg.AzureEndpoint, cfg.AzureAPIKey
+		pc.AzureDeployment, pc.AzureAPIVersion = cfg.AzureDeployment, cfg.AzureAPIVersion
+	}
+	return pc
+}
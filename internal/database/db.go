@@ -20,11 +20,36 @@ func Connect(dsn string) (*gorm.DB, error) {
 		&models.RawData{},
 		&models.ProcessedData{},
 		&models.LLMAnalysis{},
+		&models.MetricPoint{},
+		&models.MetricRollup{},
+		&models.MetricAnomaly{},
+		&models.QualityCheck{},
+		&models.MetricCorrelation{},
+		&models.MetricForecast{},
+		&models.PromptTemplate{},
+		&models.AnalysisInsight{},
+		&models.AnalysisChunk{},
 	)
 	if err != nil {
 		log.Printf("Error auto-migrating schema: %v", err)
 		return nil, err
 	}
 
+	// Entries processed before observation times were stored are ordered by their processing time
+	err = db.Model(&models.ProcessedData{}).Where("observed_at IS NULL").
+		Update("observed_at", gorm.Expr("processed_at")).Error
+	if err != nil {
+		log.Printf("Error backfilling observation times: %v", err)
+		return nil, err
+	}
+
+	// Analyses stored before statuses were recorded were always complete
+	err = db.Model(&models.LLMAnalysis{}).Where("status IS NULL OR status = ''").
+		Update("status", "completed").Error
+	if err != nil {
+		log.Printf("Error backfilling analysis statuses: %v", err)
+		return nil, err
+	}
+
 	return db, nil
 }
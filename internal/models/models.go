@@ -12,13 +12,26 @@ type RawData struct {
 	SourceName string
 	Content    string `gorm:"type:text"`
 	FetchedAt  time.Time
+	// RunID groups the entries fetched by the same ingestion run
+	RunID string `gorm:"index"`
 }
 
 // ProcessedData represents transformed data after processing raw data
 type ProcessedData struct {
 	gorm.Model
-	Content    string `gorm:"type:text"`
+	Content     string `gorm:"type:text"`
 	ProcessedAt time.Time
+	// ObservedAt is when the source data was observed; unlike ProcessedAt it is kept when a
+	// historical run is reprocessed, so it orders entries by the data they hold
+	ObservedAt    time.Time `gorm:"index"`
+	QualityStatus string    `gorm:"index"`
+	// ProcessorVersion and ConfigHash identify the logic and configuration that produced this entry
+	ProcessorVersion string `gorm:"index"`
+	ConfigHash       string `gorm:"index"`
+	// SourceRunID is the ingestion run the entry was processed from
+	SourceRunID string `gorm:"index"`
+	// RawData lists the raw payloads this entry was processed from
+	RawData []RawData `gorm:"many2many:processed_data_raw_data" json:",omitempty"`
 }
 
 // LLMAnalysis represents insights generated by an LLM
@@ -26,4 +39,186 @@ type LLMAnalysis struct {
 	gorm.Model
 	Content     string `gorm:"type:text"`
 	GeneratedAt time.Time
+	// ProcessedDataID references the processed data that was analyzed
+	ProcessedDataID *uint          `gorm:"index"`
+	ProcessedData   *ProcessedData `json:",omitempty"`
+	// Provider and the model parameters the analysis was generated with
+	Provider    string
+	ModelName   string `gorm:"index"`
+	Temperature *float64
+	MaxTokens   int
+	TopP        *float64
+	// Stop is the JSON-encoded list of stop sequences, if any
+	Stop string
+	// ServedProvider and ServedModel are the provider and model that produced the analysis,
+	// which differ from the requested ones when a fallback served it
+	ServedProvider string
+	ServedModel    string `gorm:"index"`
+	// AnalysisType, PromptName and PromptVersion identify the prompt template used
+	AnalysisType  string `gorm:"index"`
+	PromptName    string `gorm:"index"`
+	PromptVersion int
+	// Metadata is JSON describing how the prompt was built, including any data omitted to fit
+	// the prompt budget
+	Metadata string `gorm:"type:text"`
+	// Status is streaming while an analysis is generated, then completed, failed, or cancelled
+	// when its clients disconnected from the stream and Content is the partial output
+	Status string `gorm:"index"`
+	// Format is markdown for free-form analyses or structured for schema-validated JSON analyses,
+	// whose Content is Markdown rendered from Structured
+	Format     string `gorm:"index"`
+	Summary    string `gorm:"type:text"`
+	Structured string `gorm:"type:text"`
+	// Insights are the findings, trends, anomalies and recommendations of a structured analysis
+	Insights []AnalysisInsight `json:",omitempty"`
+	// Fingerprint hashes the provider, model, parameters and rendered prompt; analyses with the
+	// same fingerprint are served from the response cache
+	Fingerprint string `gorm:"index"`
+	// PromptTokens and CompletionTokens are the tokens reported by the provider, or estimated when
+	// UsageEstimated is set. CostUSD is computed from the model's price and unset when it has none.
+	PromptTokens     int
+	CompletionTokens int
+	UsageEstimated   bool
+	CostUSD          *float64
+	// Cached is set when the analysis was replayed from the response cache
+	Cached bool `gorm:"-" json:",omitempty"`
+}
+
+// AnalysisChunk is one streamed piece of an LLM analysis, kept so clients can resume a stream
+type AnalysisChunk struct {
+	gorm.Model
+	LLMAnalysisID uint `gorm:"uniqueIndex:idx_analysis_chunks_analysis_seq"`
+	// Seq numbers the chunks of an analysis from 1
+	Seq     int    `gorm:"uniqueIndex:idx_analysis_chunks_analysis_seq"`
+	Content string `gorm:"type:text"`
+}
+
+// AnalysisInsight is one item of a structured LLM analysis
+type AnalysisInsight struct {
+	gorm.Model
+	LLMAnalysisID uint `gorm:"index"`
+	// Kind is finding, trend, anomaly or recommendation
+	Kind   string `gorm:"index"`
+	Source string `gorm:"index"`
+	Metric string `gorm:"index"`
+	// Text is the finding, trend description, anomaly explanation or recommended action
+	Text string `gorm:"type:text"`
+	// Rationale explains a recommendation
+	Rationale string `gorm:"type:text"`
+	// Direction is the direction of a trend: up, down, flat or volatile
+	Direction string
+	// Severity is the severity of an anomaly and Priority the priority of a recommendation:
+	// low, medium or high
+	Severity   string `gorm:"index"`
+	Priority   string `gorm:"index"`
+	Confidence *float64
+}
+
+// PromptTemplate is one version of a named prompt template. Versions are immutable; editing a
+// template stores a new version.
+type PromptTemplate struct {
+	gorm.Model
+	Name         string `gorm:"uniqueIndex:idx_prompt_templates_name_version"`
+	Version      int    `gorm:"uniqueIndex:idx_prompt_templates_name_version"`
+	AnalysisType string `gorm:"index"`
+	Description  string
+	// System and User are text/template sources for the system and user messages
+	System string `gorm:"type:text"`
+	User   string `gorm:"type:text"`
+	// IsDefault marks the version used for its analysis type when a request names no template
+	IsDefault bool `gorm:"index"`
+}
+
+// MetricPoint represents a single numeric metric observation recorded by a processing run
+type MetricPoint struct {
+	gorm.Model
+	ProcessedDataID uint   `gorm:"index"`
+	Key             string `gorm:"index:idx_metric_points_key_observed"`
+	Value           float64
+	ObservedAt      time.Time `gorm:"index:idx_metric_points_key_observed"`
+	// ProcessorVersion is the version of the processor that produced the point
+	ProcessorVersion string `gorm:"index"`
+}
+
+// MetricRollup aggregates the points of a metric over an hourly or daily bucket
+type MetricRollup struct {
+	gorm.Model
+	Key            string    `gorm:"uniqueIndex:idx_metric_rollups_bucket"`
+	Resolution     string    `gorm:"uniqueIndex:idx_metric_rollups_bucket"`
+	BucketStart    time.Time `gorm:"uniqueIndex:idx_metric_rollups_bucket"`
+	Min            float64
+	Max            float64
+	Avg            float64
+	Sum            float64
+	Last           float64
+	Count          int64
+	LastObservedAt time.Time
+}
+
+// MetricAnomaly represents a metric value flagged as unusual compared to its history
+type MetricAnomaly struct {
+	gorm.Model
+	ProcessedDataID uint   `gorm:"index"`
+	Metric          string `gorm:"index"`
+	Method          string
+	Value           float64
+	Expected        float64
+	Score           float64
+	Threshold       float64
+	Severity        string `gorm:"index"`
+	Message         string `gorm:"type:text"`
+	DetectedAt      time.Time
+}
+
+// QualityCheck represents the outcome of a data-quality rule evaluated against a processing run
+type QualityCheck struct {
+	gorm.Model
+	ProcessedDataID uint `gorm:"index"`
+	Rule            string
+	Check           string
+	Metric          string
+	Severity        string
+	Passed          bool
+	Message         string `gorm:"type:text"`
+	CheckedAt       time.Time
+}
+
+// MetricCorrelation represents a correlation between two metrics computed over a window of history
+type MetricCorrelation struct {
+	gorm.Model
+	MetricX     string `gorm:"index"`
+	MetricY     string `gorm:"index"`
+	Method      string
+	Lag         int
+	LagSeconds  int64
+	Coefficient float64
+	SampleSize  int
+	// PValue is the two-sided significance of the coefficient, corrected for the lags tried
+	PValue      float64
+	Strong      bool
+	WindowStart time.Time
+	WindowEnd   time.Time
+	ComputedAt  time.Time `gorm:"index"`
+}
+
+// MetricForecast is one predicted step of a metric forecast, later compared against the actual value
+type MetricForecast struct {
+	gorm.Model
+	Metric      string `gorm:"index"`
+	Method      string
+	GeneratedAt time.Time `gorm:"index"`
+	// TargetAt is the start of the forecast bucket; StepSeconds is its length
+	TargetAt    time.Time `gorm:"index"`
+	StepSeconds int64
+	// StepsAhead is how many steps after the last observed bucket TargetAt lies
+	StepsAhead int
+	Value      float64
+	Lower      float64
+	Upper      float64
+	Confidence float64
+	// InPrompt marks forecasts that are reported to the LLM
+	InPrompt bool
+	// Actual is the observed bucket average, set once the bucket has passed and data is available
+	Actual      *float64
+	EvaluatedAt *time.Time `gorm:"index"`
 }
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	RegisterSourceAdapter("coincap", coinCapAdapter{})
+}
+
+// CoinCapAsset is the asset of a CoinCap /v2/assets/{id} response. CoinCap encodes all numbers
+// as strings.
+type CoinCapAsset struct {
+	ID                string        `json:"id"`
+	Rank              optionalFloat `json:"rank"`
+	Symbol            string        `json:"symbol"`
+	Name              string        `json:"name"`
+	Supply            optionalFloat `json:"supply"`
+	MaxSupply         optionalFloat `json:"maxSupply"`
+	MarketCapUsd      optionalFloat `json:"marketCapUsd"`
+	VolumeUsd24Hr     optionalFloat `json:"volumeUsd24Hr"`
+	PriceUsd          optionalFloat `json:"priceUsd"`
+	ChangePercent24Hr optionalFloat `json:"changePercent24Hr"`
+	Vwap24Hr          optionalFloat `json:"vwap24Hr"`
+}
+
+// CoinCapAssetResponse is a CoinCap /v2/assets/{id} response
+type CoinCapAssetResponse struct {
+	Data *CoinCapAsset `json:"data"`
+	// Timestamp is the time of the response in Unix milliseconds
+	Timestamp optionalFloat `json:"timestamp"`
+}
+
+// coinCapAdapter emits the price, market and supply metrics of a CoinCap asset
+type coinCapAdapter struct{}
+
+func (coinCapAdapter) Adapt(payload []byte) (MetricSet, map[string]string, error) {
+	var response CoinCapAssetResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, nil, fmt.Errorf("invalid CoinCap response: %w", err)
+	}
+	if response.Data == nil {
+		return nil, nil, fmt.Errorf("CoinCap response has no asset data")
+	}
+	asset := response.Data
+
+	m := newAdaptedMetrics()
+	m.value("asset", asset.ID)
+	m.value("symbol", strings.ToUpper(asset.Symbol))
+	m.number("rank", asset.Rank, "")
+	m.number("price_usd", asset.PriceUsd, "usd")
+	m.number("change_24h_pct", asset.ChangePercent24Hr, "percent")
+	m.number("market_cap_usd", asset.MarketCapUsd, "usd")
+	m.number("volume_24h_usd", asset.VolumeUsd24Hr, "usd")
+	m.number("vwap_24h_usd", asset.Vwap24Hr, "usd")
+	m.number("supply", asset.Supply, "")
+	m.number("max_supply", asset.MaxSupply, "")
+	m.number("source_timestamp_ms", response.Timestamp, "ms")
+
+	// Derived market metrics
+	if asset.PriceUsd.Valid && asset.Vwap24Hr.Valid && asset.Vwap24Hr.Value != 0 {
+		premium := optionalFloat{Value: asset.PriceUsd.Value - asset.Vwap24Hr.Value, Valid: true}
+		m.ratio("price_vs_vwap_pct", premium, asset.Vwap24Hr)
+	}
+	m.ratio("volume_to_market_cap_pct", asset.VolumeUsd24Hr, asset.MarketCapUsd)
+	m.ratio("supply_of_max_pct", asset.Supply, asset.MaxSupply)
+	if asset.PriceUsd.Valid && asset.ChangePercent24Hr.Valid && asset.ChangePercent24Hr.Value != -100 {
+		previous := asset.PriceUsd.Value / (1 + asset.ChangePercent24Hr.Value/100)
+		m.number("price_24h_ago_usd", optionalFloat{Value: previous, Valid: true}, "usd")
+		m.number("change_24h_usd", optionalFloat{Value: asset.PriceUsd.Value - previous, Valid: true}, "usd")
+	}
+
+	return m.metrics, m.units, nil
+}
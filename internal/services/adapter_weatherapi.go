@@ -0,0 +1,153 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+func init() {
+	RegisterSourceAdapter("weatherapi", weatherAPIAdapter{})
+}
+
+// WeatherAPILocation is the location block of a WeatherAPI response
+type WeatherAPILocation struct {
+	Name    string        `json:"name"`
+	Region  string        `json:"region"`
+	Country string        `json:"country"`
+	Lat     optionalFloat `json:"lat"`
+	Lon     optionalFloat `json:"lon"`
+}
+
+// WeatherAPICondition describes the weather condition in words
+type WeatherAPICondition struct {
+	Text string `json:"text"`
+	Code int    `json:"code"`
+}
+
+// WeatherAPICurrent is the current block of a WeatherAPI current.json or forecast.json response
+type WeatherAPICurrent struct {
+	LastUpdatedEpoch optionalFloat       `json:"last_updated_epoch"`
+	TempC            optionalFloat       `json:"temp_c"`
+	FeelslikeC       optionalFloat       `json:"feelslike_c"`
+	IsDay            optionalFloat       `json:"is_day"`
+	Condition        WeatherAPICondition `json:"condition"`
+	WindKph          optionalFloat       `json:"wind_kph"`
+	WindDegree       optionalFloat       `json:"wind_degree"`
+	WindDir          string              `json:"wind_dir"`
+	GustKph          optionalFloat       `json:"gust_kph"`
+	PressureMb       optionalFloat       `json:"pressure_mb"`
+	PrecipMm         optionalFloat       `json:"precip_mm"`
+	Humidity         optionalFloat       `json:"humidity"`
+	Cloud            optionalFloat       `json:"cloud"`
+	VisKm            optionalFloat       `json:"vis_km"`
+	UV               optionalFloat       `json:"uv"`
+}
+
+// WeatherAPIDay is the daily summary of a forecast day
+type WeatherAPIDay struct {
+	MaxtempC          optionalFloat       `json:"maxtemp_c"`
+	MintempC          optionalFloat       `json:"mintemp_c"`
+	AvgtempC          optionalFloat       `json:"avgtemp_c"`
+	MaxwindKph        optionalFloat       `json:"maxwind_kph"`
+	TotalprecipMm     optionalFloat       `json:"totalprecip_mm"`
+	Avghumidity       optionalFloat       `json:"avghumidity"`
+	DailyChanceOfRain optionalFloat       `json:"daily_chance_of_rain"`
+	UV                optionalFloat       `json:"uv"`
+	Condition         WeatherAPICondition `json:"condition"`
+}
+
+// WeatherAPIForecastDay is one day of a forecast.json response
+type WeatherAPIForecastDay struct {
+	Date string        `json:"date"`
+	Day  WeatherAPIDay `json:"day"`
+}
+
+// WeatherAPIResponse is a WeatherAPI current.json or forecast.json response
+type WeatherAPIResponse struct {
+	Location *WeatherAPILocation `json:"location"`
+	Current  *WeatherAPICurrent  `json:"current"`
+	Forecast *struct {
+		ForecastDay []WeatherAPIForecastDay `json:"forecastday"`
+	} `json:"forecast"`
+}
+
+// weatherAPIAdapter emits current conditions and, for forecast responses, one set of daily
+// metrics per forecast day prefixed with forecast_d<N>_
+type weatherAPIAdapter struct{}
+
+func (weatherAPIAdapter) Adapt(payload []byte) (MetricSet, map[string]string, error) {
+	var response WeatherAPIResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, nil, fmt.Errorf("invalid WeatherAPI response: %w", err)
+	}
+	if response.Current == nil {
+		return nil, nil, fmt.Errorf("WeatherAPI response has no current conditions")
+	}
+
+	m := newAdaptedMetrics()
+	if loc := response.Location; loc != nil {
+		m.value("location", loc.Name)
+		m.value("region", loc.Region)
+		m.value("country", loc.Country)
+		m.number("lat", loc.Lat, "degrees")
+		m.number("lon", loc.Lon, "degrees")
+	}
+
+	cur := response.Current
+	m.number("temp_c", cur.TempC, "celsius")
+	m.number("feelslike_c", cur.FeelslikeC, "celsius")
+	m.number("humidity_pct", cur.Humidity, "percent")
+	m.number("wind_kph", cur.WindKph, "kph")
+	m.number("gust_kph", cur.GustKph, "kph")
+	m.number("wind_degree", cur.WindDegree, "degrees")
+	m.value("wind_dir", cur.WindDir)
+	m.number("pressure_mb", cur.PressureMb, "mb")
+	m.number("precip_mm", cur.PrecipMm, "mm")
+	m.number("cloud_pct", cur.Cloud, "percent")
+	m.number("visibility_km", cur.VisKm, "km")
+	m.number("uv_index", cur.UV, "")
+	m.number("last_updated_epoch", cur.LastUpdatedEpoch, "s")
+	m.value("condition", cur.Condition.Text)
+	if cur.IsDay.Valid {
+		m.value("is_day", cur.IsDay.Value == 1)
+	}
+
+	// Derived comfort metrics
+	if cur.TempC.Valid && cur.FeelslikeC.Valid {
+		m.number("feelslike_delta_c", optionalFloat{Value: cur.FeelslikeC.Value - cur.TempC.Value, Valid: true}, "celsius")
+	}
+	if cur.TempC.Valid && cur.Humidity.Valid && cur.Humidity.Value > 0 {
+		dewPoint := dewPointC(cur.TempC.Value, cur.Humidity.Value)
+		m.number("dew_point_c", optionalFloat{Value: dewPoint, Valid: true}, "celsius")
+		m.number("dew_point_spread_c", optionalFloat{Value: cur.TempC.Value - dewPoint, Valid: true}, "celsius")
+	}
+
+	if response.Forecast != nil {
+		for i, day := range response.Forecast.ForecastDay {
+			prefix := fmt.Sprintf("forecast_d%d_", i)
+			m.value(prefix+"date", day.Date)
+			m.number(prefix+"maxtemp_c", day.Day.MaxtempC, "celsius")
+			m.number(prefix+"mintemp_c", day.Day.MintempC, "celsius")
+			m.number(prefix+"avgtemp_c", day.Day.AvgtempC, "celsius")
+			m.number(prefix+"maxwind_kph", day.Day.MaxwindKph, "kph")
+			m.number(prefix+"totalprecip_mm", day.Day.TotalprecipMm, "mm")
+			m.number(prefix+"humidity_pct", day.Day.Avghumidity, "percent")
+			m.number(prefix+"chance_of_rain_pct", day.Day.DailyChanceOfRain, "percent")
+			m.number(prefix+"uv_index", day.Day.UV, "")
+			m.value(prefix+"condition", day.Day.Condition.Text)
+			if day.Day.MaxtempC.Valid && day.Day.MintempC.Valid {
+				m.number(prefix+"temp_range_c", optionalFloat{Value: day.Day.MaxtempC.Value - day.Day.MintempC.Value, Valid: true}, "celsius")
+			}
+		}
+	}
+
+	return m.metrics, m.units, nil
+}
+
+// dewPointC approximates the dew point from temperature and relative humidity with the Magnus formula
+func dewPointC(tempC, humidityPct float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidityPct/100) + b*tempC/(c+tempC)
+	return c * gamma / (b - gamma)
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SourceAdapter decodes the payload of a known API into well-named metrics and their units
+type SourceAdapter interface {
+	Adapt(payload []byte) (MetricSet, map[string]string, error)
+}
+
+var (
+	sourceAdapterRegistryMu sync.RWMutex
+	sourceAdapterRegistry   = map[string]SourceAdapter{}
+)
+
+// RegisterSourceAdapter makes a source adapter available to the adapt transformer. It is meant to
+// be called from init functions and panics if the name is already registered.
+func RegisterSourceAdapter(name string, adapter SourceAdapter) {
+	sourceAdapterRegistryMu.Lock()
+	defer sourceAdapterRegistryMu.Unlock()
+
+	if _, exists := sourceAdapterRegistry[name]; exists {
+		panic(fmt.Sprintf("source adapter %q is already registered", name))
+	}
+	sourceAdapterRegistry[name] = adapter
+}
+
+// RegisteredSourceAdapters returns the sorted names of all registered source adapters
+func RegisteredSourceAdapters() []string {
+	sourceAdapterRegistryMu.RLock()
+	defer sourceAdapterRegistryMu.RUnlock()
+
+	names := make([]string, 0, len(sourceAdapterRegistry))
+	for name := range sourceAdapterRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterTransformer("adapt", newAdaptTransformer)
+}
+
+// AdaptedSource selects the adapter for a source and the prefix of the metrics it emits
+type AdaptedSource struct {
+	// Adapter is the registered adapter name, e.g. "coincap"
+	Adapter string `json:"adapter"`
+	// Prefix is prepended to every metric of the source, e.g. "btc_"
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// defaultAdaptedSources maps the built-in ingestion sources to their adapters
+var defaultAdaptedSources = map[string]AdaptedSource{
+	"CryptoAPI":  {Adapter: "coincap"},
+	"WeatherAPI": {Adapter: "weatherapi"},
+}
+
+// adaptTransformer replaces the payloads of sources with a known API by typed, unit-annotated
+// metrics. Payloads of other sources are passed on for later steps such as flatten.
+type adaptTransformer struct {
+	// Sources maps source names to adapters; defaults to CryptoAPI as coincap and WeatherAPI as weatherapi
+	Sources map[string]AdaptedSource `json:"sources"`
+
+	adapters map[string]SourceAdapter
+}
+
+func newAdaptTransformer(options json.RawMessage) (Transformer, error) {
+	t := &adaptTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	if len(t.Sources) == 0 {
+		t.Sources = defaultAdaptedSources
+	}
+
+	sourceAdapterRegistryMu.RLock()
+	defer sourceAdapterRegistryMu.RUnlock()
+
+	t.adapters = make(map[string]SourceAdapter, len(t.Sources))
+	for source, cfg := range t.Sources {
+		adapter, ok := sourceAdapterRegistry[cfg.Adapter]
+		if !ok {
+			return nil, fmt.Errorf("unknown adapter %q for source %s", cfg.Adapter, source)
+		}
+		t.adapters[source] = adapter
+	}
+	return t, nil
+}
+
+func (t *adaptTransformer) Name() string { return "adapt" }
+
+func (t *adaptTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	out := MetricSet{}
+	var diagnostics []Diagnostic
+
+	for source, value := range metrics {
+		adapter, ok := t.adapters[source]
+		if !ok {
+			out[source] = value
+			continue
+		}
+
+		payload, err := json.Marshal(value)
+		if err != nil {
+			return nil, diagnostics, fmt.Errorf("failed to encode payload of %s: %w", source, err)
+		}
+		adapted, units, err := adapter.Adapt(payload)
+		if err != nil {
+			// A payload the adapter cannot read, such as the placeholder of a failed fetch, is
+			// passed on unchanged so the other sources of the run are still processed
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DiagnosticWarn,
+				Message: fmt.Sprintf("could not adapt %s, passing it on unchanged: %v", source, err),
+			})
+			out[source] = value
+			continue
+		}
+
+		prefix := t.Sources[source].Prefix
+		for key, v := range adapted {
+			if _, exists := out[prefix+key]; exists {
+				diagnostics = append(diagnostics, Diagnostic{
+					Level:   DiagnosticWarn,
+					Message: fmt.Sprintf("%s overwrote metric %s; set a prefix for the source", source, prefix+key),
+				})
+			}
+			out[prefix+key] = v
+		}
+		for key, unit := range units {
+			ctx.Units[prefix+key] = unit
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Level:   DiagnosticInfo,
+			Message: fmt.Sprintf("adapted %s into %d metrics", source, len(adapted)),
+		})
+	}
+
+	return out, diagnostics, nil
+}
+
+// optionalFloat decodes a JSON number, a numeric string or null. APIs such as CoinCap encode
+// numbers as strings and omit unknown values as null.
+type optionalFloat struct {
+	Value float64
+	Valid bool
+}
+
+func (f *optionalFloat) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "null" || text == "" {
+		*f = optionalFloat{}
+		return nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s", data)
+	}
+	*f = optionalFloat{Value: value, Valid: true}
+	return nil
+}
+
+// adaptedMetrics collects the metrics and units emitted by an adapter, skipping missing values
+type adaptedMetrics struct {
+	metrics MetricSet
+	units   map[string]string
+}
+
+func newAdaptedMetrics() *adaptedMetrics {
+	return &adaptedMetrics{metrics: MetricSet{}, units: map[string]string{}}
+}
+
+// number records a numeric metric with its unit when the value is present
+func (a *adaptedMetrics) number(key string, value optionalFloat, unit string) {
+	if !value.Valid {
+		return
+	}
+	a.metrics[key] = value.Value
+	if unit != "" {
+		a.units[key] = unit
+	}
+}
+
+// value records a metric that needs no unit, skipping empty strings
+func (a *adaptedMetrics) value(key string, value interface{}) {
+	if str, ok := value.(string); ok && str == "" {
+		return
+	}
+	a.metrics[key] = value
+}
+
+// ratio records 100 * numerator / denominator as a percentage when both are present and the
+// denominator is not zero
+func (a *adaptedMetrics) ratio(key string, numerator, denominator optionalFloat) {
+	if numerator.Valid && denominator.Valid && denominator.Value != 0 {
+		a.number(key, optionalFloat{Value: numerator.Value / denominator.Value * 100, Valid: true}, "percent")
+	}
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestOptionalFloat(t *testing.T) {
+	tests := []struct {
+		input     string
+		want      optionalFloat
+		wantError bool
+	}{
+		{`"67000.5"`, optionalFloat{Value: 67000.5, Valid: true}, false},
+		{`12`, optionalFloat{Value: 12, Valid: true}, false},
+		{`null`, optionalFloat{}, false},
+		{`""`, optionalFloat{}, false},
+		{`"n/a"`, optionalFloat{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var got optionalFloat
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantError || got != tt.want {
+				t.Errorf("decoded %+v, %v; want %+v, error %v", got, err, tt.want, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestSourceAdapters(t *testing.T) {
+	tests := []struct {
+		name      string
+		adapter   SourceAdapter
+		payload   string
+		want      map[string]float64
+		wantUnits map[string]string
+		absent    []string
+		wantError string
+	}{
+		{
+			name:    "coincap asset",
+			adapter: coinCapAdapter{},
+			payload: `{"data": {"id": "bitcoin", "symbol": "btc", "rank": "1", "priceUsd": "110", "vwap24Hr": "100",
+				"changePercent24Hr": "10", "marketCapUsd": "1000", "volumeUsd24Hr": "50", "supply": "19", "maxSupply": null},
+				"timestamp": 1714560000000}`,
+			want: map[string]float64{
+				"price_usd": 110, "rank": 1, "price_vs_vwap_pct": 10, "volume_to_market_cap_pct": 5,
+				"price_24h_ago_usd": 100, "change_24h_usd": 10, "source_timestamp_ms": 1714560000000,
+			},
+			wantUnits: map[string]string{"price_usd": "usd", "change_24h_pct": "percent", "source_timestamp_ms": "ms"},
+			absent:    []string{"max_supply", "supply_of_max_pct"},
+		},
+		{
+			name:      "coincap without data",
+			adapter:   coinCapAdapter{},
+			payload:   `{"error": "not found"}`,
+			wantError: "no asset data",
+		},
+		{
+			name:    "weatherapi forecast",
+			adapter: weatherAPIAdapter{},
+			payload: `{"location": {"name": "London", "lat": 51.5},
+				"current": {"temp_c": 20, "feelslike_c": 18, "humidity": 100, "is_day": 1, "condition": {"text": "Rain"}},
+				"forecast": {"forecastday": [{"date": "2024-05-01", "day": {"maxtemp_c": 22, "mintemp_c": 12}}]}}`,
+			want: map[string]float64{
+				"temp_c": 20, "feelslike_delta_c": -2, "dew_point_c": 20, "dew_point_spread_c": 0,
+				"lat": 51.5, "forecast_d0_temp_range_c": 10,
+			},
+			wantUnits: map[string]string{"temp_c": "celsius", "humidity_pct": "percent", "forecast_d0_maxtemp_c": "celsius"},
+			absent:    []string{"wind_kph", "region", "forecast_d0_uv_index"},
+		},
+		{
+			name:      "weatherapi error payload",
+			adapter:   weatherAPIAdapter{},
+			payload:   `{"error": {"code": 1006, "message": "No matching location found."}}`,
+			wantError: "no current conditions",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, units, err := tt.adapter.Adapt([]byte(tt.payload))
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Adapt error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Adapt: %v", err)
+			}
+
+			for key, want := range tt.want {
+				if got, ok := metrics[key].(float64); !ok || math.Abs(got-want) > 1e-6 {
+					t.Errorf("%s = %v, want %g", key, metrics[key], want)
+				}
+			}
+			for key, want := range tt.wantUnits {
+				if units[key] != want {
+					t.Errorf("unit of %s = %q, want %q", key, units[key], want)
+				}
+			}
+			for _, key := range tt.absent {
+				if _, ok := metrics[key]; ok {
+					t.Errorf("missing value emitted as %s = %v", key, metrics[key])
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptTransformer(t *testing.T) {
+	transformer, err := newAdaptTransformer(json.RawMessage(`{"sources": {
+		"BTC": {"adapter": "coincap", "prefix": "btc_"},
+		"ETH": {"adapter": "coincap"},
+		"SOL": {"adapter": "coincap"}
+	}}`))
+	if err != nil {
+		t.Fatalf("newAdaptTransformer: %v", err)
+	}
+
+	asset := func(symbol string) map[string]interface{} {
+		return map[string]interface{}{"data": map[string]interface{}{"symbol": symbol, "priceUsd": "2"}}
+	}
+	ctx := &RunContext{Units: map[string]string{}}
+	out, diagnostics, err := transformer.Transform(ctx, MetricSet{
+		"BTC":     asset("btc"),
+		"ETH":     asset("eth"),
+		"SOL":     asset("sol"),
+		"Unknown": map[string]interface{}{"a": 1.0},
+	})
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+
+	if out["btc_symbol"] != "BTC" || out["btc_price_usd"] != 2.0 || ctx.Units["btc_price_usd"] != "usd" {
+		t.Errorf("prefixed metrics = %v with units %v", out, ctx.Units)
+	}
+	if _, ok := out["Unknown"].(map[string]interface{}); !ok {
+		t.Errorf("payload of a source without an adapter was not passed on: %v", out["Unknown"])
+	}
+
+	// ETH and SOL share unprefixed keys, so the second one overwrites the first
+	overwrites := 0
+	for _, d := range diagnostics {
+		if d.Level == DiagnosticWarn && strings.Contains(d.Message, "overwrote metric") {
+			overwrites++
+		}
+	}
+	if overwrites == 0 {
+		t.Errorf("diagnostics %v do not report the overwritten metrics", diagnostics)
+	}
+
+	if _, err := newAdaptTransformer(json.RawMessage(`{"sources": {"X": {"adapter": "nope"}}}`)); err == nil {
+		t.Error("expected an unknown adapter to be rejected")
+	}
+}
+
+func TestAdaptTransformerPassesOnUnreadablePayloads(t *testing.T) {
+	transformer, err := newAdaptTransformer(nil)
+	if err != nil {
+		t.Fatalf("newAdaptTransformer: %v", err)
+	}
+
+	failed := map[string]interface{}{"error": "fetch failed"}
+	out, diagnostics, err := transformer.Transform(&RunContext{Units: map[string]string{}}, MetricSet{"WeatherAPI": failed})
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+	if _, ok := out["WeatherAPI"].(map[string]interface{}); !ok {
+		t.Errorf("unreadable payload was not passed on: %v", out)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Level != DiagnosticWarn {
+		t.Errorf("diagnostics = %v, want one warning", diagnostics)
+	}
+}
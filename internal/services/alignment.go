@@ -0,0 +1,217 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+)
+
+// Alignment status of a source observation within a processed snapshot
+const (
+	// AlignmentAligned marks an observation within the alignment window of the snapshot time
+	AlignmentAligned = "aligned"
+	// AlignmentStale marks an observation outside the window for which no better one was found
+	AlignmentStale = "stale"
+	// AlignmentDropped marks a stale observation left out of the snapshot
+	AlignmentDropped = "dropped"
+)
+
+// AlignmentConfig joins source observations by the event timestamps in their payloads
+type AlignmentConfig struct {
+	// EventTime maps a source name to the dot-separated path of its event timestamp, e.g.
+	// {"CryptoAPI": "timestamp", "WeatherAPI": "current.last_updated_epoch"}. Sources without an
+	// entry use the time they were fetched.
+	EventTime map[string]string `json:"event_time"`
+	// Window is the largest lag behind the snapshot time at which an observation is aligned;
+	// defaults to "5m"
+	Window string `json:"window,omitempty"`
+	// AllowedLateness is how long after a run other fetches of a source may still supply an
+	// aligned observation, e.g. when reprocessing; defaults to "0s"
+	AllowedLateness string `json:"allowed_lateness,omitempty"`
+	// DropStale leaves stale observations out of the snapshot instead of marking them
+	DropStale bool `json:"drop_stale,omitempty"`
+}
+
+func (a AlignmentConfig) validate() error {
+	if _, _, err := a.durations(); err != nil {
+		return err
+	}
+	for source, path := range a.EventTime {
+		if path == "" {
+			return fmt.Errorf("event time path of %s is empty", source)
+		}
+	}
+	return nil
+}
+
+// durations parses the window and allowed lateness, applying defaults
+func (a AlignmentConfig) durations() (time.Duration, time.Duration, error) {
+	window, lateness := 5*time.Minute, time.Duration(0)
+	var err error
+	if a.Window != "" {
+		if window, err = time.ParseDuration(a.Window); err != nil {
+			return 0, 0, fmt.Errorf("invalid window: %w", err)
+		}
+	}
+	if a.AllowedLateness != "" {
+		if lateness, err = time.ParseDuration(a.AllowedLateness); err != nil {
+			return 0, 0, fmt.Errorf("invalid allowed_lateness: %w", err)
+		}
+	}
+	if window <= 0 || lateness < 0 {
+		return 0, 0, fmt.Errorf("window must be positive and allowed_lateness must not be negative")
+	}
+	return window, lateness, nil
+}
+
+// SourceAlignment describes how one source observation was placed in a snapshot
+type SourceAlignment struct {
+	Source    string    `json:"source"`
+	RawDataID uint      `json:"raw_data_id"`
+	EventTime time.Time `json:"event_time"`
+	// LagSeconds is how far the event time lies behind the snapshot time
+	LagSeconds float64 `json:"lag_seconds"`
+	Status     string  `json:"status"`
+	// Substituted is set when the observation came from another fetch than the run's own
+	Substituted bool `json:"substituted,omitempty"`
+}
+
+// Alignment records the snapshot time of a processing run and the alignment of every source
+type Alignment struct {
+	SnapshotTime time.Time         `json:"snapshot_time"`
+	Sources      []SourceAlignment `json:"sources"`
+}
+
+// alignRun joins the raw data entries of a run by their event times. The latest event time is the
+// snapshot time; sources lagging it by more than the window are replaced by a better-aligned fetch
+// of the same source when one exists, and otherwise marked stale or dropped. It returns the
+// entries to process, or the entries unchanged and nil when alignment is not configured.
+func (s *DataProcessorService) alignRun(rawDataEntries []models.RawData) ([]models.RawData, *Alignment, error) {
+	cfg := s.Config.Alignment
+	if cfg == nil || len(rawDataEntries) == 0 {
+		return rawDataEntries, nil, nil
+	}
+	window, lateness, err := cfg.durations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eventTimes := make([]time.Time, len(rawDataEntries))
+	alignment := &Alignment{}
+	for i, entry := range rawDataEntries {
+		eventTimes[i] = s.eventTime(entry)
+		if eventTimes[i].After(alignment.SnapshotTime) {
+			alignment.SnapshotTime = eventTimes[i]
+		}
+	}
+
+	fetchedAt := latestFetchedAt(rawDataEntries)
+	aligned := make([]models.RawData, 0, len(rawDataEntries))
+	for i, entry := range rawDataEntries {
+		eventTime, status, substituted := eventTimes[i], AlignmentAligned, false
+
+		if alignment.SnapshotTime.Sub(eventTime) > window {
+			replacement, replacementTime, found, err := s.closestObservation(entry.SourceName, alignment.SnapshotTime, window,
+				fetchedAt.Add(-window), fetchedAt.Add(lateness))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch {
+			case found:
+				entry, eventTime, substituted = replacement, replacementTime, true
+			case cfg.DropStale:
+				status = AlignmentDropped
+			default:
+				status = AlignmentStale
+			}
+		}
+
+		alignment.Sources = append(alignment.Sources, SourceAlignment{
+			Source:      entry.SourceName,
+			RawDataID:   entry.ID,
+			EventTime:   eventTime,
+			LagSeconds:  alignment.SnapshotTime.Sub(eventTime).Seconds(),
+			Status:      status,
+			Substituted: substituted,
+		})
+		if status != AlignmentDropped {
+			aligned = append(aligned, entry)
+		}
+	}
+
+	return aligned, alignment, nil
+}
+
+// closestObservation finds the fetch of a source within [fetchedFrom, fetchedTo] whose event time
+// is closest to the snapshot time and lies within the window of it
+func (s *DataProcessorService) closestObservation(source string, snapshot time.Time, window time.Duration, fetchedFrom, fetchedTo time.Time) (models.RawData, time.Time, bool, error) {
+	var candidates []models.RawData
+	err := s.DB.
+		Where("source_name = ? AND fetched_at >= ? AND fetched_at <= ?", source, fetchedFrom, fetchedTo).
+		Order("fetched_at desc").
+		Limit(50).
+		Find(&candidates).Error
+	if err != nil {
+		return models.RawData{}, time.Time{}, false, fmt.Errorf("failed to retrieve observations of %s: %w", source, err)
+	}
+
+	var best models.RawData
+	var bestTime time.Time
+	bestDistance := window + 1
+	for _, candidate := range candidates {
+		eventTime := s.eventTime(candidate)
+		distance := snapshot.Sub(eventTime)
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance < bestDistance {
+			best, bestTime, bestDistance = candidate, eventTime, distance
+		}
+	}
+	return best, bestTime, bestDistance <= window, nil
+}
+
+// eventTime reads the event timestamp of a raw data entry from the configured payload path,
+// falling back to the time it was fetched
+func (s *DataProcessorService) eventTime(entry models.RawData) time.Time {
+	path, ok := s.Config.Alignment.EventTime[entry.SourceName]
+	if !ok {
+		return entry.FetchedAt
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal([]byte(entry.Content), &payload); err != nil {
+		return entry.FetchedAt
+	}
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := payload.(map[string]interface{})
+		if !ok {
+			payload = nil
+			break
+		}
+		payload = object[segment]
+	}
+
+	if t, ok := toTime(payload); ok {
+		return t
+	}
+	s.Logger.Warnw("Event time not found in payload; using fetch time", "source", entry.SourceName, "path", path)
+	return entry.FetchedAt
+}
+
+// alignmentMetrics returns the lag and staleness markers of every source in a snapshot
+func alignmentMetrics(alignment *Alignment) map[string]interface{} {
+	metrics := make(map[string]interface{}, 2*len(alignment.Sources))
+	for _, src := range alignment.Sources {
+		if src.Status == AlignmentDropped {
+			continue
+		}
+		metrics["alignment_"+src.Source+"_lag_seconds"] = src.LagSeconds
+		metrics["alignment_"+src.Source+"_stale"] = src.Status == AlignmentStale
+	}
+	return metrics
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"gorm.io/gorm"
+)
+
+// rawDataRows answers a raw_data query with entries
+func rawDataRows(entries ...models.RawData) *stubRows {
+	rows := &stubRows{Columns: []string{"id", "created_at", "updated_at", "deleted_at", "source_name", "content", "fetched_at", "run_id"}}
+	for _, e := range entries {
+		rows.Rows = append(rows.Rows, []driver.Value{int64(e.ID), e.FetchedAt, e.FetchedAt, nil, e.SourceName, e.Content, e.FetchedAt, e.RunID})
+	}
+	return rows
+}
+
+func rawEntry(id uint, source string, fetchedAt, eventTime time.Time) models.RawData {
+	return models.RawData{
+		Model:      gorm.Model{ID: id},
+		SourceName: source,
+		Content:    fmt.Sprintf(`{"timestamp": %d}`, eventTime.Unix()),
+		FetchedAt:  fetchedAt,
+		RunID:      "run",
+	}
+}
+
+func TestAlignRun(t *testing.T) {
+	fetchedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	crypto := rawEntry(1, "CryptoAPI", fetchedAt, fetchedAt.Add(-time.Minute))
+	weather := rawEntry(2, "WeatherAPI", fetchedAt, fetchedAt.Add(-30*time.Minute))
+	closer := rawEntry(3, "WeatherAPI", fetchedAt.Add(-2*time.Minute), fetchedAt.Add(-3*time.Minute))
+	farther := rawEntry(4, "WeatherAPI", fetchedAt.Add(-4*time.Minute), fetchedAt.Add(-20*time.Minute))
+
+	tests := []struct {
+		name        string
+		dropStale   bool
+		candidates  []models.RawData
+		wantIDs     []uint
+		wantStatus  string
+		wantLookups int
+	}{
+		{"no better fetch marks stale", false, nil, []uint{1, 2}, AlignmentStale, 1},
+		{"no better fetch drops with drop_stale", true, nil, []uint{1}, AlignmentDropped, 1},
+		{"closest fetch within window is substituted", false, []models.RawData{farther, closer}, []uint{1, 3}, AlignmentAligned, 1},
+		{"fetches outside the window are ignored", false, []models.RawData{farther}, []uint{1, 2}, AlignmentStale, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &PipelineConfig{Alignment: &AlignmentConfig{
+				EventTime: map[string]string{"CryptoAPI": "timestamp", "WeatherAPI": "timestamp"},
+				DropStale: tt.dropStale,
+			}}
+			s, stub := newStubProcessor(t, config, func(q stubQuery) (*stubRows, error) {
+				if strings.Contains(q.SQL, `"raw_data"`) {
+					return rawDataRows(tt.candidates...), nil
+				}
+				return nil, nil
+			})
+
+			entries, alignment, err := s.alignRun([]models.RawData{crypto, weather})
+			if err != nil {
+				t.Fatalf("alignRun: %v", err)
+			}
+
+			var ids []uint
+			for _, e := range entries {
+				ids = append(ids, e.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) {
+				t.Errorf("entries = %v, want %v", ids, tt.wantIDs)
+			}
+			if want := fetchedAt.Add(-time.Minute); !alignment.SnapshotTime.Equal(want) {
+				t.Errorf("snapshot time = %s, want the latest event time %s", alignment.SnapshotTime, want)
+			}
+			if got := alignment.Sources[0].Status; got != AlignmentAligned {
+				t.Errorf("CryptoAPI status = %q, want aligned", got)
+			}
+			weatherSource := alignment.Sources[1]
+			if weatherSource.Status != tt.wantStatus {
+				t.Errorf("WeatherAPI status = %q, want %q", weatherSource.Status, tt.wantStatus)
+			}
+			if weatherSource.Substituted != (tt.wantStatus == AlignmentAligned) {
+				t.Errorf("WeatherAPI substituted = %v", weatherSource.Substituted)
+			}
+			if got := len(stub.statements(`"raw_data"`)); got != tt.wantLookups {
+				t.Errorf("%d raw_data lookups, want %d", got, tt.wantLookups)
+			}
+		})
+	}
+}
+
+func TestAlignRunWithinWindowNeedsNoLookup(t *testing.T) {
+	fetchedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	config := &PipelineConfig{Alignment: &AlignmentConfig{EventTime: map[string]string{"CryptoAPI": "timestamp"}}}
+	s, stub := newStubProcessor(t, config, nil)
+
+	entries := []models.RawData{
+		rawEntry(1, "CryptoAPI", fetchedAt, fetchedAt.Add(-2*time.Minute)),
+		// Without an event time path the fetch time is used
+		rawEntry(2, "WeatherAPI", fetchedAt, time.Time{}),
+	}
+	aligned, alignment, err := s.alignRun(entries)
+	if err != nil {
+		t.Fatalf("alignRun: %v", err)
+	}
+	if len(aligned) != 2 || len(stub.statements("")) != 0 {
+		t.Errorf("got %d entries and %d queries, want 2 entries and no queries", len(aligned), len(stub.statements("")))
+	}
+	if !alignment.SnapshotTime.Equal(fetchedAt) {
+		t.Errorf("snapshot time = %s, want %s", alignment.SnapshotTime, fetchedAt)
+	}
+	if got := alignment.Sources[0].LagSeconds; got != 120 {
+		t.Errorf("CryptoAPI lag = %g seconds, want 120", got)
+	}
+}
+
+func TestStaleSnapshotFailsFreshnessAgainstFetchTime(t *testing.T) {
+	// Every source is equally stale, so the snapshot time agrees with the event times; freshness
+	// must still be judged against the time the run was fetched
+	fetchedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	eventTime := fetchedAt.Add(-2 * time.Hour)
+	result := &ProcessedResult{
+		ObservedAt:      fetchedAt,
+		SnapshotAt:      eventTime,
+		CombinedMetrics: map[string]interface{}{"CryptoAPI_timestamp": float64(eventTime.Unix())},
+	}
+	s := &DataProcessorService{Config: &PipelineConfig{QualityRules: []QualityRule{
+		{Metric: "CryptoAPI_timestamp", Check: QualityCheckFreshness, MaxAge: "15m", Severity: QualitySeverityFail},
+	}}}
+
+	_, status, err := s.evaluateQualityRules(result)
+	if err != nil {
+		t.Fatalf("evaluateQualityRules: %v", err)
+	}
+	if status != QualityStatusFailed {
+		t.Errorf("status = %q, want failed", status)
+	}
+	for _, point := range metricPointsFromResult(1, result) {
+		if !point.ObservedAt.Equal(eventTime) {
+			t.Errorf("point %s stored at %s, want the snapshot time %s", point.Key, point.ObservedAt, eventTime)
+		}
+	}
+}
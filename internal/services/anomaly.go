@@ -0,0 +1,264 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+)
+
+// Supported anomaly detection methods
+const (
+	AnomalyMethodZScore    = "zscore"
+	AnomalyMethodPctChange = "pct_change"
+	AnomalyMethodIQR       = "iqr"
+)
+
+// Anomaly severities, ordered from least to most severe
+const (
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
+// AnomalyRule configures a statistical test applied to every metric matching a glob pattern
+type AnomalyRule struct {
+	// Metric is a glob pattern matched against metric keys, e.g. "CryptoAPI_*"
+	Metric string `json:"metric"`
+	// Method is one of zscore, pct_change or iqr
+	Method string `json:"method"`
+	// Window is the number of historical points the test looks at
+	Window int `json:"window,omitempty"`
+	// Threshold is the z-score, percent change or IQR multiplier above which a value is flagged
+	Threshold float64 `json:"threshold,omitempty"`
+	// MinHistory is the number of historical points required before the test runs
+	MinHistory int `json:"min_history,omitempty"`
+}
+
+// Anomaly describes a metric value flagged as unusual compared to its history
+type Anomaly struct {
+	Metric    string  `json:"metric"`
+	Method    string  `json:"method"`
+	Value     float64 `json:"value"`
+	Expected  float64 `json:"expected"`
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"threshold"`
+	Severity  string  `json:"severity"`
+	Message   string  `json:"message"`
+}
+
+func (r AnomalyRule) validate() error {
+	if r.Metric == "" {
+		return fmt.Errorf("metric pattern is required")
+	}
+	switch r.Method {
+	case AnomalyMethodZScore, AnomalyMethodPctChange, AnomalyMethodIQR:
+	default:
+		return fmt.Errorf("unsupported method: %s", r.Method)
+	}
+	if r.Window < 0 || r.Threshold < 0 || r.MinHistory < 0 {
+		return fmt.Errorf("window, threshold and min_history must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills in the window, threshold and minimum history of a rule when unset
+func (r AnomalyRule) withDefaults() AnomalyRule {
+	if r.Window == 0 {
+		r.Window = 30
+	}
+	if r.Threshold == 0 {
+		switch r.Method {
+		case AnomalyMethodZScore:
+			r.Threshold = 3
+		case AnomalyMethodPctChange:
+			r.Threshold = 20
+		case AnomalyMethodIQR:
+			r.Threshold = 1.5
+		}
+	}
+	if r.MinHistory == 0 {
+		if r.Method == AnomalyMethodPctChange {
+			r.MinHistory = 1
+		} else {
+			r.MinHistory = 5
+		}
+	}
+	return r
+}
+
+// detectAnomalies compares the numeric metrics of a run with their stored history using the
+// configured rules. Only history observed before the run is considered; the history of every
+// matched metric is loaded in a single query covering the largest window of its rules.
+func (s *DataProcessorService) detectAnomalies(metrics map[string]float64, observedAt time.Time) ([]Anomaly, error) {
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rules := make([]AnomalyRule, len(s.Config.AnomalyRules))
+	matched := []string{}
+	window := 0
+	seen := make(map[string]bool)
+	for i, rule := range s.Config.AnomalyRules {
+		rules[i] = rule.withDefaults()
+		for _, key := range keys {
+			if !matchGlob(rules[i].Metric, key) {
+				continue
+			}
+			if !seen[key] {
+				seen[key] = true
+				matched = append(matched, key)
+			}
+			if rules[i].Window > window {
+				window = rules[i].Window
+			}
+		}
+	}
+
+	anomalies := []Anomaly{}
+	if len(matched) == 0 {
+		return anomalies, nil
+	}
+	history, err := s.metricHistories(matched, window, observedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		for _, key := range keys {
+			if !matchGlob(rule.Metric, key) {
+				continue
+			}
+
+			values := history[key]
+			if len(values) > rule.Window {
+				values = values[len(values)-rule.Window:]
+			}
+			if len(values) < rule.MinHistory {
+				continue
+			}
+
+			if anomaly, flagged := evaluateAnomalyRule(rule, key, metrics[key], values); flagged {
+				anomalies = append(anomalies, anomaly)
+			}
+		}
+	}
+
+	return anomalies, nil
+}
+
+// metricHistory returns up to limit of the most recent values of a metric observed before a
+// point in time, in chronological order
+func (s *DataProcessorService) metricHistory(key string, limit int, before time.Time) ([]float64, error) {
+	history, err := s.metricHistories([]string{key}, limit, before)
+	if err != nil {
+		return nil, err
+	}
+	return history[key], nil
+}
+
+// metricHistories returns up to limit of the most recent values of each metric observed before a
+// point in time, in chronological order, ranking the points of every metric in one query
+func (s *DataProcessorService) metricHistories(keys []string, limit int, before time.Time) (map[string][]float64, error) {
+	var points []models.MetricPoint
+	latest := latestMetricPoints(s.DB, "").Where("key IN ? AND observed_at < ?", keys, before)
+	ranked := s.DB.Table("(?) AS p", latest).
+		Select("p.*, ROW_NUMBER() OVER (PARTITION BY p.key ORDER BY p.observed_at DESC) AS recency")
+	err := s.DB.Table("(?) AS r", ranked).
+		Where("recency <= ?", limit).
+		Order("key, observed_at").
+		Find(&points).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve metric history: %w", err)
+	}
+
+	history := make(map[string][]float64, len(keys))
+	for _, p := range points {
+		history[p.Key] = append(history[p.Key], p.Value)
+	}
+	return history, nil
+}
+
+// evaluateAnomalyRule applies a single statistical test to a value and its history
+func evaluateAnomalyRule(rule AnomalyRule, key string, value float64, history []float64) (Anomaly, bool) {
+	anomaly := Anomaly{
+		Metric:    key,
+		Method:    rule.Method,
+		Value:     value,
+		Threshold: rule.Threshold,
+	}
+
+	switch rule.Method {
+	case AnomalyMethodZScore:
+		m, sd := mean(history), stddev(history)
+		if sd == 0 {
+			return anomaly, false
+		}
+		anomaly.Expected = m
+		anomaly.Score = (value - m) / sd
+		anomaly.Message = fmt.Sprintf("%s is %.2f standard deviations from its rolling mean of %.4g", key, anomaly.Score, m)
+
+	case AnomalyMethodPctChange:
+		previous := history[len(history)-1]
+		if previous == 0 {
+			return anomaly, false
+		}
+		anomaly.Expected = previous
+		anomaly.Score = (value - previous) / math.Abs(previous) * 100
+		anomaly.Message = fmt.Sprintf("%s changed by %.2f%% since the previous run (%.4g)", key, anomaly.Score, previous)
+
+	case AnomalyMethodIQR:
+		q1, q3 := quantile(history, 0.25), quantile(history, 0.75)
+		iqr := q3 - q1
+		if iqr == 0 {
+			return anomaly, false
+		}
+		anomaly.Expected = quantile(history, 0.5)
+		switch {
+		case value > q3:
+			anomaly.Score = (value - q3) / iqr
+		case value < q1:
+			anomaly.Score = -(q1 - value) / iqr
+		}
+		anomaly.Message = fmt.Sprintf("%s lies %.2f IQRs outside the interquartile range [%.4g, %.4g]", key, math.Abs(anomaly.Score), q1, q3)
+	}
+
+	ratio := math.Abs(anomaly.Score) / rule.Threshold
+	if ratio < 1 {
+		return anomaly, false
+	}
+
+	switch {
+	case ratio >= 2:
+		anomaly.Severity = SeverityHigh
+	case ratio >= 1.5:
+		anomaly.Severity = SeverityMedium
+	default:
+		anomaly.Severity = SeverityLow
+	}
+	return anomaly, true
+}
+
+// anomalyRecords converts detected anomalies into rows linked to a processed data entry
+func anomalyRecords(processedDataID uint, detectedAt time.Time, anomalies []Anomaly) []models.MetricAnomaly {
+	records := make([]models.MetricAnomaly, len(anomalies))
+	for i, a := range anomalies {
+		records[i] = models.MetricAnomaly{
+			ProcessedDataID: processedDataID,
+			Metric:          a.Metric,
+			Method:          a.Method,
+			Value:           a.Value,
+			Expected:        a.Expected,
+			Score:           a.Score,
+			Threshold:       a.Threshold,
+			Severity:        a.Severity,
+			Message:         a.Message,
+			DetectedAt:      detectedAt,
+		}
+	}
+	return records
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateAnomalyRule(t *testing.T) {
+	steady := []float64{10, 11, 9, 10, 11, 9, 10, 10}
+
+	tests := []struct {
+		name         string
+		rule         AnomalyRule
+		value        float64
+		history      []float64
+		wantFlagged  bool
+		wantSeverity string
+	}{
+		{"zscore within threshold", AnomalyRule{Method: AnomalyMethodZScore}, 10.5, steady, false, ""},
+		{"zscore far above", AnomalyRule{Method: AnomalyMethodZScore}, 20, steady, true, SeverityHigh},
+		{"zscore just above", AnomalyRule{Method: AnomalyMethodZScore, Threshold: 2}, 11.6, steady, true, SeverityLow},
+		{"zscore flat history", AnomalyRule{Method: AnomalyMethodZScore}, 50, []float64{5, 5, 5, 5, 5}, false, ""},
+		{"pct_change within threshold", AnomalyRule{Method: AnomalyMethodPctChange}, 110, []float64{100}, false, ""},
+		{"pct_change drop", AnomalyRule{Method: AnomalyMethodPctChange}, 65, []float64{100}, true, SeverityMedium},
+		{"pct_change from zero", AnomalyRule{Method: AnomalyMethodPctChange}, 65, []float64{0}, false, ""},
+		{"iqr inside range", AnomalyRule{Method: AnomalyMethodIQR}, 10, steady, false, ""},
+		{"iqr above", AnomalyRule{Method: AnomalyMethodIQR}, 20, steady, true, SeverityHigh},
+		{"iqr below", AnomalyRule{Method: AnomalyMethodIQR}, 5, []float64{10, 12, 14, 16, 18}, true, SeverityLow},
+		{"iqr flat history", AnomalyRule{Method: AnomalyMethodIQR}, 50, []float64{5, 5, 5, 5, 5}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anomaly, flagged := evaluateAnomalyRule(tt.rule.withDefaults(), "metric", tt.value, tt.history)
+			if flagged != tt.wantFlagged {
+				t.Fatalf("flagged = %v, want %v (score %g)", flagged, tt.wantFlagged, anomaly.Score)
+			}
+			if flagged && anomaly.Severity != tt.wantSeverity {
+				t.Errorf("severity = %q, want %q (score %g)", anomaly.Severity, tt.wantSeverity, anomaly.Score)
+			}
+		})
+	}
+}
+
+// metricPointRows answers a metric_points query with the history of each key in order
+func metricPointRows(history map[string][]float64, observedAt time.Time) *stubRows {
+	rows := &stubRows{Columns: []string{"id", "created_at", "updated_at", "deleted_at", "processed_data_id", "key", "value", "observed_at", "processor_version", "recency"}}
+	id := int64(0)
+	for key, values := range history {
+		for i, v := range values {
+			id++
+			at := observedAt.Add(time.Duration(i-len(values)) * time.Hour)
+			rows.Rows = append(rows.Rows, []driver.Value{id, at, at, nil, id, key, v, at, ProcessorVersion, int64(len(values) - i)})
+		}
+	}
+	return rows
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	observedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := map[string][]float64{
+		"CryptoAPI_price":  {10, 11, 9, 10, 11, 9, 10, 10},
+		"CryptoAPI_volume": {5, 6, 7},
+	}
+	metrics := map[string]float64{"CryptoAPI_price": 20, "CryptoAPI_volume": 100, "WeatherAPI_temp": 40}
+
+	tests := []struct {
+		name      string
+		rules     []AnomalyRule
+		wantFlags []string
+		wantLimit int
+	}{
+		{"zscore and iqr share one query", []AnomalyRule{
+			{Metric: "CryptoAPI_*", Method: AnomalyMethodZScore, Window: 10},
+			{Metric: "CryptoAPI_price", Method: AnomalyMethodIQR, Window: 20},
+		}, []string{"CryptoAPI_price/zscore", "CryptoAPI_price/iqr"}, 20},
+		{"history exactly at the minimum", []AnomalyRule{
+			{Metric: "CryptoAPI_price", Method: AnomalyMethodZScore, MinHistory: 8},
+		}, []string{"CryptoAPI_price/zscore"}, 30},
+		{"history below the minimum", []AnomalyRule{
+			{Metric: "CryptoAPI_price", Method: AnomalyMethodZScore, MinHistory: 9},
+		}, nil, 30},
+		{"history is cut to the window", []AnomalyRule{
+			{Metric: "CryptoAPI_price", Method: AnomalyMethodZScore, Window: 4, MinHistory: 5},
+		}, nil, 4},
+		{"metrics with short history are skipped", []AnomalyRule{
+			{Metric: "CryptoAPI_volume", Method: AnomalyMethodZScore, MinHistory: 5},
+			{Metric: "CryptoAPI_volume", Method: AnomalyMethodPctChange},
+		}, []string{"CryptoAPI_volume/pct_change"}, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, stub := newStubProcessor(t, &PipelineConfig{AnomalyRules: tt.rules}, func(q stubQuery) (*stubRows, error) {
+				return metricPointRows(history, observedAt), nil
+			})
+
+			anomalies, err := s.detectAnomalies(metrics, observedAt)
+			if err != nil {
+				t.Fatalf("detectAnomalies: %v", err)
+			}
+			var flags []string
+			for _, a := range anomalies {
+				flags = append(flags, a.Metric+"/"+a.Method)
+			}
+			if strings.Join(flags, ",") != strings.Join(tt.wantFlags, ",") {
+				t.Errorf("anomalies = %v, want %v", flags, tt.wantFlags)
+			}
+
+			queries := stub.statements(`"metric_points"`)
+			if len(queries) != 1 {
+				t.Fatalf("%d history queries, want 1", len(queries))
+			}
+			args := queries[0].Args
+			if got := fmt.Sprint(args[len(args)-1]); got != fmt.Sprint(tt.wantLimit) {
+				t.Errorf("per-metric limit = %v, want %d", args[len(args)-1], tt.wantLimit)
+			}
+			for _, arg := range args {
+				if arg == "WeatherAPI_temp" {
+					t.Error("history of an unmatched metric was loaded")
+				}
+			}
+		})
+	}
+}
+
+func TestDetectAnomaliesWithoutMatchesSkipsQuery(t *testing.T) {
+	s, stub := newStubProcessor(t, &PipelineConfig{AnomalyRules: []AnomalyRule{
+		{Metric: "CryptoAPI_*", Method: AnomalyMethodZScore},
+	}}, nil)
+
+	anomalies, err := s.detectAnomalies(map[string]float64{"WeatherAPI_temp": 40}, time.Now())
+	if err != nil {
+		t.Fatalf("detectAnomalies: %v", err)
+	}
+	if len(anomalies) != 0 || len(stub.statements("")) != 0 {
+		t.Errorf("got %d anomalies and %d queries, want none", len(anomalies), len(stub.statements("")))
+	}
+}
@@ -0,0 +1,258 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Supported correlation methods
+const (
+	CorrelationPearson  = "pearson"
+	CorrelationSpearman = "spearman"
+)
+
+// defaultCorrelationFactThreshold is the absolute coefficient above which a correlation is
+// considered strong when the pipeline config does not set one
+const defaultCorrelationFactThreshold = 0.7
+
+// defaultCorrelationMinSamples is the number of aligned points a correlation needs to be
+// considered strong when the pipeline config does not set one
+const defaultCorrelationMinSamples = 20
+
+// correlationSignificance is the p-value below which a correlation can be considered strong
+const correlationSignificance = 0.05
+
+// CorrelationPair configures a correlation computed between two metrics over their history
+type CorrelationPair struct {
+	// X and Y are the metric keys to correlate, e.g. "CryptoAPI_data_priceUsd"
+	X string `json:"x"`
+	Y string `json:"y"`
+	// Window is how much history is correlated; defaults to "168h"
+	Window string `json:"window,omitempty"`
+	// Step is the bucket size both series are averaged into before correlating; defaults to "1h"
+	Step string `json:"step,omitempty"`
+	// MaxLag is the largest shift, in steps, tried for lagged correlations. A positive lag means
+	// Y follows X.
+	MaxLag int `json:"max_lag,omitempty"`
+}
+
+func (p CorrelationPair) validate() error {
+	if p.X == "" || p.Y == "" {
+		return fmt.Errorf("x and y metric keys are required")
+	}
+	if _, _, err := p.durations(); err != nil {
+		return err
+	}
+	if p.MaxLag < 0 {
+		return fmt.Errorf("max_lag must not be negative")
+	}
+	return nil
+}
+
+// durations parses the window and step of a pair, applying defaults
+func (p CorrelationPair) durations() (time.Duration, time.Duration, error) {
+	window, step := 168*time.Hour, time.Hour
+	var err error
+	if p.Window != "" {
+		if window, err = time.ParseDuration(p.Window); err != nil {
+			return 0, 0, fmt.Errorf("invalid window: %w", err)
+		}
+	}
+	if p.Step != "" {
+		if step, err = time.ParseDuration(p.Step); err != nil {
+			return 0, 0, fmt.Errorf("invalid step: %w", err)
+		}
+	}
+	if window <= 0 || step <= 0 || step > window {
+		return 0, 0, fmt.Errorf("window and step must be positive and step must not exceed window")
+	}
+	return window, step, nil
+}
+
+// CorrelationService computes correlations between configured metric pairs across history
+type CorrelationService struct {
+	DB      *gorm.DB
+	Logger  *zap.SugaredLogger
+	Config  *PipelineConfig
+	Metrics *MetricsService
+}
+
+// NewCorrelationService creates a new CorrelationService instance
+func NewCorrelationService(db *gorm.DB, logger *zap.SugaredLogger, config *PipelineConfig, metrics *MetricsService) *CorrelationService {
+	return &CorrelationService{
+		DB:      db,
+		Logger:  logger,
+		Config:  config,
+		Metrics: metrics,
+	}
+}
+
+// Run computes Pearson, Spearman and best lagged correlations for every configured pair and
+// stores them as one batch sharing the same computation time
+func (s *CorrelationService) Run() ([]models.MetricCorrelation, error) {
+	s.Logger.Infow("Starting correlation analysis", "pairs", len(s.Config.Correlations))
+
+	computedAt := time.Now()
+	threshold := s.Config.CorrelationFactThreshold
+	if threshold == 0 {
+		threshold = defaultCorrelationFactThreshold
+	}
+	minSamples := s.Config.CorrelationMinSamples
+	if minSamples == 0 {
+		minSamples = defaultCorrelationMinSamples
+	}
+
+	results := []models.MetricCorrelation{}
+	for _, pair := range s.Config.Correlations {
+		correlations, err := s.correlatePair(pair, computedAt, threshold, minSamples)
+		if err != nil {
+			return nil, fmt.Errorf("failed to correlate %s and %s: %w", pair.X, pair.Y, err)
+		}
+		results = append(results, correlations...)
+	}
+
+	if len(results) > 0 {
+		if err := s.DB.Create(&results).Error; err != nil {
+			return nil, fmt.Errorf("failed to store correlations: %w", err)
+		}
+	}
+
+	s.Logger.Infow("Correlation analysis completed", "results", len(results))
+	return results, nil
+}
+
+// correlatePair aligns the history of both metrics of a pair and correlates them
+func (s *CorrelationService) correlatePair(pair CorrelationPair, computedAt time.Time, threshold float64, minSamples int) ([]models.MetricCorrelation, error) {
+	window, step, err := pair.durations()
+	if err != nil {
+		return nil, err
+	}
+
+	from := computedAt.Add(-window)
+	series, err := s.Metrics.QuerySeries(SeriesQuery{
+		Keys:        []string{pair.X, pair.Y},
+		From:        from,
+		To:          computedAt,
+		Step:        step,
+		Aggregation: AggregationAvg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	xs, ys := bucketValues(series[0]), bucketValues(series[1])
+	newCorrelation := func(method string, lag int, coefficient float64, samples, tests int) models.MetricCorrelation {
+		pValue := correlationPValue(coefficient, samples, tests)
+		return models.MetricCorrelation{
+			MetricX:     pair.X,
+			MetricY:     pair.Y,
+			Method:      method,
+			Lag:         lag,
+			LagSeconds:  int64(time.Duration(lag) * step / time.Second),
+			Coefficient: coefficient,
+			SampleSize:  samples,
+			PValue:      pValue,
+			Strong:      isStrongCorrelation(coefficient, samples, pValue, threshold, minSamples),
+			WindowStart: from,
+			WindowEnd:   computedAt,
+			ComputedAt:  computedAt,
+		}
+	}
+
+	results := []models.MetricCorrelation{}
+
+	x, y := alignBuckets(xs, ys, 0, step)
+	if r, ok := pearson(x, y); ok {
+		results = append(results, newCorrelation(CorrelationPearson, 0, r, len(x), 1))
+	}
+	if r, ok := spearman(x, y); ok {
+		results = append(results, newCorrelation(CorrelationSpearman, 0, r, len(x), 1))
+	}
+
+	// Keep the lag with the strongest Pearson correlation; its significance is corrected for
+	// every lag tried
+	bestLag, bestR, bestSamples, found := 0, 0.0, 0, false
+	for lag := -pair.MaxLag; lag <= pair.MaxLag; lag++ {
+		if lag == 0 {
+			continue
+		}
+		x, y := alignBuckets(xs, ys, lag, step)
+		if r, ok := pearson(x, y); ok && (!found || math.Abs(r) > math.Abs(bestR)) {
+			bestLag, bestR, bestSamples, found = lag, r, len(x), true
+		}
+	}
+	if found {
+		results = append(results, newCorrelation(CorrelationPearson, bestLag, bestR, bestSamples, 2*pair.MaxLag))
+	}
+
+	return results, nil
+}
+
+// isStrongCorrelation reports whether a coefficient reaches the threshold over enough aligned
+// points to be significant
+func isStrongCorrelation(coefficient float64, samples int, pValue, threshold float64, minSamples int) bool {
+	return math.Abs(coefficient) >= threshold && samples >= minSamples && pValue < correlationSignificance
+}
+
+// bucketValues indexes the points of a series by bucket start time in Unix nanoseconds
+func bucketValues(series Series) map[int64]float64 {
+	values := make(map[int64]float64, len(series.Points))
+	for _, p := range series.Points {
+		values[p.Timestamp.UnixNano()] = p.Value
+	}
+	return values
+}
+
+// alignBuckets pairs every X bucket with the Y bucket lag steps later, dropping unmatched buckets
+func alignBuckets(xs, ys map[int64]float64, lag int, step time.Duration) ([]float64, []float64) {
+	times := make([]int64, 0, len(xs))
+	for t := range xs {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	var x, y []float64
+	for _, t := range times {
+		if yv, ok := ys[t+int64(lag)*int64(step)]; ok {
+			x = append(x, xs[t])
+			y = append(y, yv)
+		}
+	}
+	return x, y
+}
+
+// loadCorrelationFacts describes the strong correlations of the latest correlation run as prompt facts
+func loadCorrelationFacts(db *gorm.DB) (string, error) {
+	var latest models.MetricCorrelation
+	err := db.Order("computed_at desc").Limit(1).Find(&latest).Error
+	if err != nil || latest.ID == 0 {
+		return "", err
+	}
+
+	var strong []models.MetricCorrelation
+	err = db.Where("computed_at = ? AND strong = ?", latest.ComputedAt, true).Order("id asc").Find(&strong).Error
+	if err != nil || len(strong) == 0 {
+		return "", err
+	}
+
+	facts := "\nCross-source correlations estimated from metric history (sample statistics; correlation does not imply causation):\n"
+	for _, c := range strong {
+		lag := ""
+		switch {
+		case c.Lag > 0:
+			lag = fmt.Sprintf(", %s following %s by %s", c.MetricY, c.MetricX, time.Duration(c.LagSeconds)*time.Second)
+		case c.Lag < 0:
+			lag = fmt.Sprintf(", %s following %s by %s", c.MetricX, c.MetricY, time.Duration(-c.LagSeconds)*time.Second)
+		}
+		facts += fmt.Sprintf("- %s and %s: %s r=%.2f (p=%.3g) from %d aligned points over the %s ending %s%s\n",
+			c.MetricX, c.MetricY, c.Method, c.Coefficient, c.PValue, c.SampleSize,
+			c.WindowEnd.Sub(c.WindowStart), c.WindowEnd.UTC().Format(time.RFC3339), lag)
+	}
+	return facts, nil
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPearson(t *testing.T) {
+	tests := []struct {
+		name   string
+		x, y   []float64
+		want   float64
+		wantOK bool
+	}{
+		{"perfect positive", []float64{1, 2, 3, 4}, []float64{2, 4, 6, 8}, 1, true},
+		{"perfect negative", []float64{1, 2, 3, 4}, []float64{8, 6, 4, 2}, -1, true},
+		{"uncorrelated", []float64{1, 2, 3, 4}, []float64{1, -1, -1, 1}, 0, true},
+		{"partial", []float64{1, 2, 3, 4, 5}, []float64{2, 1, 4, 3, 5}, 0.8, true},
+		{"too few samples", []float64{1, 2}, []float64{2, 4}, 0, false},
+		{"constant series", []float64{1, 2, 3}, []float64{5, 5, 5}, 0, false},
+		{"unequal lengths", []float64{1, 2, 3}, []float64{1, 2}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pearson(tt.x, tt.y)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("pearson = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpearman(t *testing.T) {
+	// Monotonic but not linear, with a tie
+	x := []float64{1, 2, 3, 4, 5}
+	y := []float64{1, 8, 8, 64, 125}
+	got, ok := spearman(x, y)
+	if !ok || math.Abs(got-0.9746794344808963) > 1e-9 {
+		t.Errorf("spearman = %g, %v; want 0.9747", got, ok)
+	}
+	if got := fmt.Sprint(ranks([]float64{10, 30, 20, 30})); got != "[1 3.5 2 3.5]" {
+		t.Errorf("ranks = %s, want [1 3.5 2 3.5]", got)
+	}
+}
+
+func TestCorrelationStrength(t *testing.T) {
+	tests := []struct {
+		name       string
+		r          float64
+		samples    int
+		tests      int
+		wantStrong bool
+	}{
+		{"strong over many samples", 0.8, 50, 1, true},
+		{"strong over three samples", 0.99, 3, 1, false},
+		{"below the minimum sample size", 0.9, 19, 1, false},
+		{"at the minimum sample size", 0.9, 20, 1, true},
+		{"below the threshold", 0.6, 500, 1, false},
+		{"negative", -0.75, 40, 1, true},
+		{"at the threshold", 0.7, 20, 1, true},
+		{"lagged and not significant after correction", 0.7, 12, 12, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minSamples := defaultCorrelationMinSamples
+			if tt.tests > 1 {
+				minSamples = 10
+			}
+			pValue := correlationPValue(tt.r, tt.samples, tt.tests)
+			if got := isStrongCorrelation(tt.r, tt.samples, pValue, defaultCorrelationFactThreshold, minSamples); got != tt.wantStrong {
+				t.Errorf("strong = %v, want %v (p=%g)", got, tt.wantStrong, pValue)
+			}
+		})
+	}
+}
+
+func TestCorrelationPValue(t *testing.T) {
+	// r=0.5 over 28 samples gives z = atanh(0.5) * 5 = 2.7465, a two-sided p of 0.006024
+	if got := correlationPValue(0.5, 28, 1); math.Abs(got-0.006024) > 1e-5 {
+		t.Errorf("p = %g, want 0.006024", got)
+	}
+	if got := correlationPValue(0.5, 28, 4); math.Abs(got-4*0.006024) > 1e-4 {
+		t.Errorf("corrected p = %g, want 0.0241", got)
+	}
+	if got := correlationPValue(0.1, 10, 20); got != 1 {
+		t.Errorf("corrected p = %g, want it capped at 1", got)
+	}
+	if got := correlationPValue(0.99, 3, 1); got != 1 {
+		t.Errorf("p over 3 samples = %g, want 1", got)
+	}
+}
+
+func TestAlignBuckets(t *testing.T) {
+	step := time.Hour
+	at := func(h int) int64 { return int64(time.Duration(h) * step) }
+	xs := map[int64]float64{at(0): 1, at(1): 2, at(2): 3}
+	ys := map[int64]float64{at(1): 20, at(2): 30, at(3): 40}
+
+	tests := []struct {
+		lag  int
+		x, y string
+	}{
+		{0, "[2 3]", "[20 30]"},
+		{1, "[1 2 3]", "[20 30 40]"},
+		{-1, "[3]", "[20]"},
+	}
+	for _, tt := range tests {
+		x, y := alignBuckets(xs, ys, tt.lag, step)
+		if fmt.Sprint(x) != tt.x || fmt.Sprint(y) != tt.y {
+			t.Errorf("lag %d: x %v y %v, want %s %s", tt.lag, x, y, tt.x, tt.y)
+		}
+	}
+}
+
+func TestLoadCorrelationFacts(t *testing.T) {
+	computedAt := time.Date(2024, 5, 8, 12, 0, 0, 0, time.UTC)
+	from := computedAt.Add(-168 * time.Hour)
+	db, _ := newStubDB(t, func(q stubQuery) (*stubRows, error) {
+		return &stubRows{
+			Columns: []string{"id", "metric_x", "metric_y", "method", "lag", "lag_seconds", "coefficient", "sample_size", "p_value", "strong", "window_start", "window_end", "computed_at"},
+			Rows: [][]driver.Value{
+				{int64(1), "CryptoAPI_price", "WeatherAPI_temp", CorrelationPearson, int64(2), int64(7200), 0.81, int64(42), 0.0004, true, from, computedAt, computedAt},
+			},
+		}, nil
+	})
+
+	facts, err := loadCorrelationFacts(db)
+	if err != nil {
+		t.Fatalf("loadCorrelationFacts: %v", err)
+	}
+	for _, want := range []string{"r=0.81", "p=0.0004", "42 aligned points", "168h0m0s ending 2024-05-08T12:00:00Z", "WeatherAPI_temp following CryptoAPI_price by 2h0m0s"} {
+		if !strings.Contains(facts, want) {
+			t.Errorf("facts do not contain %q:\n%s", want, facts)
+		}
+	}
+	if strings.Contains(facts, "established facts") {
+		t.Errorf("facts present correlations as established:\n%s", facts)
+	}
+}
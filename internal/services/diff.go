@@ -0,0 +1,140 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// DiffOptions filters the metrics compared by DiffResults
+type DiffOptions struct {
+	// Prefixes keeps only metrics whose key starts with one of the prefixes, e.g. "CryptoAPI_"
+	Prefixes []string
+	// MinChange drops numeric changes whose absolute delta is smaller than this
+	MinChange float64
+	// MinChangePct drops numeric changes whose absolute percent delta is smaller than this
+	MinChangePct float64
+}
+
+// MetricValue is a metric present in only one of two compared results
+type MetricValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// MetricChange is a metric whose value differs between two compared results. Delta and DeltaPct
+// are only set for numeric values; DeltaPct is omitted when the old value is zero.
+type MetricChange struct {
+	Key      string      `json:"key"`
+	From     interface{} `json:"from"`
+	To       interface{} `json:"to"`
+	Delta    *float64    `json:"delta,omitempty"`
+	DeltaPct *float64    `json:"delta_pct,omitempty"`
+}
+
+// ResultDiff lists the metrics added, removed and changed between two processed results
+type ResultDiff struct {
+	Added     []MetricValue  `json:"added"`
+	Removed   []MetricValue  `json:"removed"`
+	Changed   []MetricChange `json:"changed"`
+	Unchanged int            `json:"unchanged"`
+}
+
+// DiffResults compares two processed results key by key across their combined and derived metrics
+func DiffResults(from, to *ProcessedResult, opts DiffOptions) *ResultDiff {
+	fromMetrics, toMetrics := diffMetrics(from, opts), diffMetrics(to, opts)
+
+	diff := &ResultDiff{
+		Added:   []MetricValue{},
+		Removed: []MetricValue{},
+		Changed: []MetricChange{},
+	}
+
+	for _, key := range sortedKeys(toMetrics) {
+		if _, ok := fromMetrics[key]; !ok {
+			diff.Added = append(diff.Added, MetricValue{Key: key, Value: toMetrics[key]})
+		}
+	}
+
+	for _, key := range sortedKeys(fromMetrics) {
+		oldValue := fromMetrics[key]
+		newValue, ok := toMetrics[key]
+		if !ok {
+			diff.Removed = append(diff.Removed, MetricValue{Key: key, Value: oldValue})
+			continue
+		}
+
+		oldFloat, oldNumeric := toFloat(oldValue)
+		newFloat, newNumeric := toFloat(newValue)
+		if !oldNumeric || !newNumeric {
+			if fmt.Sprint(oldValue) == fmt.Sprint(newValue) {
+				diff.Unchanged++
+			} else {
+				diff.Changed = append(diff.Changed, MetricChange{Key: key, From: oldValue, To: newValue})
+			}
+			continue
+		}
+
+		delta := newFloat - oldFloat
+		if delta == 0 {
+			diff.Unchanged++
+			continue
+		}
+
+		change := MetricChange{Key: key, From: oldValue, To: newValue, Delta: &delta}
+		if oldFloat != 0 {
+			pct := delta / math.Abs(oldFloat) * 100
+			change.DeltaPct = &pct
+		}
+
+		// Changes below either threshold are counted as unchanged
+		if math.Abs(delta) < opts.MinChange ||
+			(opts.MinChangePct > 0 && change.DeltaPct != nil && math.Abs(*change.DeltaPct) < opts.MinChangePct) {
+			diff.Unchanged++
+			continue
+		}
+		diff.Changed = append(diff.Changed, change)
+	}
+
+	return diff
+}
+
+// diffMetrics merges the combined and derived metrics of a result, keeping only keys with one of
+// the requested prefixes
+func diffMetrics(result *ProcessedResult, opts DiffOptions) map[string]interface{} {
+	metrics := make(map[string]interface{}, len(result.CombinedMetrics)+len(result.DerivedMetrics))
+	keep := func(key string) bool {
+		if len(opts.Prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range opts.Prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for key, value := range result.CombinedMetrics {
+		if keep(key) {
+			metrics[key] = value
+		}
+	}
+	for key, value := range result.DerivedMetrics {
+		if keep(key) {
+			metrics[key] = value
+		}
+	}
+	return metrics
+}
+
+// sortedKeys returns the keys of a metric map in lexical order
+func sortedKeys(metrics map[string]interface{}) []string {
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// describeMetrics formats a flat metric map as sorted "key=value" pairs
+func describeMetrics(metrics map[string]interface{}) string {
+	parts := make([]string, 0, len(metrics))
+	for key, value := range metrics {
+		parts = append(parts, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func TestFlattenJSON(t *testing.T) {
+	payload := `{
+		"name": "btc",
+		"quote": {"usd": {"price": 2}},
+		"tags": ["a", "b", "c"],
+		"trades": [{"size": 1, "side": "buy"}, {"size": 3, "side": "sell"}]
+	}`
+
+	tests := []struct {
+		name string
+		opts FlattenOptions
+		want string
+	}{
+		{"defaults expand arrays", FlattenOptions{},
+			"name=btc quote_usd_price=2 tags_0=a tags_1=b tags_2=c tags_count=3 " +
+				"trades_0_side=buy trades_0_size=1 trades_1_side=sell trades_1_size=3 trades_count=2"},
+		{"separator", FlattenOptions{Separator: ".", ArrayMode: ArrayModeCount},
+			"name=btc quote.usd.price=2 tags.count=3 trades.count=2"},
+		{"max depth encodes deeper values", FlattenOptions{MaxDepth: 1, ArrayMode: ArrayModeCount},
+			`name=btc quote={"usd":{"price":2}} tags_count=3 trades_count=2`},
+		{"max depth within arrays", FlattenOptions{MaxDepth: 2, ArrayMode: ArrayModeFirstN, ArrayLimit: 1},
+			`name=btc quote_usd={"price":2} tags_0=a tags_count=3 trades_0_side=buy trades_0_size=1 trades_count=2`},
+		{"first n", FlattenOptions{ArrayMode: ArrayModeFirstN, ArrayLimit: 2},
+			"name=btc quote_usd_price=2 tags_0=a tags_1=b tags_count=3 " +
+				"trades_0_side=buy trades_0_size=1 trades_1_side=sell trades_1_size=3 trades_count=2"},
+		{"stats aggregate numeric fields", FlattenOptions{ArrayMode: ArrayModeStats},
+			"name=btc quote_usd_price=2 tags_count=3 trades_count=2 " +
+				"trades_size_avg=2 trades_size_max=3 trades_size_min=1 trades_size_sum=4"},
+		{"include and exclude", FlattenOptions{Include: []string{"trades_*", "name"}, Exclude: []string{"*_side"}},
+			"name=btc trades_0_size=1 trades_1_size=3 trades_count=2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(payload), &data); err != nil {
+				t.Fatalf("invalid payload: %v", err)
+			}
+
+			result := make(map[string]interface{})
+			flattenJSON("", data, result, tt.opts.withDefaults(), 0)
+			if got := describeMetrics(result); got != tt.want {
+				t.Errorf("flattened\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreArrayStatsOfNumbers(t *testing.T) {
+	result := make(map[string]interface{})
+	flattenArray("prices", []interface{}{4.0, "x", 2.0}, result, FlattenOptions{ArrayMode: ArrayModeStats}.withDefaults(), 0)
+	if got, want := describeMetrics(result), "prices_avg=3 prices_count=3 prices_max=4 prices_min=2 prices_sum=6"; got != want {
+		t.Errorf("stats = %s, want %s", got, want)
+	}
+}
+
+func TestFlattenOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    FlattenOptions
+		wantErr bool
+	}{
+		{"defaults", FlattenOptions{}, false},
+		{"every array mode", FlattenOptions{ArrayMode: ArrayModeStats, MaxDepth: 3, ArrayLimit: 2}, false},
+		{"unknown array mode", FlattenOptions{ArrayMode: "sample"}, true},
+		{"negative depth", FlattenOptions{MaxDepth: -1}, true},
+		{"negative limit", FlattenOptions{ArrayLimit: -1}, true},
+		{"invalid glob", FlattenOptions{Exclude: []string{"a["}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFlattenTransformerPrefixesSources(t *testing.T) {
+	ctx := &RunContext{Config: &PipelineConfig{
+		Flatten: map[string]FlattenOptions{"WeatherAPI": {Separator: ".", ArrayMode: ArrayModeCount}},
+	}}
+	metrics := MetricSet{
+		"CryptoAPI":  map[string]interface{}{"data": map[string]interface{}{"price": 1.0}},
+		"WeatherAPI": map[string]interface{}{"current": map[string]interface{}{"temp_c": 20.0}, "alerts": []interface{}{"wind"}},
+		"flat_key":   5.0,
+	}
+
+	tests := []struct {
+		name    string
+		options string
+		want    string
+	}{
+		{"per-source options", "", "CryptoAPI_data_price=1 WeatherAPI.alerts.count=1 WeatherAPI.current.temp_c=20 flat_key=5"},
+		{"override", `{"separator": "/"}`, "CryptoAPI/data/price=1 WeatherAPI/alerts/0=wind WeatherAPI/alerts/count=1 WeatherAPI/current/temp_c=20 flat_key=5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := newFlattenTransformer(json.RawMessage(tt.options))
+			if err != nil {
+				t.Fatalf("newFlattenTransformer: %v", err)
+			}
+			out, _, err := transformer.Transform(ctx, metrics)
+			if err != nil {
+				t.Fatalf("Transform: %v", err)
+			}
+			if got := describeMetrics(out); got != tt.want {
+				t.Errorf("flattened\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newFlattenTransformer(json.RawMessage(`{"array_mode": "sample"}`)); err == nil {
+		t.Error("expected invalid override options to be rejected")
+	}
+}
@@ -0,0 +1,389 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Supported forecast methods
+const (
+	ForecastLinear      = "linear"
+	ForecastSES         = "ses"
+	ForecastHoltWinters = "holt_winters"
+)
+
+// ForecastSpec configures a forecast of one metric
+type ForecastSpec struct {
+	// Metric is the metric key to forecast, e.g. "CryptoAPI_data_priceUsd"
+	Metric string `json:"metric"`
+	// Method is linear, ses (simple exponential smoothing) or holt_winters (additive seasonal)
+	Method string `json:"method"`
+	// Step is the bucket size history is averaged into and forecast at; defaults to "1h"
+	Step string `json:"step,omitempty"`
+	// Horizon is the number of steps forecast; defaults to 24
+	Horizon int `json:"horizon,omitempty"`
+	// History is how much history the model is fitted to; defaults to "168h"
+	History string `json:"history,omitempty"`
+	// SeasonLength is the season of holt_winters in steps; defaults to 24
+	SeasonLength int `json:"season_length,omitempty"`
+	// Alpha, Beta and Gamma are the level, trend and seasonal smoothing factors; default to 0.3, 0.1 and 0.1
+	Alpha float64 `json:"alpha,omitempty"`
+	Beta  float64 `json:"beta,omitempty"`
+	Gamma float64 `json:"gamma,omitempty"`
+	// Confidence is the coverage of the prediction interval; defaults to 0.95
+	Confidence float64 `json:"confidence,omitempty"`
+	// IncludeInPrompt reports the forecast to the LLM
+	IncludeInPrompt bool `json:"include_in_prompt,omitempty"`
+}
+
+func (f ForecastSpec) validate() error {
+	if f.Metric == "" {
+		return fmt.Errorf("metric is required")
+	}
+	switch f.Method {
+	case ForecastLinear, ForecastSES, ForecastHoltWinters:
+	default:
+		return fmt.Errorf("unsupported method: %s", f.Method)
+	}
+
+	f = f.withDefaults()
+	if _, _, err := f.durations(); err != nil {
+		return err
+	}
+	if f.Horizon < 1 || f.SeasonLength < 2 {
+		return fmt.Errorf("horizon must be positive and season_length at least 2")
+	}
+	for _, factor := range []float64{f.Alpha, f.Beta, f.Gamma} {
+		if factor <= 0 || factor > 1 {
+			return fmt.Errorf("alpha, beta and gamma must be in (0, 1]")
+		}
+	}
+	if f.Confidence <= 0 || f.Confidence >= 1 {
+		return fmt.Errorf("confidence must be between 0 and 1")
+	}
+	return nil
+}
+
+// withDefaults fills in unset horizon, season, smoothing factors and confidence
+func (f ForecastSpec) withDefaults() ForecastSpec {
+	if f.Horizon == 0 {
+		f.Horizon = 24
+	}
+	if f.SeasonLength == 0 {
+		f.SeasonLength = 24
+	}
+	if f.Alpha == 0 {
+		f.Alpha = 0.3
+	}
+	if f.Beta == 0 {
+		f.Beta = 0.1
+	}
+	if f.Gamma == 0 {
+		f.Gamma = 0.1
+	}
+	if f.Confidence == 0 {
+		f.Confidence = 0.95
+	}
+	return f
+}
+
+// durations parses the step and history of a spec, applying defaults
+func (f ForecastSpec) durations() (time.Duration, time.Duration, error) {
+	step, history := time.Hour, 168*time.Hour
+	var err error
+	if f.Step != "" {
+		if step, err = time.ParseDuration(f.Step); err != nil {
+			return 0, 0, fmt.Errorf("invalid step: %w", err)
+		}
+	}
+	if f.History != "" {
+		if history, err = time.ParseDuration(f.History); err != nil {
+			return 0, 0, fmt.Errorf("invalid history: %w", err)
+		}
+	}
+	if step <= 0 || history <= 0 || step > history {
+		return 0, 0, fmt.Errorf("step and history must be positive and step must not exceed history")
+	}
+	return step, history, nil
+}
+
+// ForecastAccuracy summarises how forecasts of a metric and method compared with the actual values
+type ForecastAccuracy struct {
+	Metric string `json:"metric"`
+	Method string `json:"method"`
+	// Count is the number of forecast steps with a known actual value
+	Count int     `json:"count"`
+	MAE   float64 `json:"mae"`
+	RMSE  float64 `json:"rmse"`
+	// MAPE is the mean absolute percent error, ignoring actual values of zero
+	MAPE float64 `json:"mape"`
+	// Coverage is the fraction of actual values that fell within the prediction interval
+	Coverage float64 `json:"coverage"`
+}
+
+// ForecastService fits forecasting models to metric history and tracks their accuracy
+type ForecastService struct {
+	DB      *gorm.DB
+	Logger  *zap.SugaredLogger
+	Config  *PipelineConfig
+	Metrics *MetricsService
+}
+
+// NewForecastService creates a new ForecastService instance
+func NewForecastService(db *gorm.DB, logger *zap.SugaredLogger, config *PipelineConfig, metrics *MetricsService) *ForecastService {
+	return &ForecastService{
+		DB:      db,
+		Logger:  logger,
+		Config:  config,
+		Metrics: metrics,
+	}
+}
+
+// Run records the actual values of past forecasts and then forecasts every configured metric,
+// storing the results as one batch sharing the same generation time. Metrics without enough
+// history are skipped.
+func (s *ForecastService) Run() ([]models.MetricForecast, error) {
+	s.Logger.Infow("Starting forecasting", "forecasts", len(s.Config.Forecasts))
+
+	if _, err := s.Evaluate(); err != nil {
+		return nil, err
+	}
+
+	generatedAt := time.Now()
+	results := []models.MetricForecast{}
+	for _, spec := range s.Config.Forecasts {
+		forecasts, err := s.forecastMetric(spec.withDefaults(), generatedAt)
+		if err != nil {
+			s.Logger.Warnw("Skipping forecast", "metric", spec.Metric, "method", spec.Method, "reason", err)
+			continue
+		}
+		results = append(results, forecasts...)
+	}
+
+	if len(results) > 0 {
+		if err := s.DB.CreateInBatches(&results, 100).Error; err != nil {
+			return nil, fmt.Errorf("failed to store forecasts: %w", err)
+		}
+	}
+
+	s.Logger.Infow("Forecasting completed", "results", len(results))
+	return results, nil
+}
+
+// forecastMetric fits the configured model to the bucketed history of a metric
+func (s *ForecastService) forecastMetric(spec ForecastSpec, generatedAt time.Time) ([]models.MetricForecast, error) {
+	step, history, err := spec.durations()
+	if err != nil {
+		return nil, err
+	}
+
+	// Align buckets to the step so forecasts can be compared with later series buckets
+	to := generatedAt.Truncate(step)
+	series, err := s.Metrics.QuerySeries(SeriesQuery{
+		Keys:        []string{spec.Metric},
+		From:        to.Add(-history),
+		To:          to,
+		Step:        step,
+		Aggregation: AggregationAvg,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values, lastBucket := regularSeries(series[0].Points, step)
+
+	var steps []forecastStep
+	switch spec.Method {
+	case ForecastLinear:
+		steps, err = forecastLinear(values, spec.Horizon)
+	case ForecastSES:
+		steps, err = forecastSES(values, spec.Horizon, spec.Alpha)
+	case ForecastHoltWinters:
+		steps, err = forecastHoltWinters(values, spec.Horizon, spec.SeasonLength, spec.Alpha, spec.Beta, spec.Gamma)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	z := math.Sqrt2 * math.Erfinv(spec.Confidence)
+	forecasts := make([]models.MetricForecast, len(steps))
+	for i, f := range steps {
+		forecasts[i] = models.MetricForecast{
+			Metric:      spec.Metric,
+			Method:      spec.Method,
+			GeneratedAt: generatedAt,
+			TargetAt:    lastBucket.Add(time.Duration(i+1) * step),
+			StepSeconds: int64(step / time.Second),
+			StepsAhead:  i + 1,
+			Value:       f.value,
+			Lower:       f.value - z*f.stdErr,
+			Upper:       f.value + z*f.stdErr,
+			Confidence:  spec.Confidence,
+			InPrompt:    spec.IncludeInPrompt,
+		}
+	}
+	return forecasts, nil
+}
+
+// Evaluate records the actual bucket average of every forecast whose bucket has ended. Forecasts
+// of buckets without data are marked evaluated without an actual value. It returns the number of
+// forecasts evaluated.
+func (s *ForecastService) Evaluate() (int, error) {
+	now := time.Now()
+
+	var pending []models.MetricForecast
+	err := s.DB.
+		Where("evaluated_at IS NULL AND target_at + step_seconds * interval '1 second' <= ?", now).
+		Order("target_at asc").
+		Find(&pending).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve pending forecasts: %w", err)
+	}
+
+	for i := range pending {
+		f := &pending[i]
+		step := time.Duration(f.StepSeconds) * time.Second
+
+		series, err := s.Metrics.QuerySeries(SeriesQuery{
+			Keys:        []string{f.Metric},
+			From:        f.TargetAt,
+			To:          f.TargetAt.Add(step),
+			Step:        step,
+			Aggregation: AggregationAvg,
+		})
+		if err != nil {
+			return i, fmt.Errorf("failed to retrieve actual value of %s: %w", f.Metric, err)
+		}
+
+		updates := map[string]interface{}{"evaluated_at": now}
+		if len(series[0].Points) > 0 {
+			updates["actual"] = series[0].Points[0].Value
+		}
+		if err := s.DB.Model(f).Updates(updates).Error; err != nil {
+			return i, fmt.Errorf("failed to store forecast actual: %w", err)
+		}
+	}
+
+	if len(pending) > 0 {
+		s.Logger.Infow("Evaluated forecasts against actuals", "count", len(pending))
+	}
+	return len(pending), nil
+}
+
+// Accuracy summarises the error of every evaluated forecast, optionally for one metric only
+func (s *ForecastService) Accuracy(metric string) ([]ForecastAccuracy, error) {
+	query := s.DB.Where("actual IS NOT NULL")
+	if metric != "" {
+		query = query.Where("metric = ?", metric)
+	}
+
+	var forecasts []models.MetricForecast
+	if err := query.Find(&forecasts).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve evaluated forecasts: %w", err)
+	}
+
+	type group struct {
+		metric, method             string
+		absErr, sqErr, pctErr      float64
+		count, pctCount, withinInt int
+	}
+	groups := make(map[string]*group)
+	for _, f := range forecasts {
+		id := f.Metric + "\x00" + f.Method
+		g := groups[id]
+		if g == nil {
+			g = &group{metric: f.Metric, method: f.Method}
+			groups[id] = g
+		}
+
+		actual := *f.Actual
+		err := actual - f.Value
+		g.count++
+		g.absErr += math.Abs(err)
+		g.sqErr += err * err
+		if actual != 0 {
+			g.pctErr += math.Abs(err / actual * 100)
+			g.pctCount++
+		}
+		if actual >= f.Lower && actual <= f.Upper {
+			g.withinInt++
+		}
+	}
+
+	results := make([]ForecastAccuracy, 0, len(groups))
+	for _, g := range groups {
+		a := ForecastAccuracy{
+			Metric:   g.metric,
+			Method:   g.method,
+			Count:    g.count,
+			MAE:      g.absErr / float64(g.count),
+			RMSE:     math.Sqrt(g.sqErr / float64(g.count)),
+			Coverage: float64(g.withinInt) / float64(g.count),
+		}
+		if g.pctCount > 0 {
+			a.MAPE = g.pctErr / float64(g.pctCount)
+		}
+		results = append(results, a)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Metric != results[j].Metric {
+			return results[i].Metric < results[j].Metric
+		}
+		return results[i].Method < results[j].Method
+	})
+	return results, nil
+}
+
+// loadForecastFacts describes the latest forecasts marked for the prompt, giving the next step and
+// the end of the horizon of each metric
+func loadForecastFacts(db *gorm.DB) (string, error) {
+	var latest models.MetricForecast
+	err := db.Where("in_prompt = ?", true).Order("generated_at desc").Limit(1).Find(&latest).Error
+	if err != nil || latest.ID == 0 {
+		return "", err
+	}
+
+	var forecasts []models.MetricForecast
+	err = db.Where("generated_at = ? AND in_prompt = ?", latest.GeneratedAt, true).
+		Order("metric asc, method asc, steps_ahead asc").
+		Find(&forecasts).Error
+	if err != nil || len(forecasts) == 0 {
+		return "", err
+	}
+
+	// Keep the first and last step of every metric and method
+	type bounds struct{ first, last models.MetricForecast }
+	var order []string
+	byID := make(map[string]*bounds)
+	for _, f := range forecasts {
+		id := f.Metric + "\x00" + f.Method
+		if b, ok := byID[id]; ok {
+			b.last = f
+			continue
+		}
+		byID[id] = &bounds{first: f, last: f}
+		order = append(order, id)
+	}
+
+	describe := func(f models.MetricForecast) string {
+		return fmt.Sprintf("%.4g at %s (%.0f%% interval %.4g to %.4g)",
+			f.Value, f.TargetAt.UTC().Format(time.RFC3339), f.Confidence*100, f.Lower, f.Upper)
+	}
+
+	facts := "\nStatistical forecasts of upcoming metric values (model estimates, not observations):\n"
+	for _, id := range order {
+		b := byID[id]
+		facts += fmt.Sprintf("- %s (%s): next %s", b.first.Metric, b.first.Method, describe(b.first))
+		if b.last.StepsAhead > b.first.StepsAhead {
+			facts += "; then " + describe(b.last)
+		}
+		facts += "\n"
+	}
+	return facts, nil
+}
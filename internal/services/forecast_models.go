@@ -0,0 +1,167 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// forecastStep is the point forecast of one future step and the standard error of that forecast
+type forecastStep struct {
+	value  float64
+	stdErr float64
+}
+
+// forecastLinear fits an ordinary least-squares trend line and extends it horizon steps
+func forecastLinear(values []float64, horizon int) ([]forecastStep, error) {
+	n := len(values)
+	if n < 3 {
+		return nil, fmt.Errorf("linear trend needs at least 3 points, got %d", n)
+	}
+
+	tMean := float64(n-1) / 2
+	yMean := mean(values)
+	var sxx, sxy float64
+	for i, y := range values {
+		dt := float64(i) - tMean
+		sxx += dt * dt
+		sxy += dt * (y - yMean)
+	}
+	slope := sxy / sxx
+	intercept := yMean - slope*tMean
+
+	var sse float64
+	for i, y := range values {
+		r := y - (intercept + slope*float64(i))
+		sse += r * r
+	}
+	sigma := math.Sqrt(sse / float64(n-2))
+
+	steps := make([]forecastStep, horizon)
+	for k := 1; k <= horizon; k++ {
+		t := float64(n - 1 + k)
+		steps[k-1] = forecastStep{
+			value:  intercept + slope*t,
+			stdErr: sigma * math.Sqrt(1+1/float64(n)+(t-tMean)*(t-tMean)/sxx),
+		}
+	}
+	return steps, nil
+}
+
+// forecastSES applies simple exponential smoothing, forecasting the final level for every step
+func forecastSES(values []float64, horizon int, alpha float64) ([]forecastStep, error) {
+	if len(values) < 3 {
+		return nil, fmt.Errorf("exponential smoothing needs at least 3 points, got %d", len(values))
+	}
+
+	level := values[0]
+	errs := make([]float64, 0, len(values)-1)
+	for _, y := range values[1:] {
+		err := y - level
+		errs = append(errs, err)
+		level += alpha * err
+	}
+	sigma := rootMeanSquare(errs)
+
+	steps := make([]forecastStep, horizon)
+	for k := 1; k <= horizon; k++ {
+		steps[k-1] = forecastStep{
+			value:  level,
+			stdErr: sigma * math.Sqrt(1+float64(k-1)*alpha*alpha),
+		}
+	}
+	return steps, nil
+}
+
+// forecastHoltWinters applies additive Holt-Winters smoothing with a season of the given length
+// in steps. The first two seasons initialise the level, trend and seasonal components.
+func forecastHoltWinters(values []float64, horizon, season int, alpha, beta, gamma float64) ([]forecastStep, error) {
+	n := len(values)
+	if n < 2*season {
+		return nil, fmt.Errorf("holt-winters needs at least two seasons (%d points), got %d", 2*season, n)
+	}
+
+	// The first season's mean is the level at its midpoint; seasonal components are measured
+	// against the trend line through it and the level is carried to the season's last step
+	center := float64(season-1) / 2
+	firstMean := mean(values[:season])
+	trend := (mean(values[season:2*season]) - firstMean) / float64(season)
+	seasonal := make([]float64, season)
+	for i := range seasonal {
+		seasonal[i] = values[i] - (firstMean + trend*(float64(i)-center))
+	}
+	level := firstMean + trend*center
+
+	errs := make([]float64, 0, n-season)
+	for i := season; i < n; i++ {
+		y, s := values[i], seasonal[i%season]
+		errs = append(errs, y-(level+trend+s))
+
+		newLevel := alpha*(y-s) + (1-alpha)*(level+trend)
+		trend = beta*(newLevel-level) + (1-beta)*trend
+		seasonal[i%season] = gamma*(y-newLevel) + (1-gamma)*s
+		level = newLevel
+	}
+	sigma := rootMeanSquare(errs)
+
+	steps := make([]forecastStep, horizon)
+	variance := 1.0
+	for k := 1; k <= horizon; k++ {
+		if k > 1 {
+			// Variance grows with the smoothing weights of the steps already forecast
+			j := float64(k - 1)
+			c := alpha * (1 + j*beta)
+			if (k-1)%season == 0 {
+				c += gamma
+			}
+			variance += c * c
+		}
+		steps[k-1] = forecastStep{
+			value:  level + float64(k)*trend + seasonal[(n+k-1)%season],
+			stdErr: sigma * math.Sqrt(variance),
+		}
+	}
+	return steps, nil
+}
+
+// regularSeries turns the bucketed points of a series into consecutive step-sized values starting
+// at the first observed bucket, linearly interpolating missing buckets. It also returns the start
+// of the last observed bucket.
+func regularSeries(points []SeriesPoint, step time.Duration) ([]float64, time.Time) {
+	if len(points) == 0 {
+		return nil, time.Time{}
+	}
+
+	first, last := points[0].Timestamp, points[len(points)-1].Timestamp
+	values := make([]float64, int(last.Sub(first)/step)+1)
+	known := make([]bool, len(values))
+	for _, p := range points {
+		i := int(p.Timestamp.Sub(first) / step)
+		values[i], known[i] = p.Value, true
+	}
+
+	prev := 0
+	for i := 1; i < len(values); i++ {
+		if !known[i] {
+			continue
+		}
+		for j := prev + 1; j < i; j++ {
+			frac := float64(j-prev) / float64(i-prev)
+			values[j] = values[prev] + frac*(values[i]-values[prev])
+		}
+		prev = i
+	}
+	return values, last
+}
+
+// rootMeanSquare returns the root of the mean of the squared values
+func rootMeanSquare(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestForecastLinear(t *testing.T) {
+	// y = 2 + 3t is fitted exactly, so the forecast extends the line with no error
+	steps, err := forecastLinear([]float64{2, 5, 8, 11}, 2)
+	if err != nil {
+		t.Fatalf("forecastLinear: %v", err)
+	}
+	for i, want := range []float64{14, 17} {
+		if math.Abs(steps[i].value-want) > 1e-9 || steps[i].stdErr > 1e-9 {
+			t.Errorf("step %d = %g ± %g, want %g ± 0", i+1, steps[i].value, steps[i].stdErr, want)
+		}
+	}
+
+	// Noise widens the interval with the distance from the fitted range
+	steps, err = forecastLinear([]float64{1, 3, 2, 4, 3, 5}, 3)
+	if err != nil {
+		t.Fatalf("forecastLinear: %v", err)
+	}
+	if !(steps[0].stdErr > 0 && steps[1].stdErr > steps[0].stdErr && steps[2].stdErr > steps[1].stdErr) {
+		t.Errorf("standard errors %g, %g, %g do not grow with the horizon", steps[0].stdErr, steps[1].stdErr, steps[2].stdErr)
+	}
+
+	if _, err := forecastLinear([]float64{1, 2}, 1); err == nil {
+		t.Error("expected an error for two points")
+	}
+}
+
+func TestForecastSES(t *testing.T) {
+	tests := []struct {
+		name       string
+		values     []float64
+		alpha      float64
+		wantValue  float64
+		wantStdErr []float64
+	}{
+		{"constant series", []float64{5, 5, 5, 5}, 0.3, 5, []float64{0, 0}},
+		// Levels 1, 1.5, 2.25 with one-step errors 1 and 1.5, so sigma = sqrt(3.25 / 2)
+		{"rising series", []float64{1, 2, 3}, 0.5, 2.25, []float64{math.Sqrt(3.25 / 2), math.Sqrt(3.25/2) * math.Sqrt(1.25)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := forecastSES(tt.values, len(tt.wantStdErr), tt.alpha)
+			if err != nil {
+				t.Fatalf("forecastSES: %v", err)
+			}
+			for i, want := range tt.wantStdErr {
+				if math.Abs(steps[i].value-tt.wantValue) > 1e-9 || math.Abs(steps[i].stdErr-want) > 1e-9 {
+					t.Errorf("step %d = %g ± %g, want %g ± %g", i+1, steps[i].value, steps[i].stdErr, tt.wantValue, want)
+				}
+			}
+		})
+	}
+
+	if _, err := forecastSES([]float64{1, 2}, 1, 0.3); err == nil {
+		t.Error("expected an error for two points")
+	}
+}
+
+func TestForecastHoltWinters(t *testing.T) {
+	// A linear trend plus a season of four steps is reproduced exactly
+	season := []float64{2, -1, -3, 2}
+	series := func(i int) float64 { return 10 + 0.5*float64(i) + season[i%len(season)] }
+
+	tests := []struct {
+		name string
+		n    int
+	}{
+		{"exactly two seasons", 8},
+		{"mid-season end", 11},
+		{"long history", 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := make([]float64, tt.n)
+			for i := range values {
+				values[i] = series(i)
+			}
+
+			steps, err := forecastHoltWinters(values, 6, len(season), 0.3, 0.1, 0.1)
+			if err != nil {
+				t.Fatalf("forecastHoltWinters: %v", err)
+			}
+			for k, step := range steps {
+				want := series(tt.n + k)
+				if math.Abs(step.value-want) > 1e-9 || step.stdErr > 1e-9 {
+					t.Errorf("step %d = %g ± %g, want %g ± 0", k+1, step.value, step.stdErr, want)
+				}
+			}
+		})
+	}
+
+	if _, err := forecastHoltWinters([]float64{1, 2, 3, 4, 5, 6, 7}, 1, 4, 0.3, 0.1, 0.1); err == nil {
+		t.Error("expected an error for less than two seasons")
+	}
+}
+
+func TestForecastHoltWintersIntervalGrows(t *testing.T) {
+	values := []float64{3, 1, 4, 1, 5, 9, 2, 6, 5, 3, 5, 8}
+	steps, err := forecastHoltWinters(values, 8, 4, 0.3, 0.1, 0.1)
+	if err != nil {
+		t.Fatalf("forecastHoltWinters: %v", err)
+	}
+	for k := 1; k < len(steps); k++ {
+		if steps[k].stdErr <= steps[k-1].stdErr {
+			t.Errorf("standard error of step %d (%g) is not above step %d (%g)", k+1, steps[k].stdErr, k, steps[k-1].stdErr)
+		}
+	}
+}
+
+func TestRegularSeries(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+
+	values, last := regularSeries([]SeriesPoint{
+		{Timestamp: at(0), Value: 1},
+		{Timestamp: at(1), Value: 2},
+		{Timestamp: at(4), Value: 8},
+	}, time.Hour)
+
+	want := []float64{1, 2, 4, 6, 8}
+	if len(values) != len(want) {
+		t.Fatalf("values = %v, want %v", values, want)
+	}
+	for i := range want {
+		if math.Abs(values[i]-want[i]) > 1e-9 {
+			t.Errorf("values = %v, want %v", values, want)
+			break
+		}
+	}
+	if !last.Equal(at(4)) {
+		t.Errorf("last bucket = %s, want %s", last, at(4))
+	}
+
+	if values, last := regularSeries(nil, time.Hour); values != nil || !last.IsZero() {
+		t.Errorf("empty series = %v, %s", values, last)
+	}
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"database/sql/driver"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestForecastAccuracy(t *testing.T) {
+	at := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	db, stub := newStubDB(t, func(q stubQuery) (*stubRows, error) {
+		rows := &stubRows{Columns: []string{"id", "metric", "method", "target_at", "step_seconds", "value", "lower", "upper", "actual", "evaluated_at"}}
+		for i, f := range [][4]float64{
+			// value, lower, upper, actual
+			{100, 90, 110, 110},
+			{100, 95, 105, 90},
+			{50, 40, 60, 0},
+		} {
+			rows.Rows = append(rows.Rows, []driver.Value{int64(i + 1), "price", ForecastLinear, at, int64(3600), f[0], f[1], f[2], f[3], at})
+		}
+		return rows, nil
+	})
+	s := NewForecastService(db, zap.NewNop().Sugar(), &PipelineConfig{}, nil)
+
+	accuracy, err := s.Accuracy("price")
+	if err != nil {
+		t.Fatalf("Accuracy: %v", err)
+	}
+	if len(accuracy) != 1 {
+		t.Fatalf("got %d accuracy groups, want 1", len(accuracy))
+	}
+	a := accuracy[0]
+	// Errors are 10, -10 and -50; the zero actual is left out of MAPE
+	checks := []struct {
+		name      string
+		got, want float64
+	}{
+		{"count", float64(a.Count), 3},
+		{"mae", a.MAE, 70.0 / 3},
+		{"rmse", a.RMSE, math.Sqrt(2700.0 / 3)},
+		{"mape", a.MAPE, (100.0/11 + 100.0/9) / 2},
+		{"coverage", a.Coverage, 1.0 / 3},
+	}
+	for _, c := range checks {
+		if math.Abs(c.got-c.want) > 1e-9 {
+			t.Errorf("%s = %g, want %g", c.name, c.got, c.want)
+		}
+	}
+
+	for _, q := range stub.statements("") {
+		if !strings.HasPrefix(q.SQL, "SELECT") {
+			t.Errorf("accuracy must only read: %s", q.SQL)
+		}
+	}
+}
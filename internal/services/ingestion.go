@@ -1,6 +1,8 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -45,7 +47,11 @@ func NewDataIngestionService(db *gorm.DB, logger *zap.SugaredLogger, config *Con
 
 // FetchData concurrently fetches data from all configured sources and stores it in the database
 func (s *DataIngestionService) FetchData() error {
-	s.Logger.Info("Starting data ingestion")
+	runID, err := newRunID()
+	if err != nil {
+		return fmt.Errorf("failed to generate run ID: %w", err)
+	}
+	s.Logger.Infow("Starting data ingestion", "run_id", runID)
 
 	// Use a wait group to coordinate goroutines
 	var wg sync.WaitGroup
@@ -98,6 +104,7 @@ func (s *DataIngestionService) FetchData() error {
 			SourceName: result.SourceName,
 			Content:    content,
 			FetchedAt:  time.Now(),
+			RunID:      runID,
 		}
 
 		if err := s.DB.Create(&rawData).Error; err != nil {
@@ -117,6 +124,15 @@ func (s *DataIngestionService) FetchData() error {
 	return nil
 }
 
+// newRunID returns a random identifier shared by the entries of one ingestion run
+func newRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // fetchFromAPI fetches data from a single API endpoint
 func (s *DataIngestionService) fetchFromAPI(url string) (string, error) {
 	if url == "" {
@@ -1,13 +1,12 @@
 package services
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/arkouda/PipelineIQ/internal/models"
@@ -17,104 +16,92 @@ import (
 
 // LLMService handles generating insights from processed data using an LLM
 type LLMService struct {
-	DB           *gorm.DB
-	Logger       *zap.SugaredLogger
-	OpenAIAPIKey string
+	DB       *gorm.DB
+	Logger   *zap.SugaredLogger
+	Provider Provider
+	Settings LLMSettings
+	Prompts  *PromptService
+
+	// streams are the analyses being streamed, by analysis ID
+	streamsMu sync.Mutex
+	streams   map[uint]*liveStream
 }
 
 // NewLLMService creates a new LLMService instance
-func NewLLMService(db *gorm.DB, logger *zap.SugaredLogger, apiKey string) *LLMService {
+func NewLLMService(db *gorm.DB, logger *zap.SugaredLogger, provider Provider, settings LLMSettings, prompts *PromptService) *LLMService {
 	return &LLMService{
-		DB:           db,
-		Logger:       logger,
-		OpenAIAPIKey: apiKey,
+		DB:       db,
+		Logger:   logger,
+		Provider: provider,
+		Settings: settings,
+		Prompts:  prompts,
+		streams:  make(map[uint]*liveStream),
 	}
 }
 
-// OpenAI ChatCompletion request structure
-type ChatCompletionRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream,omitempty"`
-}
-
-// Message for OpenAI ChatCompletion
+// Message is a chat message sent to the LLM provider
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
-// OpenAI ChatCompletion response structure
-type ChatCompletionResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Choices []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"message"`
-	} `json:"choices"`
-}
+// Analysis statuses
+const (
+	AnalysisStatusStreaming = "streaming"
+	AnalysisStatusCompleted = "completed"
+	AnalysisStatusCancelled = "cancelled"
+	AnalysisStatusFailed    = "failed"
+)
 
-// OpenAI ChatCompletion streaming response structure
-type ChatCompletionChunk struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index int `json:"index"`
-		Delta struct {
-			Content string `json:"content,omitempty"`
-		} `json:"delta"`
-		FinishReason *string `json:"finish_reason"`
-	} `json:"choices"`
+// AnalysisOptions are the per-request model parameters and prompt template of an analysis
+type AnalysisOptions struct {
+	Params ModelParams
+	Prompt PromptRef
+	// NoCache bypasses the response cache; the new analysis still refreshes it
+	NoCache bool
 }
 
-// GenerateInsights retrieves the latest processed data and generates insights using an LLM
-func (s *LLMService) GenerateInsights() (*models.LLMAnalysis, error) {
-	if s.OpenAIAPIKey == "" {
-		return nil, fmt.Errorf("OpenAI API key is not set")
-	}
-
+// GenerateInsights generates insights of processed data using an LLM; a processedDataID of 0
+// selects the latest processed data
+func (s *LLMService) GenerateInsights(processedDataID uint, opts AnalysisOptions) (*models.LLMAnalysis, error) {
 	s.Logger.Info("Starting LLM analysis generation")
 
-	// Retrieve the latest processed data
-	var processedData models.ProcessedData
-	if err := s.DB.Order("processed_at desc").First(&processedData).Error; err != nil {
-		return nil, fmt.Errorf("failed to retrieve processed data: %w", err)
+	// Retrieve the processed data, refusing data that failed a quality check
+	processedData, err := s.processedDataForAnalysis(processedDataID)
+	if err != nil {
+		return nil, err
 	}
 
 	// Prepare the prompt for the LLM
-	prompt := fmt.Sprintf(`Analyze the following JSON data and provide insights:
-
-%s
-
-The data structure includes:
-- timestamp: When the data was processed
-- combined_metrics: All metrics from different data sources with source name as prefix
-- derived_metrics: Calculated metrics based on combined data
-- data_sources: List of data sources
+	prompt, err := s.analysisPrompt(AnalysisTypeInsights, opts, processedData)
+	if err != nil {
+		return nil, err
+	}
 
-Please provide:
-1. A summary of the key metrics from each data source
-2. Notable trends or patterns if any are apparent
-3. Potential actions or recommendations based on the data
-`, processedData.Content)
+	// Replay an identical recent analysis instead of paying for a new completion
+	req, cached, err := s.prepareCompletion(prompt, &opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		return cached, nil
+	}
 
 	// Query the LLM API
-	insights, err := s.queryLLM(prompt)
+	resp, err := s.queryLLM(req)
 	if err != nil {
 		return nil, fmt.Errorf("LLM API request failed: %w", err)
 	}
 
 	// Store the generated insights
 	llmAnalysis := models.LLMAnalysis{
-		Content:     insights,
-		GeneratedAt: time.Now(),
+		Content:         resp.Content,
+		GeneratedAt:     time.Now(),
+		ProcessedDataID: &processedData.ID,
 	}
+	opts.Params.record(&llmAnalysis, s.Provider.Name())
+	s.recordCompletion(&llmAnalysis, prompt, req, resp)
+	prompt.record(&llmAnalysis)
 
 	if err := s.DB.Create(&llmAnalysis).Error; err != nil {
 		return nil, fmt.Errorf("failed to store LLM analysis: %w", err)
@@ -124,531 +111,189 @@ Please provide:
 	return &llmAnalysis, nil
 }
 
-// queryLLM makes a request to the OpenAI API to generate insights
-func (s *LLMService) queryLLM(prompt string) (string, error) {
-	url := "https://api.openai.com/v1/chat/completions"
-
-	// Prepare the request payload
-	request := ChatCompletionRequest{
-		Model: "gpt-4", // Use an appropriate model
-		Messages: []Message{
-			{
-				Role:    "system",
-				Content: "You are a data analyst that provides insightful analysis of metrics and trends.",
-			},
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
-	}
+// renderedPrompt is an analysis prompt and the template and metadata it was built with
+type renderedPrompt struct {
+	Messages []Message
+	Template *models.PromptTemplate
+	Metadata AnalysisMetadata
+	// Fingerprint keys the response cache
+	Fingerprint string
+}
 
-	// Convert request to JSON
-	payload, err := json.Marshal(request)
-	if err != nil {
-		return "", fmt.Errorf("failed to serialize request: %w", err)
+// record stores the prompt template and metadata on an analysis row
+func (p *renderedPrompt) record(analysis *models.LLMAnalysis) {
+	analysis.AnalysisType = p.Template.AnalysisType
+	analysis.PromptName = p.Template.Name
+	analysis.PromptVersion = p.Template.Version
+	analysis.Metadata = p.Metadata.encode()
+	analysis.Fingerprint = p.Fingerprint
+	if analysis.Format == "" {
+		analysis.Format = AnalysisFormatMarkdown
 	}
+	if analysis.Status == "" {
+		analysis.Status = AnalysisStatusCompleted
+	}
+}
 
-	// Create the HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+// analysisPrompt renders the prompt template selected for an analysis of processed data, reducing
+// the data when the prompt would exceed the model's prompt budget
+func (s *LLMService) analysisPrompt(analysisType string, opts AnalysisOptions, processedData *models.ProcessedData) (*renderedPrompt, error) {
+	tmpl, err := s.Prompts.Resolve(analysisType, opts.Prompt)
 	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+		return nil, err
 	}
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.OpenAIAPIKey))
-
-	// Make the request
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("OpenAI API request failed: %w", err)
+	data := PromptData{
+		SchemaNotes: promptSchemaNotes,
+		Run: PromptRunContext{
+			ProcessedDataID:  processedData.ID,
+			ProcessedAt:      processedData.ProcessedAt,
+			QualityStatus:    processedData.QualityStatus,
+			ProcessorVersion: processedData.ProcessorVersion,
+			ConfigHash:       processedData.ConfigHash,
+			SourceRunID:      processedData.SourceRunID,
+			AnalysisType:     analysisType,
+		},
+		Correlations: s.correlationFacts(),
+		Forecasts:    s.forecastFacts(),
+	}
+	if analysisType == AnalysisTypeStructured {
+		data.OutputSchema = insightsSchemaText()
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
+	// Render without the data first to find how much of the budget is left for it
+	frame, err := s.Prompts.Render(tmpl, data)
 	if err != nil {
-		return "", fmt.Errorf("failed to read API response: %w", err)
+		return nil, err
 	}
-
-	// Check for non-200 response
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API returned error: status=%d, body=%s", resp.StatusCode, string(body))
+	// The request may be downgraded or fall back to a model with a smaller context window, so the
+	// data is fitted to the tightest of them
+	limit := s.tightestPromptLimit(opts.Params, frame)
+	model, budget, window, dataBudget := limit.model, limit.budget, limit.window, limit.dataBudget
+	if dataBudget <= 0 {
+		return nil, fmt.Errorf("prompt template %s version %d alone exceeds the prompt budget of %d tokens of %s", tmpl.Name, tmpl.Version, budget, model)
 	}
 
-	// Parse the response
-	var response ChatCompletionResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", fmt.Errorf("failed to parse API response: %w", err)
+	content, truncation := fitPromptData(processedData.Content, model, dataBudget, s.Settings.LowPriorityKeys)
+	if truncation != nil {
+		s.Logger.Warnw("Reduced processed data to fit the prompt budget",
+			"processed_id", processedData.ID, "model", model, "budget", dataBudget,
+			"original_tokens", truncation.OriginalTokens, "tokens", truncation.Tokens, "strategies", truncation.Strategies)
 	}
+	data.Data = content
 
-	// Extract the generated text
-	if len(response.Choices) == 0 {
-		return "", fmt.Errorf("API response contained no choices")
+	messages, err := s.Prompts.Render(tmpl, data)
+	if err != nil {
+		return nil, err
 	}
+	return &renderedPrompt{
+		Messages: messages,
+		Template: tmpl,
+		Metadata: AnalysisMetadata{
+			PromptTokens:  estimateMessageTokens(model, messages),
+			PromptBudget:  budget,
+			ContextWindow: window,
+			Truncation:    truncation,
+			BudgetModel:   budgetModel(model, opts.Params.Model),
+		},
+	}, nil
+}
 
-	return response.Choices[0].Message.Content, nil
+// queryLLM sends prompt messages to the configured provider to generate insights, retrying and
+// falling back to other models as configured
+func (s *LLMService) queryLLM(req CompletionRequest) (*CompletionResponse, error) {
+	return s.complete(context.Background(), req)
 }
 
-// StreamLLMAnalysis generates LLM insights and streams the results
-func (s *LLMService) StreamLLMAnalysis(w http.ResponseWriter, processedDataID uint) {
-	if s.OpenAIAPIKey == "" {
-		http.Error(w, "OpenAI API key is not set", http.StatusInternalServerError)
-		return
+// prepareCompletion builds the provider request for a prompt. When an identical analysis is in
+// the response cache it is returned instead; otherwise the spending budget is applied, which may
+// downgrade opts.Params to a cheaper model.
+func (s *LLMService) prepareCompletion(prompt *renderedPrompt, opts *AnalysisOptions, schema *JSONSchema) (CompletionRequest, *models.LLMAnalysis, error) {
+	req := opts.Params.completionRequest(prompt.Messages)
+	req.JSONSchema = schema
+	prompt.Fingerprint = s.promptFingerprint(req)
+	if cached := s.cachedAnalysis(prompt.Fingerprint, *opts); cached != nil {
+		return req, cached, nil
 	}
 
-	s.Logger.Info("Starting streaming LLM analysis generation")
-
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	// Create a channel to signal completion
-	done := make(chan bool)
-
-	// Helper function to write SSE messages
-	sendSSE := func(eventType, data string) {
-		fmt.Fprintf(w, "event: %s\n", eventType)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		w.(http.Flusher).Flush()
+	downgradedFrom, err := s.applyBudget(&opts.Params)
+	if err != nil {
+		return req, nil, err
 	}
-
-	// Start streaming in a goroutine
-	go func() {
-		defer close(done)
-
-		// Retrieve the processed data by ID or latest
-		var processedData models.ProcessedData
-		var err error
-
-		if processedDataID > 0 {
-			err = s.DB.First(&processedData, processedDataID).Error
-		} else {
-			err = s.DB.Order("processed_at desc").First(&processedData).Error
-		}
-
-		if err != nil {
-			errMsg := fmt.Sprintf("failed to retrieve processed data: %v", err)
-			s.Logger.Error(errMsg)
-			sendSSE("error", errMsg)
-			return
+	if downgradedFrom != "" {
+		prompt.Metadata.DowngradedFrom = downgradedFrom
+		req = opts.Params.completionRequest(prompt.Messages)
+		req.JSONSchema = schema
+		prompt.Fingerprint = s.promptFingerprint(req)
+		if cached := s.cachedAnalysis(prompt.Fingerprint, *opts); cached != nil {
+			return req, cached, nil
 		}
-
-		// Prepare the prompt for the LLM with Markdown formatting guidance
-		prompt := fmt.Sprintf(`Analyze the following JSON data and provide insights:
-
-%s
-
-The data structure includes:
-- timestamp: When the data was processed
-- combined_metrics: All metrics from different data sources with source name as prefix
-- derived_metrics: Calculated metrics based on combined data
-- data_sources: List of data sources
-
-Please provide a detailed analysis with the following sections, using Markdown formatting:
-
-## Summary of Key Metrics
-Summarize the key metrics from each data source with bullet points or paragraphs.
-
-## Trends and Patterns
-Analyze any notable trends or patterns in the data.
-
-## Recommendations
-Provide actionable recommendations based on the data analysis.
-
-IMPORTANT: Format your response using Markdown with proper headings, lists, and emphasis to highlight important points. Use tables if appropriate for data comparison.
-`, processedData.Content)
-
-		// Send starting message
-		sendSSE("start", "Starting LLM analysis...")
-
-		// Stream from OpenAI API
-		url := "https://api.openai.com/v1/chat/completions"
-
-		// Prepare the streaming request
-		request := ChatCompletionRequest{
-			Model: "gpt-4", // Use an appropriate model
-			Messages: []Message{
-				{
-					Role:    "system",
-					Content: "You are a data analyst that provides insightful analysis of metrics and trends.",
-				},
-				{
-					Role:    "user",
-					Content: prompt,
-				},
-			},
-			Stream: true,
-		}
-
-		// Convert request to JSON
-		payload, err := json.Marshal(request)
-		if err != nil {
-			s.Logger.Errorw("Failed to serialize request", "error", err)
-			sendSSE("error", fmt.Sprintf("Failed to serialize request: %v", err))
-			return
-		}
-
-		// Create the HTTP request
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-		if err != nil {
-			s.Logger.Errorw("Failed to create HTTP request", "error", err)
-			sendSSE("error", fmt.Sprintf("Failed to create HTTP request: %v", err))
-			return
-		}
-
-		// Set headers
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.OpenAIAPIKey))
-		req.Header.Set("Accept", "text/event-stream")
-
-		// Make the request
-		client := &http.Client{Timeout: 120 * time.Second}
-		resp, err := client.Do(req)
-		if err != nil {
-			s.Logger.Errorw("OpenAI API request failed", "error", err)
-			sendSSE("error", fmt.Sprintf("OpenAI API request failed: %v", err))
-			return
-		}
-		defer resp.Body.Close()
-
-		// Check for non-200 response
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			s.Logger.Errorw("API returned error", "status", resp.StatusCode, "body", string(body))
-			sendSSE("error", fmt.Sprintf("API returned error: status=%d, body=%s", resp.StatusCode, string(body)))
-			return
-		}
-
-		// Accumulate the full content for storing in the database
-		var fullContent strings.Builder
-
-		// Read the streaming response
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				s.Logger.Errorw("Error reading stream", "error", err)
-				sendSSE("error", fmt.Sprintf("Error reading stream: %v", err))
-				return
-			}
-
-			line = bytes.TrimSpace(line)
-			if len(line) == 0 {
-				continue
-			}
-
-			// SSE format: "data: {JSON data}"
-			if !bytes.HasPrefix(line, []byte("data: ")) {
-				continue
-			}
-
-			// Extract JSON data
-			data := line[6:] // Skip "data: "
-
-			// Check for stream end
-			if string(data) == "[DONE]" {
-				break
-			}
-
-			// Parse the chunk
-			var chunk ChatCompletionChunk
-			if err := json.Unmarshal(data, &chunk); err != nil {
-				s.Logger.Errorw("Failed to parse chunk", "error", err, "data", string(data))
-				continue
-			}
-
-			if len(chunk.Choices) == 0 {
-				continue
-			}
-
-			content := chunk.Choices[0].Delta.Content
-			if content != "" {
-				fullContent.WriteString(content)
-				sendSSE("content", content)
-			}
-		}
-
-		// Store the full content in the database
-		llmAnalysis := models.LLMAnalysis{
-			Content:     fullContent.String(),
-			GeneratedAt: time.Now(),
-		}
-
-		if err := s.DB.Create(&llmAnalysis).Error; err != nil {
-			s.Logger.Errorw("Failed to store LLM analysis", "error", err)
-			sendSSE("error", fmt.Sprintf("Failed to store analysis: %v", err))
-			return
-		}
-
-		// Send completion event with the ID
-		sendSSE("complete", fmt.Sprintf(`{"id": %d, "message": "Analysis completed"}`, llmAnalysis.ID))
-		s.Logger.Infow("Streaming LLM analysis completed", "id", llmAnalysis.ID)
-	}()
-
-	// Wait for completion
-	<-done
+	}
+	return req, nil, nil
 }
 
-// StreamLLMAnalysisOpenAI generates LLM insights and streams the results in OpenAI API format
-func (s *LLMService) StreamLLMAnalysisOpenAI(w http.ResponseWriter, processedDataID uint) {
-	if s.OpenAIAPIKey == "" {
-		http.Error(w, "OpenAI API key is not set", http.StatusInternalServerError)
-		return
+// recordServed stores the provider, model and temperature that served a completion on an
+// analysis, replacing the requested temperature when it was clamped for the provider
+func recordServed(analysis *models.LLMAnalysis, resp *CompletionResponse) {
+	analysis.ServedProvider = resp.Provider
+	analysis.ServedModel = resp.Model
+	if resp.Temperature != nil {
+		analysis.Temperature = resp.Temperature
 	}
+}
 
-	s.Logger.Info("Starting OpenAI format streaming LLM analysis generation")
-
-	// Set headers for streaming
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	// Create a channel to signal completion
-	done := make(chan bool)
-
-	// Start streaming in a goroutine
-	go func() {
-		defer close(done)
-
-		// Retrieve the processed data by ID or latest
-		var processedData models.ProcessedData
-		var err error
-
-		if processedDataID > 0 {
-			err = s.DB.First(&processedData, processedDataID).Error
-		} else {
-			err = s.DB.Order("processed_at desc").First(&processedData).Error
-		}
-
-		if err != nil {
-			errJson, _ := json.Marshal(map[string]interface{}{
-				"error": map[string]string{
-					"message": fmt.Sprintf("Failed to retrieve processed data: %v", err),
-					"type":    "internal_error",
-				},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errJson)
-			w.(http.Flusher).Flush()
-			return
-		}
-
-		// Prepare the prompt for the LLM with Markdown formatting guidance
-		prompt := fmt.Sprintf(`Analyze the following JSON data and provide insights:
-
-%s
-
-The data structure includes:
-- timestamp: When the data was processed
-- combined_metrics: All metrics from different data sources with source name as prefix
-- derived_metrics: Calculated metrics based on combined data
-- data_sources: List of data sources
-
-Please provide a detailed analysis with the following sections, using Markdown formatting:
-
-## Summary of Key Metrics
-Summarize the key metrics from each data source with bullet points or paragraphs.
-
-## Trends and Patterns
-Analyze any notable trends or patterns in the data.
-
-## Recommendations
-Provide actionable recommendations based on the data analysis.
-
-IMPORTANT: Format your response using Markdown with proper headings, lists, and emphasis to highlight important points. Use tables if appropriate for data comparison.
-`, processedData.Content)
-
-		// Stream from OpenAI API
-		url := "https://api.openai.com/v1/chat/completions"
-
-		// Prepare the streaming request
-		request := ChatCompletionRequest{
-			Model: "gpt-4", // Use an appropriate model
-			Messages: []Message{
-				{
-					Role:    "system",
-					Content: "You are a data analyst that provides insightful analysis of metrics and trends.",
-				},
-				{
-					Role:    "user",
-					Content: prompt,
-				},
-			},
-			Stream: true,
-		}
-
-		// Convert request to JSON
-		payload, err := json.Marshal(request)
-		if err != nil {
-			errJson, _ := json.Marshal(map[string]interface{}{
-				"error": map[string]string{
-					"message": fmt.Sprintf("Failed to serialize request: %v", err),
-					"type":    "internal_error",
-				},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errJson)
-			w.(http.Flusher).Flush()
-			return
-		}
-
-		// Create the HTTP request
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-		if err != nil {
-			errJson, _ := json.Marshal(map[string]interface{}{
-				"error": map[string]string{
-					"message": fmt.Sprintf("Failed to create HTTP request: %v", err),
-					"type":    "internal_error",
-				},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errJson)
-			w.(http.Flusher).Flush()
-			return
-		}
-
-		// Set headers
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.OpenAIAPIKey))
-		req.Header.Set("Accept", "text/event-stream")
-
-		// Make the request
-		client := &http.Client{Timeout: 120 * time.Second}
-		resp, err := client.Do(req)
-		if err != nil {
-			errJson, _ := json.Marshal(map[string]interface{}{
-				"error": map[string]string{
-					"message": fmt.Sprintf("OpenAI API request failed: %v", err),
-					"type":    "api_error",
-				},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errJson)
-			w.(http.Flusher).Flush()
-			return
-		}
-		defer resp.Body.Close()
-
-		// Check for non-200 response
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			errJson, _ := json.Marshal(map[string]interface{}{
-				"error": map[string]string{
-					"message": fmt.Sprintf("API returned error: status=%d, body=%s", resp.StatusCode, string(body)),
-					"type":    "api_error",
-				},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errJson)
-			w.(http.Flusher).Flush()
-			return
-		}
+// recordCompletion stores the provider and model that served a completion, the failed attempts
+// before it and its token usage and cost on an analysis. It must run before prompt.record, which
+// encodes the metadata.
+func (s *LLMService) recordCompletion(analysis *models.LLMAnalysis, prompt *renderedPrompt, req CompletionRequest, resp *CompletionResponse) {
+	recordServed(analysis, resp)
+	prompt.Metadata.FailedCalls = append(prompt.Metadata.FailedCalls, resp.Failures...)
+	usage, estimated := completionUsage(req, resp)
+	s.recordUsage(analysis, resp.Model, usage, estimated)
+}
 
-		// Accumulate the full content for storing in the database
-		var fullContent strings.Builder
-
-		// Read the streaming response
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				s.Logger.Errorw("Error reading stream", "error", err)
-				errJson, _ := json.Marshal(map[string]interface{}{
-					"error": map[string]string{
-						"message": fmt.Sprintf("Error reading stream: %v", err),
-						"type":    "stream_error",
-					},
-				})
-				fmt.Fprintf(w, "data: %s\n\n", errJson)
-				w.(http.Flusher).Flush()
-				return
-			}
-
-			line = bytes.TrimSpace(line)
-			if len(line) == 0 {
-				continue
-			}
-
-			// SSE format: "data: {JSON data}"
-			if !bytes.HasPrefix(line, []byte("data: ")) {
-				continue
-			}
-
-			// Extract JSON data
-			data := line[6:] // Skip "data: "
-
-			// Check for stream end
-			if string(data) == "[DONE]" {
-				fmt.Fprintf(w, "data: [DONE]\n\n")
-				w.(http.Flusher).Flush()
-				break
-			}
-
-			// Parse the chunk
-			var chunk ChatCompletionChunk
-			if err := json.Unmarshal(data, &chunk); err != nil {
-				s.Logger.Errorw("Failed to parse chunk", "error", err, "data", string(data))
-				continue
-			}
-
-			if len(chunk.Choices) == 0 {
-				continue
-			}
-
-			content := chunk.Choices[0].Delta.Content
-			if content != "" {
-				fullContent.WriteString(content)
-				
-				// Create OpenAI-compatible delta format
-				deltaJson, _ := json.Marshal(map[string]interface{}{
-					"id":      chunk.ID,
-					"object":  "chat.completion.chunk",
-					"created": time.Now().Unix(),
-					"model":   "gpt-4",
-					"choices": []map[string]interface{}{
-						{
-							"index": 0,
-							"delta": map[string]string{
-								"content": content,
-							},
-							"finish_reason": nil,
-						},
-					},
-				})
-				
-				fmt.Fprintf(w, "data: %s\n\n", deltaJson)
-				w.(http.Flusher).Flush()
-			}
-		}
+// StreamLLMAnalysis generates LLM insights and streams the results as Server-Sent Events. Content
+// events carry ids that a reconnecting client sends back as lastEventID to resume the stream;
+// generation continues in the background while no client is connected, up to the detach timeout.
+func (s *LLMService) StreamLLMAnalysis(ctx context.Context, w http.ResponseWriter, processedDataID uint, opts AnalysisOptions, lastEventID string) {
+	s.Logger.Info("Starting streaming LLM analysis generation")
+	setStreamHeaders(w)
+	s.streamAnalysis(ctx, &sseEncoder{w: w}, processedDataID, opts, lastEventID)
+}
 
-		// Store the full content in the database
-		llmAnalysis := models.LLMAnalysis{
-			Content:     fullContent.String(),
-			GeneratedAt: time.Now(),
-		}
+// StreamLLMAnalysisOpenAI generates LLM insights and streams the results in OpenAI API format.
+// It resumes and outlives connections like StreamLLMAnalysis.
+func (s *LLMService) StreamLLMAnalysisOpenAI(ctx context.Context, w http.ResponseWriter, processedDataID uint, opts AnalysisOptions, lastEventID string) {
+	s.Logger.Info("Starting OpenAI format streaming LLM analysis generation")
+	setStreamHeaders(w)
+	s.streamAnalysis(ctx, &openAIEncoder{w: w, chunkID: newChatCompletionID(), model: opts.Params.Model}, processedDataID, opts, lastEventID)
+}
 
-		if err := s.DB.Create(&llmAnalysis).Error; err != nil {
-			s.Logger.Errorw("Failed to store LLM analysis", "error", err)
-			errJson, _ := json.Marshal(map[string]interface{}{
-				"error": map[string]string{
-					"message": fmt.Sprintf("Failed to store analysis: %v", err),
-					"type":    "db_error",
-				},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errJson)
-			w.(http.Flusher).Flush()
-		}
+// newChatCompletionID returns an id for the chunks of an OpenAI-format stream
+func newChatCompletionID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	}
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
 
-		s.Logger.Infow("OpenAI format streaming LLM analysis completed", "id", llmAnalysis.ID)
-	}()
+// correlationFacts returns the strong cross-source correlations to append to an analysis prompt
+func (s *LLMService) correlationFacts() string {
+	facts, err := loadCorrelationFacts(s.DB)
+	if err != nil {
+		s.Logger.Warnw("Failed to load correlation facts for prompt", "error", err)
+		return ""
+	}
+	return facts
+}
 
-	// Wait for completion
-	<-done
+// forecastFacts returns the latest forecasts marked for the prompt to append to an analysis prompt
+func (s *LLMService) forecastFacts() string {
+	facts, err := loadForecastFacts(s.DB)
+	if err != nil {
+		s.Logger.Warnw("Failed to load forecast facts for prompt", "error", err)
+		return ""
+	}
+	return facts
 }
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"gorm.io/gorm"
+)
+
+// promptFingerprint hashes everything that determines a completion: the provider, the model, the
+// generation parameters, the output schema and the rendered prompt messages
+func (s *LLMService) promptFingerprint(req CompletionRequest) string {
+	encoded, _ := json.Marshal(struct {
+		Provider string
+		Request  CompletionRequest
+	}{s.Provider.Name(), req})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedAnalysis returns the newest analysis generated from the same fingerprint within the cache
+// TTL, or nil when there is none or the cache is disabled or bypassed
+func (s *LLMService) cachedAnalysis(fingerprint string, opts AnalysisOptions) *models.LLMAnalysis {
+	if s.Settings.CacheTTL <= 0 || opts.NoCache {
+		return nil
+	}
+
+	var analysis models.LLMAnalysis
+	err := s.DB.Preload("Insights", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	}).Where("fingerprint = ? AND generated_at >= ? AND status = ?", fingerprint, time.Now().Add(-s.Settings.CacheTTL), AnalysisStatusCompleted).
+		Order("generated_at desc").First(&analysis).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.Logger.Warnw("Failed to look up cached LLM analysis", "error", err)
+		}
+		return nil
+	}
+
+	s.Logger.Infow("Serving LLM analysis from cache", "id", analysis.ID, "fingerprint", fingerprint)
+	analysis.Cached = true
+	return &analysis
+}
+
+// replayStream sends cached content to onDelta one word at a time, pausing between words so
+// clients see the same incremental stream as a live response. It stops when ctx is done.
+func replayStream(ctx context.Context, content string, delay time.Duration, onDelta func(delta string) error) error {
+	for _, chunk := range replayChunks(content) {
+		if err := onDelta(chunk); err != nil {
+			return err
+		}
+		if delay > 0 {
+			if err := sleepContext(ctx, delay); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replayChunks splits content into words, each keeping the whitespace that follows it
+func replayChunks(content string) []string {
+	var chunks []string
+	start := 0
+	inSpace := false
+	for i, r := range content {
+		space := unicode.IsSpace(r)
+		if inSpace && !space {
+			chunks = append(chunks, content[start:i])
+			start = i
+		}
+		inSpace = space
+	}
+	if start < len(content) {
+		chunks = append(chunks, content[start:])
+	}
+	return chunks
+}
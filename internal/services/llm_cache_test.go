@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", nil},
+		{"single word", "ok", []string{"ok"}},
+		{"words keep trailing whitespace", "The price rose", []string{"The ", "price ", "rose"}},
+		{"leading and repeated whitespace", "  a\n\nb \t", []string{"  ", "a\n\n", "b \t"}},
+		{"multi-byte runes", "prix ↑ 5 €", []string{"prix ", "↑ ", "5 ", "€"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := replayChunks(tt.content)
+			if fmt.Sprintf("%q", chunks) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("replayChunks = %q, want %q", chunks, tt.want)
+			}
+			if joined := strings.Join(chunks, ""); joined != tt.content {
+				t.Errorf("chunks join to %q, want %q", joined, tt.content)
+			}
+		})
+	}
+}
+
+func TestReplayStream(t *testing.T) {
+	var got []string
+	collect := func(delta string) error {
+		got = append(got, delta)
+		return nil
+	}
+
+	if err := replayStream(context.Background(), "one two three", 0, collect); err != nil {
+		t.Fatalf("replayStream: %v", err)
+	}
+	if strings.Join(got, "|") != "one |two |three" {
+		t.Errorf("replayed %q", got)
+	}
+
+	// A client write error stops the replay
+	stop := errors.New("client gone")
+	calls := 0
+	err := replayStream(context.Background(), "one two three", 0, func(string) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("replayStream = %v after %d deltas, want the client error after 1", err, calls)
+	}
+
+	// Cancellation interrupts the pause between words
+	ctx, cancel := context.WithCancel(context.Background())
+	got = nil
+	err = replayStream(ctx, "one two three", time.Hour, func(delta string) error {
+		cancel()
+		return collect(delta)
+	})
+	if !errors.Is(err, context.Canceled) || len(got) != 1 {
+		t.Errorf("replayStream = %v after %q, want cancellation after one word", err, got)
+	}
+}
+
+func TestPromptFingerprint(t *testing.T) {
+	s := newStubLLMService(&stubProvider{name: ProviderOpenAI}, LLMSettings{})
+	temperature := 0.2
+	base := CompletionRequest{Model: "gpt-4o", Temperature: &temperature, Messages: []Message{{Role: "user", Content: "data"}}}
+
+	other := temperature
+	tests := []struct {
+		name string
+		req  CompletionRequest
+		same bool
+	}{
+		{"identical request", CompletionRequest{Model: "gpt-4o", Temperature: &other, Messages: []Message{{Role: "user", Content: "data"}}}, true},
+		{"other model", CompletionRequest{Model: "gpt-4o-mini", Temperature: &temperature, Messages: base.Messages}, false},
+		{"other prompt", CompletionRequest{Model: "gpt-4o", Temperature: &temperature, Messages: []Message{{Role: "user", Content: "more data"}}}, false},
+		{"default temperature", CompletionRequest{Model: "gpt-4o", Messages: base.Messages}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := s.promptFingerprint(tt.req) == s.promptFingerprint(base); same != tt.same {
+				t.Errorf("same fingerprint = %v, want %v", same, tt.same)
+			}
+		})
+	}
+
+	anthropic := newStubLLMService(&stubProvider{name: ProviderAnthropic}, LLMSettings{})
+	if anthropic.promptFingerprint(base) == s.promptFingerprint(base) {
+		t.Error("fingerprints of different providers match")
+	}
+}
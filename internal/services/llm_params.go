@@ -0,0 +1,175 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+)
+
+// ErrInvalidModelParams is returned when per-request overrides fall outside what the config allows
+var ErrInvalidModelParams = errors.New("invalid model parameters")
+
+// ModelParams are the generation parameters sent with a completion request. Nil and zero values
+// are omitted so the provider's own defaults apply.
+type ModelParams struct {
+	Model       string   `json:"model"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// ParamOverrides are the per-request parameters an analysis endpoint accepts; unset fields keep
+// the configured defaults
+type ParamOverrides struct {
+	Model       string
+	Temperature *float64
+	MaxTokens   *int
+}
+
+// LLMSettings are the configured model parameters and the limits on per-request overrides
+type LLMSettings struct {
+	Defaults ModelParams
+	// AllowedModels lists the models a request may select; the default model is always allowed
+	AllowedModels []string
+	// MaxTokensLimit caps max_tokens overrides; 0 disables max_tokens overrides
+	MaxTokensLimit int
+	// PromptBudget caps prompt tokens; 0 derives the budget from the model's context window
+	PromptBudget int
+	// ContextWindow overrides the context window looked up from the model name
+	ContextWindow int
+	// LowPriorityKeys are globs of combined metric keys dropped first when a prompt is over budget
+	LowPriorityKeys []string
+	// StructuredRetries is how many times a structured analysis re-asks after an invalid response
+	StructuredRetries int
+	// CacheTTL is how long an analysis is replayed for identical requests; 0 disables the cache
+	CacheTTL time.Duration
+	// CacheReplayDelay is the pause between words when a cached analysis is replayed as a stream
+	CacheReplayDelay time.Duration
+	// Prices add to and override the built-in model prices
+	Prices map[string]ModelPrice
+	// Budget caps daily and monthly spending
+	Budget BudgetSettings
+	// Retry controls retries of failed provider calls
+	Retry RetrySettings
+	// Fallbacks are tried in order when the requested model keeps failing
+	Fallbacks []FallbackTarget
+	// DiscardCancelled drops the partial output of streams cancelled by a client disconnect
+	// instead of storing it as a cancelled analysis
+	DiscardCancelled bool
+	// StreamDetachTimeout is how long a stream keeps generating with no client connected before
+	// it is cancelled; 0 cancels it as soon as the last client disconnects
+	StreamDetachTimeout time.Duration
+	// StreamFlushInterval is how often streamed chunks are persisted
+	StreamFlushInterval time.Duration
+}
+
+// maxTemperatures is the highest temperature each provider accepts
+var maxTemperatures = map[string]float64{
+	ProviderOpenAI:    2,
+	ProviderAzure:     2,
+	ProviderOllama:    2,
+	ProviderAnthropic: 1,
+}
+
+// clampTemperature caps a temperature at the maximum of a provider, so a temperature valid for the
+// primary provider does not fail a fallback, e.g. 1.5 sent to Anthropic
+func clampTemperature(provider string, temperature *float64) *float64 {
+	if limit := MaxTemperature(provider); temperature != nil && *temperature > limit {
+		return &limit
+	}
+	return temperature
+}
+
+// MaxTemperature returns the highest temperature a provider accepts
+func MaxTemperature(provider string) float64 {
+	if limit, ok := maxTemperatures[provider]; ok {
+		return limit
+	}
+	return maxTemperatures[ProviderOpenAI]
+}
+
+// ResolveParams applies per-request overrides to the configured defaults
+func (s *LLMService) ResolveParams(o ParamOverrides) (ModelParams, error) {
+	params := s.Settings.Defaults
+	params.Stop = append([]string(nil), params.Stop...)
+
+	if o.Model != "" && o.Model != params.Model {
+		if !s.modelAllowed(o.Model) {
+			return params, fmt.Errorf("%w: model %q is not allowed (allowed: %s)",
+				ErrInvalidModelParams, o.Model, strings.Join(s.allowedModels(), ", "))
+		}
+		params.Model = o.Model
+	}
+
+	if o.Temperature != nil {
+		maxTemperature := MaxTemperature(s.Provider.Name())
+		if *o.Temperature < 0 || *o.Temperature > maxTemperature {
+			return params, fmt.Errorf("%w: temperature must be between 0 and %g for %s", ErrInvalidModelParams, maxTemperature, s.Provider.Name())
+		}
+		temperature := *o.Temperature
+		params.Temperature = &temperature
+	}
+
+	if o.MaxTokens != nil {
+		if *o.MaxTokens <= 0 || *o.MaxTokens > s.Settings.MaxTokensLimit {
+			return params, fmt.Errorf("%w: max_tokens must be between 1 and %d", ErrInvalidModelParams, s.Settings.MaxTokensLimit)
+		}
+		params.MaxTokens = *o.MaxTokens
+	}
+
+	return params, nil
+}
+
+func (s *LLMService) modelAllowed(model string) bool {
+	for _, allowed := range s.allowedModels() {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedModels returns the sorted allow-list including the default model
+func (s *LLMService) allowedModels() []string {
+	seen := map[string]bool{s.Settings.Defaults.Model: true}
+	models := []string{s.Settings.Defaults.Model}
+	for _, model := range s.Settings.AllowedModels {
+		if model != "" && !seen[model] {
+			seen[model] = true
+			models = append(models, model)
+		}
+	}
+	sort.Strings(models)
+	return models
+}
+
+// completionRequest builds a provider request for the given messages with these parameters
+func (p ModelParams) completionRequest(messages []Message) CompletionRequest {
+	return CompletionRequest{
+		Model:       p.Model,
+		Messages:    messages,
+		Temperature: p.Temperature,
+		MaxTokens:   p.MaxTokens,
+		TopP:        p.TopP,
+		Stop:        p.Stop,
+	}
+}
+
+// record stores the parameters an analysis was generated with on its row
+func (p ModelParams) record(analysis *models.LLMAnalysis, provider string) {
+	analysis.Provider = provider
+	analysis.ModelName = p.Model
+	analysis.Temperature = p.Temperature
+	analysis.MaxTokens = p.MaxTokens
+	analysis.TopP = p.TopP
+	if len(p.Stop) > 0 {
+		stop, _ := json.Marshal(p.Stop)
+		analysis.Stop = string(stop)
+	}
+}
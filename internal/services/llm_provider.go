@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Supported LLM providers
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+	ProviderAzure     = "azure"
+)
+
+// CompletionRequest is a provider-independent chat completion request. Messages may include a
+// leading system message.
+type CompletionRequest struct {
+	Model       string
+	Messages    []Message
+	Temperature *float64
+	MaxTokens   int
+	TopP        *float64
+	Stop        []string
+	// JSONSchema asks for a JSON response matching the schema, using the provider's structured
+	// output support where it has any
+	JSONSchema *JSONSchema
+}
+
+// JSONSchema names a JSON schema for structured output
+type JSONSchema struct {
+	Name   string
+	Schema map[string]interface{}
+}
+
+// CompletionResponse is the generated text of a completion and the model that served it
+type CompletionResponse struct {
+	Content string
+	Model   string
+	// Usage is nil when the provider did not report token usage
+	Usage *TokenUsage
+	// Provider is the provider that served the completion and Failures the failed attempts before
+	// it, set when the call went through retries and fallbacks
+	Provider string
+	Failures []string
+	// Temperature is the temperature sent to the provider that served the completion, which is
+	// clamped to that provider's maximum
+	Temperature *float64
+}
+
+// TokenUsage counts the prompt and completion tokens of a completion
+type TokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Provider is a chat completion backend. Stream calls onDelta with every piece of generated text
+// as it arrives and returns the full response once the stream ends; an error from onDelta aborts
+// the stream.
+type Provider interface {
+	Name() string
+	Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error)
+	Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResponse, error)
+}
+
+// ProviderConfig selects and configures the LLM provider
+type ProviderConfig struct {
+	// Provider is openai (default), anthropic, ollama or azure
+	Provider string
+	// BaseURL overrides the provider's API root, e.g. a local OpenAI-compatible server; for azure
+	// it is the resource endpoint such as https://example.openai.azure.com
+	BaseURL string
+	APIKey  string
+	// AzureDeployment and AzureAPIVersion address an Azure OpenAI deployment
+	AzureDeployment string
+	AzureAPIVersion string
+	// Timeout bounds complete requests and the time to the first byte of streams; defaults to 120s
+	Timeout time.Duration
+}
+
+// azureStreamUsageAPIVersion is the first Azure OpenAI API version accepting stream_options.
+// API versions are dates, so later versions compare greater.
+const azureStreamUsageAPIVersion = "2024-09-01-preview"
+
+// defaultProviderModels is the model used with each provider when none is configured
+var defaultProviderModels = map[string]string{
+	ProviderOpenAI:    "gpt-4",
+	ProviderAnthropic: "claude-3-5-sonnet-latest",
+	ProviderOllama:    "llama3",
+	ProviderAzure:     "gpt-4",
+}
+
+// DefaultProviderModel returns the model used with a provider when none is configured
+func DefaultProviderModel(provider string) string {
+	if provider == "" {
+		provider = ProviderOpenAI
+	}
+	return defaultProviderModels[provider]
+}
+
+// NewProvider creates the provider selected by the config. A missing API key is reported when the
+// provider is first used rather than here, so the server can start without LLM credentials.
+func NewProvider(cfg ProviderConfig) (Provider, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 120 * time.Second
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+
+	switch cfg.Provider {
+	case "", ProviderOpenAI:
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		return &openAIProvider{
+			name:        ProviderOpenAI,
+			url:         strings.TrimRight(baseURL, "/") + "/chat/completions",
+			authHeader:  "Authorization",
+			authValue:   bearer(cfg.APIKey),
+			apiKey:      cfg.APIKey,
+			client:      client,
+			timeout:     timeout,
+			streamUsage: true,
+		}, nil
+
+	case ProviderAzure:
+		if cfg.BaseURL == "" || cfg.AzureDeployment == "" {
+			return nil, fmt.Errorf("azure provider requires a base URL and a deployment")
+		}
+		apiVersion := cfg.AzureAPIVersion
+		if apiVersion == "" {
+			apiVersion = "2024-06-01"
+		}
+		return &openAIProvider{
+			name: ProviderAzure,
+			url: fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+				strings.TrimRight(cfg.BaseURL, "/"), cfg.AzureDeployment, apiVersion),
+			authHeader:  "api-key",
+			authValue:   cfg.APIKey,
+			apiKey:      cfg.APIKey,
+			client:      client,
+			timeout:     timeout,
+			streamUsage: apiVersion >= azureStreamUsageAPIVersion,
+		}, nil
+
+	case ProviderAnthropic:
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "https://api.anthropic.com"
+		}
+		return &anthropicProvider{
+			url:     strings.TrimRight(baseURL, "/") + "/v1/messages",
+			apiKey:  cfg.APIKey,
+			client:  client,
+			timeout: timeout,
+		}, nil
+
+	case ProviderOllama:
+		baseURL := cfg.BaseURL
+		if baseURL == "" {
+			baseURL = "http://localhost:11434"
+		}
+		return &ollamaProvider{
+			url:     strings.TrimRight(baseURL, "/") + "/api/chat",
+			client:  client,
+			timeout: timeout,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported LLM provider: %s", cfg.Provider)
+}
+
+func bearer(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	return "Bearer " + apiKey
+}
+
+// APIError is a non-200 response from a provider API
+type APIError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is how long the provider asked clients to wait before retrying, 0 when it did not
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned error: status=%d, body=%s", e.StatusCode, e.Body)
+}
+
+// postJSON sends a JSON request and returns the response once its status is 200. The caller must
+// close the response body.
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}, headers map[string]string) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		if value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("API request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(respBody),
+			RetryAfter: retryAfter(resp.Header, time.Now()),
+		}
+	}
+	return resp, nil
+}
+
+// readServerSentEvents calls onEvent with the event type and data of every event in an SSE
+// stream until the stream ends or onEvent returns done or an error
+func readServerSentEvents(body io.Reader, onEvent func(event string, data []byte) (done bool, err error)) error {
+	reader := bufio.NewReader(body)
+	event := ""
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading stream: %w", err)
+		}
+		eof := err == io.EOF
+
+		line = bytes.TrimSpace(line)
+		switch {
+		case bytes.HasPrefix(line, []byte("event:")):
+			event = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			done, err := onEvent(event, bytes.TrimSpace(line[len("data:"):]))
+			if err != nil || done {
+				return err
+			}
+		case len(line) == 0:
+			event = ""
+		}
+
+		if eof {
+			return nil
+		}
+	}
+}
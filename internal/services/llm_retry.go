@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetrySettings control how failed provider calls are retried
+type RetrySettings struct {
+	// MaxRetries is the number of retries per provider and model after the first attempt
+	MaxRetries int
+	// BaseDelay is the first backoff delay, doubled on every retry up to MaxDelay. A provider
+	// asking for a longer wait than MaxDelay is not retried; the fallback chain moves on instead.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// FallbackTarget is a provider and model tried when the ones before it in the chain fail
+type FallbackTarget struct {
+	Provider Provider
+	Model    string
+}
+
+// ParseFallbackTarget splits a fallback chain entry, either "model" for the primary provider or
+// "provider:model". Model names may contain colons themselves, as Ollama tags do.
+func ParseFallbackTarget(entry string) (provider, model string) {
+	entry = strings.TrimSpace(entry)
+	if name, rest, ok := strings.Cut(entry, ":"); ok {
+		switch name {
+		case ProviderOpenAI, ProviderAnthropic, ProviderOllama, ProviderAzure:
+			return name, rest
+		}
+	}
+	return "", entry
+}
+
+// rateLimitResets pairs the OpenAI rate-limit reset headers with the remaining-quota header
+// that says whether that limit is the one hit
+var rateLimitResets = []struct{ reset, remaining string }{
+	{"x-ratelimit-reset-requests", "x-ratelimit-remaining-requests"},
+	{"x-ratelimit-reset-tokens", "x-ratelimit-remaining-tokens"},
+}
+
+// anthropicRateLimitResets are the Anthropic headers holding the RFC 3339 time a limit resets
+var anthropicRateLimitResets = []string{
+	"anthropic-ratelimit-requests-reset",
+	"anthropic-ratelimit-tokens-reset",
+}
+
+// retryAfter returns how long a provider asked clients to wait, from the Retry-After headers or,
+// failing those, the time until the exhausted rate limit resets
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if value := header.Get("retry-after"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if at, err := http.ParseTime(value); err == nil && at.After(now) {
+			return at.Sub(now)
+		}
+	}
+
+	// OpenAI reports resets as durations such as 1s or 6m0s
+	var wait, exhausted time.Duration
+	for _, h := range rateLimitResets {
+		reset, err := time.ParseDuration(header.Get(h.reset))
+		if err != nil {
+			continue
+		}
+		wait = max(wait, reset)
+		if header.Get(h.remaining) == "0" {
+			exhausted = max(exhausted, reset)
+		}
+	}
+	if exhausted > 0 {
+		return exhausted
+	}
+
+	for _, h := range anthropicRateLimitResets {
+		if at, err := time.Parse(time.RFC3339, header.Get(h)); err == nil && at.After(now) {
+			wait = max(wait, at.Sub(now))
+		}
+	}
+	return wait
+}
+
+// retryable reports whether a failed call may succeed when repeated: rate limits, server errors
+// and timeouts. Cancellation by the caller is never retried.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// backoff returns the wait before a retry: what the provider asked for, or exponential backoff
+// with jitter. ok is false when the wait would exceed the maximum delay.
+func (r RetrySettings) backoff(attempt int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter, r.MaxDelay <= 0 || apiErr.RetryAfter <= r.MaxDelay
+	}
+
+	delay := r.BaseDelay << attempt
+	if delay <= 0 || r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	// Up to 20% jitter spreads out retries of concurrent requests
+	if delay > 0 {
+		delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	}
+	return delay, true
+}
+
+// sleepContext waits for a duration unless the context is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// fallbackChain returns the primary provider with the requested model followed by the
+// configured fallbacks
+func (s *LLMService) fallbackChain(model string) []FallbackTarget {
+	return append([]FallbackTarget{{Provider: s.Provider, Model: model}}, s.Settings.Fallbacks...)
+}
+
+// callWithFallback runs a provider call with retries on every target of the fallback chain until
+// one succeeds. The response records the provider and model that served it and the failed
+// attempts before it. A call that reports partial progress is neither retried nor handed to a
+// fallback, as its output has already been used; the partial response it returned, if any, is
+// returned along with the error.
+func (s *LLMService) callWithFallback(ctx context.Context, req CompletionRequest,
+	call func(ctx context.Context, p Provider, req CompletionRequest) (*CompletionResponse, bool, error)) (*CompletionResponse, error) {
+	var failures []string
+	var lastErr error
+	for _, target := range s.fallbackChain(req.Model) {
+		targetReq := req
+		targetReq.Model = target.Model
+		targetReq.Temperature = clampTemperature(target.Provider.Name(), req.Temperature)
+
+		for attempt := 0; ; attempt++ {
+			resp, started, err := call(ctx, target.Provider, targetReq)
+			if err == nil {
+				resp.Provider = target.Provider.Name()
+				resp.Temperature = targetReq.Temperature
+				if resp.Model == "" {
+					resp.Model = target.Model
+				}
+				resp.Failures = failures
+				if len(failures) > 0 {
+					s.Logger.Infow("LLM request served after failures", "provider", resp.Provider, "model", resp.Model, "failures", len(failures))
+				}
+				return resp, nil
+			}
+
+			lastErr = err
+			failures = append(failures, fmt.Sprintf("%s/%s: %v", target.Provider.Name(), target.Model, err))
+			s.Logger.Warnw("LLM request failed", "provider", target.Provider.Name(), "model", target.Model, "attempt", attempt+1, "error", err)
+			if started {
+				resp.Provider = target.Provider.Name()
+				resp.Temperature = targetReq.Temperature
+				resp.Failures = failures
+				return resp, err
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if attempt >= s.Settings.Retry.MaxRetries || !retryable(ctx, err) {
+				break
+			}
+			delay, ok := s.Settings.Retry.backoff(attempt, err)
+			if !ok {
+				s.Logger.Warnw("Provider asked to wait longer than the maximum retry delay", "provider", target.Provider.Name(), "wait", delay)
+				break
+			}
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(failures) > 1 {
+		return nil, fmt.Errorf("all %d attempts failed, last: %w", len(failures), lastErr)
+	}
+	return nil, lastErr
+}
+
+// complete sends a completion request with retries and fallbacks
+func (s *LLMService) complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	return s.callWithFallback(ctx, req, func(ctx context.Context, p Provider, req CompletionRequest) (*CompletionResponse, bool, error) {
+		resp, err := p.Complete(ctx, req)
+		return resp, false, err
+	})
+}
+
+// stream streams a completion with retries and fallbacks. Only failures before the first delta
+// are retried. A stream that fails or is cancelled after its first delta returns the error with a
+// response holding the partial content and the provider and model that generated it, as those
+// tokens are billed.
+func (s *LLMService) stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResponse, error) {
+	return s.callWithFallback(ctx, req, func(ctx context.Context, p Provider, req CompletionRequest) (*CompletionResponse, bool, error) {
+		var partial strings.Builder
+		resp, err := p.Stream(ctx, req, func(delta string) error {
+			partial.WriteString(delta)
+			return onDelta(delta)
+		})
+		started := partial.Len() > 0
+		if err != nil && started {
+			resp = &CompletionResponse{Content: partial.String(), Model: req.Model}
+		}
+		return resp, started, err
+	})
+}
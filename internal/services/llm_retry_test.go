@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stubProvider is a Provider whose calls are answered by functions, recording the requests
+type stubProvider struct {
+	name     string
+	complete func(req CompletionRequest) (*CompletionResponse, error)
+	requests []CompletionRequest
+}
+
+func (p *stubProvider) Name() string { return p.name }
+
+func (p *stubProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	p.requests = append(p.requests, req)
+	return p.complete(req)
+}
+
+func (p *stubProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResponse, error) {
+	resp, err := p.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, onDelta(resp.Content)
+}
+
+// newStubLLMService returns an LLM service with a primary provider and fallback targets
+func newStubLLMService(primary Provider, settings LLMSettings) *LLMService {
+	return &LLMService{Provider: primary, Logger: zap.NewNop().Sugar(), Settings: settings}
+}
+
+func TestCallWithFallbackClampsTemperature(t *testing.T) {
+	primary := &stubProvider{name: ProviderOpenAI, complete: func(CompletionRequest) (*CompletionResponse, error) {
+		return nil, &APIError{StatusCode: 400, Body: "bad request"}
+	}}
+	fallback := &stubProvider{name: ProviderAnthropic, complete: func(req CompletionRequest) (*CompletionResponse, error) {
+		return &CompletionResponse{Content: "ok"}, nil
+	}}
+	s := newStubLLMService(primary, LLMSettings{
+		Fallbacks: []FallbackTarget{{Provider: fallback, Model: "claude-3-5-haiku-latest"}},
+	})
+
+	temperature := 1.5
+	resp, err := s.complete(context.Background(), CompletionRequest{Model: "gpt-4o", Temperature: &temperature})
+	if err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	if got := *primary.requests[0].Temperature; got != 1.5 {
+		t.Errorf("OpenAI temperature = %g, want 1.5", got)
+	}
+	if got := *fallback.requests[0].Temperature; got != 1 {
+		t.Errorf("Anthropic temperature = %g, want it clamped to 1", got)
+	}
+	if resp.Provider != ProviderAnthropic || resp.Temperature == nil || *resp.Temperature != 1 {
+		t.Errorf("response provider %q temperature %v, want anthropic with 1", resp.Provider, resp.Temperature)
+	}
+	if temperature != 1.5 {
+		t.Errorf("requested temperature changed to %g", temperature)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+	}{
+		{"no headers", nil, 0},
+		{"milliseconds", map[string]string{"retry-after-ms": "1500", "retry-after": "9"}, 1500 * time.Millisecond},
+		{"seconds", map[string]string{"retry-after": "2.5"}, 2500 * time.Millisecond},
+		{"HTTP date", map[string]string{"retry-after": now.Add(30 * time.Second).Format(http.TimeFormat)}, 30 * time.Second},
+		{"past HTTP date", map[string]string{"retry-after": now.Add(-time.Minute).Format(http.TimeFormat)}, 0},
+		{"invalid value", map[string]string{"retry-after": "soon"}, 0},
+		{"exhausted OpenAI limit", map[string]string{
+			"x-ratelimit-reset-requests": "1s", "x-ratelimit-remaining-requests": "10",
+			"x-ratelimit-reset-tokens": "6m0s", "x-ratelimit-remaining-tokens": "0",
+		}, 6 * time.Minute},
+		{"exhausted limit resets first", map[string]string{
+			"x-ratelimit-reset-requests": "2s", "x-ratelimit-remaining-requests": "0",
+			"x-ratelimit-reset-tokens": "6m0s", "x-ratelimit-remaining-tokens": "500",
+		}, 2 * time.Second},
+		{"no limit exhausted", map[string]string{"x-ratelimit-reset-requests": "3s", "x-ratelimit-reset-tokens": "1s"}, 3 * time.Second},
+		{"Anthropic reset", map[string]string{
+			"anthropic-ratelimit-requests-reset": now.Add(20 * time.Second).Format(time.RFC3339),
+			"anthropic-ratelimit-tokens-reset":   now.Add(45 * time.Second).Format(time.RFC3339),
+		}, 45 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			if got := retryAfter(header, now); got != tt.want {
+				t.Errorf("retryAfter = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	settings := RetrySettings{MaxRetries: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		name    string
+		attempt int
+		err     error
+		min     time.Duration
+		max     time.Duration
+		wantOK  bool
+	}{
+		{"first retry", 0, errors.New("timeout"), 100 * time.Millisecond, 120 * time.Millisecond, true},
+		{"doubles per attempt", 2, errors.New("timeout"), 400 * time.Millisecond, 480 * time.Millisecond, true},
+		{"capped at the maximum", 5, errors.New("timeout"), time.Second, 1200 * time.Millisecond, true},
+		{"shift overflow is capped", 70, errors.New("timeout"), time.Second, 1200 * time.Millisecond, true},
+		{"provider wait", 0, &APIError{StatusCode: 429, RetryAfter: 700 * time.Millisecond}, 700 * time.Millisecond, 700 * time.Millisecond, true},
+		{"provider wait too long", 0, &APIError{StatusCode: 429, RetryAfter: time.Minute}, time.Minute, time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				delay, ok := settings.backoff(tt.attempt, tt.err)
+				if ok != tt.wantOK || delay < tt.min || delay > tt.max {
+					t.Fatalf("backoff = %s, %v; want [%s, %s], %v", delay, ok, tt.min, tt.max, tt.wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"rate limited", context.Background(), &APIError{StatusCode: 429}, true},
+		{"server error", context.Background(), &APIError{StatusCode: 503}, true},
+		{"bad request", context.Background(), &APIError{StatusCode: 400}, false},
+		{"deadline", context.Background(), context.DeadlineExceeded, true},
+		{"other error", context.Background(), errors.New("connection refused"), false},
+		{"cancelled by the caller", cancelled, &APIError{StatusCode: 503}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("retryable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallWithFallbackRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		errs         []error
+		wantPrimary  int
+		wantFallback int
+		wantFailures int
+	}{
+		{"recovers after a retry", []error{&APIError{StatusCode: 503}}, 2, 0, 1},
+		{"falls back after the last retry", []error{&APIError{StatusCode: 503}, &APIError{StatusCode: 503}, &APIError{StatusCode: 503}}, 3, 1, 3},
+		{"falls back without retrying a bad request", []error{&APIError{StatusCode: 400}}, 1, 1, 1},
+		{"falls back when the wait is too long", []error{&APIError{StatusCode: 429, RetryAfter: time.Hour}}, 1, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &stubProvider{name: ProviderOpenAI}
+			primary.complete = func(CompletionRequest) (*CompletionResponse, error) {
+				if n := len(primary.requests); n <= len(tt.errs) {
+					return nil, tt.errs[n-1]
+				}
+				return &CompletionResponse{Content: "primary"}, nil
+			}
+			fallback := &stubProvider{name: ProviderOllama, complete: func(CompletionRequest) (*CompletionResponse, error) {
+				return &CompletionResponse{Content: "fallback"}, nil
+			}}
+			s := newStubLLMService(primary, LLMSettings{
+				Retry:     RetrySettings{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second},
+				Fallbacks: []FallbackTarget{{Provider: fallback, Model: "llama3"}},
+			})
+
+			resp, err := s.complete(context.Background(), CompletionRequest{Model: "gpt-4o"})
+			if err != nil {
+				t.Fatalf("complete: %v", err)
+			}
+			if len(primary.requests) != tt.wantPrimary || len(fallback.requests) != tt.wantFallback {
+				t.Errorf("%d primary and %d fallback calls, want %d and %d",
+					len(primary.requests), len(fallback.requests), tt.wantPrimary, tt.wantFallback)
+			}
+			if len(resp.Failures) != tt.wantFailures {
+				t.Errorf("failures = %v, want %d", resp.Failures, tt.wantFailures)
+			}
+		})
+	}
+}
@@ -0,0 +1,540 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"gorm.io/gorm"
+)
+
+// liveStreamRetention is how long a finished stream stays in memory for reconnecting clients;
+// after that they are served from the stored chunks
+const liveStreamRetention = time.Minute
+
+// Stream error types, sent as the type of OpenAI-format errors
+const (
+	streamErrInternal    = "internal_error"
+	streamErrQuality     = "quality_gate_error"
+	streamErrPrompt      = "prompt_error"
+	streamErrBudget      = "budget_exceeded"
+	streamErrAPI         = "api_error"
+	streamErrDB          = "db_error"
+	streamErrNotFound    = "not_found"
+	streamErrCancelled   = "cancelled"
+	streamErrInterrupted = "stream_interrupted"
+)
+
+// liveStream is an analysis being generated independently of the connections following it. Its
+// chunks are numbered from 1 in the order they were generated.
+type liveStream struct {
+	analysisID uint
+	cancel     context.CancelFunc
+
+	mu     sync.Mutex
+	chunks []string
+	done   bool
+	// errType and errMsg describe why a finished stream did not complete
+	errType string
+	errMsg  string
+	// changed is closed and replaced whenever a chunk is added or the stream finishes
+	changed     chan struct{}
+	subscribers int
+	detachTimer *time.Timer
+}
+
+// append adds a chunk and returns its sequence number
+func (st *liveStream) append(delta string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.chunks = append(st.chunks, delta)
+	st.broadcast()
+	return len(st.chunks)
+}
+
+// finish marks the stream done, with an error unless errType is empty
+func (st *liveStream) finish(errType, errMsg string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.done = true
+	st.errType, st.errMsg = errType, errMsg
+	st.broadcast()
+}
+
+func (st *liveStream) broadcast() {
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+func (st *liveStream) content() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strings.Join(st.chunks, "")
+}
+
+// streamEncoder writes the events of an analysis stream in one wire format. Content events carry
+// an SSE id of the form <analysis ID>-<sequence> that clients send back as Last-Event-ID.
+type streamEncoder interface {
+	start(analysisID uint)
+	content(analysisID uint, seq int, delta string)
+	complete(analysisID uint, cached bool)
+	fail(errType, message string)
+}
+
+// eventID returns the SSE id of a chunk
+func eventID(analysisID uint, seq int) string {
+	return fmt.Sprintf("%d-%d", analysisID, seq)
+}
+
+// parseEventID splits a Last-Event-ID into the analysis ID and the sequence number of the last
+// chunk received
+func parseEventID(id string) (uint, int, bool) {
+	analysis, seq, ok := strings.Cut(strings.TrimSpace(id), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	analysisID, err := strconv.ParseUint(analysis, 10, 32)
+	if err != nil || analysisID == 0 {
+		return 0, 0, false
+	}
+	n, err := strconv.Atoi(seq)
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+	return uint(analysisID), n, true
+}
+
+// setStreamHeaders sets the headers of a Server-Sent Events response
+func setStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// sseEncoder writes typed events: start, content, error and complete
+type sseEncoder struct {
+	w http.ResponseWriter
+}
+
+func (e *sseEncoder) send(id, eventType, data string) {
+	if id != "" {
+		fmt.Fprintf(e.w, "id: %s\n", id)
+	}
+	fmt.Fprintf(e.w, "event: %s\n", eventType)
+	// Multi-line data needs one data field per line
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(e.w, "data: %s\n", line)
+	}
+	fmt.Fprint(e.w, "\n")
+	e.w.(http.Flusher).Flush()
+}
+
+func (e *sseEncoder) start(analysisID uint) {
+	e.send(eventID(analysisID, 0), "start", "Starting LLM analysis...")
+}
+
+func (e *sseEncoder) content(analysisID uint, seq int, delta string) {
+	e.send(eventID(analysisID, seq), "content", delta)
+}
+
+func (e *sseEncoder) complete(analysisID uint, cached bool) {
+	if cached {
+		e.send("", "complete", fmt.Sprintf(`{"id": %d, "message": "Analysis completed", "cached": true}`, analysisID))
+		return
+	}
+	e.send("", "complete", fmt.Sprintf(`{"id": %d, "message": "Analysis completed"}`, analysisID))
+}
+
+func (e *sseEncoder) fail(errType, message string) {
+	e.send("", "error", message)
+}
+
+// openAIEncoder writes OpenAI chat completion chunks followed by [DONE]
+type openAIEncoder struct {
+	w       http.ResponseWriter
+	chunkID string
+	model   string
+}
+
+func (e *openAIEncoder) start(analysisID uint) {}
+
+func (e *openAIEncoder) content(analysisID uint, seq int, delta string) {
+	deltaJson, _ := json.Marshal(map[string]interface{}{
+		"id":      e.chunkID,
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   e.model,
+		"choices": []map[string]interface{}{
+			{
+				"index": 0,
+				"delta": map[string]string{
+					"content": delta,
+				},
+				"finish_reason": nil,
+			},
+		},
+	})
+
+	fmt.Fprintf(e.w, "id: %s\ndata: %s\n\n", eventID(analysisID, seq), deltaJson)
+	e.w.(http.Flusher).Flush()
+}
+
+func (e *openAIEncoder) complete(analysisID uint, cached bool) {
+	fmt.Fprintf(e.w, "data: [DONE]\n\n")
+	e.w.(http.Flusher).Flush()
+}
+
+func (e *openAIEncoder) fail(errType, message string) {
+	errJson, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"message": message,
+			"type":    errType,
+		},
+	})
+	fmt.Fprintf(e.w, "data: %s\n\n", errJson)
+	e.w.(http.Flusher).Flush()
+}
+
+// streamAnalysis streams an analysis of processed data to one connection. With a Last-Event-ID
+// it resumes the analysis that event belongs to; otherwise it starts a new one, unless an
+// identical analysis is cached. The analysis is generated in the background, so it survives the
+// connection: ctx only ends this connection's part in it.
+func (s *LLMService) streamAnalysis(ctx context.Context, enc streamEncoder, processedDataID uint, opts AnalysisOptions, lastEventID string) {
+	if lastEventID != "" {
+		if analysisID, seq, ok := parseEventID(lastEventID); ok {
+			s.Logger.Infow("Resuming LLM analysis stream", "id", analysisID, "last_seq", seq)
+			s.resumeStream(ctx, enc, analysisID, seq)
+			return
+		}
+		s.Logger.Warnw("Ignoring invalid Last-Event-ID", "last_event_id", lastEventID)
+	}
+
+	processedData, err := s.processedDataForAnalysis(processedDataID)
+	if err != nil {
+		s.Logger.Errorw("Failed to load processed data for streaming analysis", "error", err)
+		errType := streamErrInternal
+		if errors.Is(err, ErrQualityGateFailed) {
+			errType = streamErrQuality
+		}
+		enc.fail(errType, err.Error())
+		return
+	}
+
+	// Prepare the prompt for the LLM with Markdown formatting guidance
+	prompt, err := s.analysisPrompt(AnalysisTypeReport, opts, processedData)
+	if err != nil {
+		s.Logger.Errorw("Failed to prepare prompt", "error", err)
+		enc.fail(streamErrPrompt, err.Error())
+		return
+	}
+
+	// Replay an identical recent analysis as if it were streamed live
+	req, cached, err := s.prepareCompletion(prompt, &opts, nil)
+	if err != nil {
+		s.Logger.Warnw("LLM analysis refused", "error", err)
+		errType := streamErrInternal
+		if errors.Is(err, ErrBudgetExceeded) {
+			errType = streamErrBudget
+		}
+		enc.fail(errType, err.Error())
+		return
+	}
+	if cached != nil {
+		enc.start(cached.ID)
+		chunks := s.analysisChunks(cached)
+		for i, chunk := range chunks {
+			enc.content(cached.ID, i+1, chunk)
+			if err := sleepContext(ctx, s.Settings.CacheReplayDelay); err != nil {
+				return
+			}
+		}
+		enc.complete(cached.ID, true)
+		return
+	}
+
+	st, err := s.startStream(processedData, opts, prompt, req)
+	if err != nil {
+		s.Logger.Errorw("Failed to start LLM analysis stream", "error", err)
+		enc.fail(streamErrDB, err.Error())
+		return
+	}
+	enc.start(st.analysisID)
+	s.followStream(ctx, enc, st, 0)
+}
+
+// startStream stores a streaming analysis and starts generating it in the background
+func (s *LLMService) startStream(processedData *models.ProcessedData, opts AnalysisOptions, prompt *renderedPrompt, req CompletionRequest) (*liveStream, error) {
+	llmAnalysis := &models.LLMAnalysis{
+		GeneratedAt:     time.Now(),
+		ProcessedDataID: &processedData.ID,
+		Status:          AnalysisStatusStreaming,
+	}
+	opts.Params.record(llmAnalysis, s.Provider.Name())
+	prompt.record(llmAnalysis)
+	if err := s.DB.Create(llmAnalysis).Error; err != nil {
+		return nil, fmt.Errorf("failed to store analysis: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &liveStream{analysisID: llmAnalysis.ID, cancel: cancel, changed: make(chan struct{})}
+	s.streamsMu.Lock()
+	s.streams[st.analysisID] = st
+	s.streamsMu.Unlock()
+
+	go s.generateStream(ctx, st, llmAnalysis, prompt, req)
+	return st, nil
+}
+
+// generateStream streams a completion into a live stream, storing its chunks as they arrive and
+// the final analysis once it ends
+func (s *LLMService) generateStream(ctx context.Context, st *liveStream, llmAnalysis *models.LLMAnalysis, prompt *renderedPrompt, req CompletionRequest) {
+	defer st.cancel()
+	defer time.AfterFunc(liveStreamRetention, func() {
+		s.streamsMu.Lock()
+		delete(s.streams, st.analysisID)
+		s.streamsMu.Unlock()
+	})
+
+	var pending []models.AnalysisChunk
+	lastFlush := time.Now()
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := s.storeChunks(llmAnalysis.ID, pending); err != nil {
+			s.Logger.Errorw("Failed to store analysis chunks", "id", llmAnalysis.ID, "error", err)
+		}
+		pending, lastFlush = nil, time.Now()
+	}
+
+	resp, err := s.stream(ctx, req, func(delta string) error {
+		seq := st.append(delta)
+		pending = append(pending, models.AnalysisChunk{LLMAnalysisID: llmAnalysis.ID, Seq: seq, Content: delta})
+		if time.Since(lastFlush) >= s.Settings.StreamFlushInterval {
+			flush()
+		}
+		return nil
+	})
+	flush()
+
+	if err != nil {
+		// resp holds the partial output when the stream broke off after its first chunk
+		if ctx.Err() != nil {
+			s.cancelledStream(llmAnalysis, prompt, req, resp)
+			st.finish(streamErrCancelled, "Analysis cancelled after all clients disconnected")
+			return
+		}
+		s.Logger.Errorw("LLM API request failed", "id", llmAnalysis.ID, "error", err)
+		llmAnalysis.Content = st.content()
+		llmAnalysis.Status = AnalysisStatusFailed
+		if resp != nil {
+			// The tokens generated before the failure are billed; the stream reported no usage,
+			// so it is estimated from the partial content
+			s.recordCompletion(llmAnalysis, prompt, req, resp)
+		} else {
+			prompt.Metadata.FailedCalls = append(prompt.Metadata.FailedCalls, err.Error())
+		}
+		prompt.record(llmAnalysis)
+		if err := s.DB.Save(llmAnalysis).Error; err != nil {
+			s.Logger.Errorw("Failed to store failed LLM analysis", "id", llmAnalysis.ID, "error", err)
+		}
+		st.finish(streamErrAPI, fmt.Sprintf("LLM API request failed: %v", err))
+		return
+	}
+
+	// Store the full content in the database
+	llmAnalysis.Content = resp.Content
+	llmAnalysis.Status = AnalysisStatusCompleted
+	s.recordCompletion(llmAnalysis, prompt, req, resp)
+	prompt.record(llmAnalysis)
+	if err := s.DB.Save(llmAnalysis).Error; err != nil {
+		s.Logger.Errorw("Failed to store LLM analysis", "error", err)
+		st.finish(streamErrDB, fmt.Sprintf("Failed to store analysis: %v", err))
+		return
+	}
+
+	st.finish("", "")
+	s.Logger.Infow("Streaming LLM analysis completed", "id", llmAnalysis.ID)
+}
+
+// storeChunks persists streamed chunks and appends them to the analysis content
+func (s *LLMService) storeChunks(analysisID uint, chunks []models.AnalysisChunk) error {
+	var text strings.Builder
+	for _, chunk := range chunks {
+		text.WriteString(chunk.Content)
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chunks).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.LLMAnalysis{}).Where("id = ?", analysisID).
+			Update("content", gorm.Expr("content || ?", text.String())).Error
+	})
+}
+
+// followStream sends a live stream to one connection from the chunk after seq, then follows it
+// until it finishes or ctx is done
+func (s *LLMService) followStream(ctx context.Context, enc streamEncoder, st *liveStream, seq int) {
+	s.attach(st)
+	defer s.detach(st)
+
+	for {
+		st.mu.Lock()
+		var chunks []string
+		if seq < len(st.chunks) {
+			chunks = st.chunks[seq:]
+		}
+		done, errType, errMsg, changed := st.done, st.errType, st.errMsg, st.changed
+		st.mu.Unlock()
+
+		for _, chunk := range chunks {
+			if ctx.Err() != nil {
+				return
+			}
+			seq++
+			enc.content(st.analysisID, seq, chunk)
+		}
+		if done {
+			if errType != "" {
+				enc.fail(errType, errMsg)
+			} else {
+				enc.complete(st.analysisID, false)
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// attach registers a connection following a stream, keeping it from being cancelled
+func (s *LLMService) attach(st *liveStream) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.subscribers++
+	if st.detachTimer != nil {
+		st.detachTimer.Stop()
+		st.detachTimer = nil
+	}
+}
+
+// detach unregisters a connection. When the last one leaves an unfinished stream, generation is
+// cancelled unless a client reconnects within the detach timeout.
+func (s *LLMService) detach(st *liveStream) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.subscribers--
+	if st.subscribers > 0 || st.done {
+		return
+	}
+	if s.Settings.StreamDetachTimeout <= 0 {
+		st.cancel()
+		return
+	}
+	st.detachTimer = time.AfterFunc(s.Settings.StreamDetachTimeout, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if st.subscribers == 0 && !st.done {
+			s.Logger.Infow("No client reconnected; cancelling LLM analysis stream", "id", st.analysisID)
+			st.cancel()
+		}
+	})
+}
+
+// resumeStream continues a stream after the chunk a client last received: from memory while it
+// is live or recently finished, otherwise from the stored analysis
+func (s *LLMService) resumeStream(ctx context.Context, enc streamEncoder, analysisID uint, seq int) {
+	s.streamsMu.Lock()
+	st := s.streams[analysisID]
+	s.streamsMu.Unlock()
+	if st != nil {
+		s.followStream(ctx, enc, st, seq)
+		return
+	}
+
+	var llmAnalysis models.LLMAnalysis
+	if err := s.DB.First(&llmAnalysis, analysisID).Error; err != nil {
+		enc.fail(streamErrNotFound, fmt.Sprintf("analysis %d not found", analysisID))
+		return
+	}
+	chunks := s.analysisChunks(&llmAnalysis)
+	for i := seq; i < len(chunks); i++ {
+		if ctx.Err() != nil {
+			return
+		}
+		enc.content(analysisID, i+1, chunks[i])
+	}
+
+	switch llmAnalysis.Status {
+	case AnalysisStatusCancelled:
+		enc.fail(streamErrCancelled, "Analysis was cancelled before it completed")
+	case AnalysisStatusFailed:
+		enc.fail(streamErrAPI, "Analysis failed before it completed")
+	case AnalysisStatusStreaming:
+		// Generation stopped without finishing, e.g. because the server restarted
+		enc.fail(streamErrInterrupted, "Analysis stream was interrupted")
+	default:
+		enc.complete(analysisID, false)
+	}
+}
+
+// analysisChunks returns the stored chunks of an analysis, or its content split into words when
+// it was not streamed
+func (s *LLMService) analysisChunks(llmAnalysis *models.LLMAnalysis) []string {
+	var stored []models.AnalysisChunk
+	if err := s.DB.Where("llm_analysis_id = ?", llmAnalysis.ID).Order("seq asc").Find(&stored).Error; err != nil {
+		s.Logger.Warnw("Failed to load analysis chunks", "id", llmAnalysis.ID, "error", err)
+	}
+	if len(stored) == 0 {
+		return replayChunks(llmAnalysis.Content)
+	}
+	chunks := make([]string, len(stored))
+	for i, chunk := range stored {
+		chunks[i] = chunk.Content
+	}
+	return chunks
+}
+
+// cancelledStream handles a stream cancelled after its clients disconnected: the content streamed
+// so far is kept as a cancelled analysis, or the analysis is deleted when so configured or when
+// nothing was streamed
+func (s *LLMService) cancelledStream(llmAnalysis *models.LLMAnalysis, prompt *renderedPrompt, req CompletionRequest, partial *CompletionResponse) {
+	if s.Settings.DiscardCancelled || partial == nil {
+		err := s.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Unscoped().Where("llm_analysis_id = ?", llmAnalysis.ID).Delete(&models.AnalysisChunk{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Delete(llmAnalysis).Error
+		})
+		if err != nil {
+			s.Logger.Errorw("Failed to discard cancelled LLM analysis", "id", llmAnalysis.ID, "error", err)
+			return
+		}
+		s.Logger.Infow("Clients disconnected; discarded partial LLM analysis", "id", llmAnalysis.ID)
+		return
+	}
+
+	llmAnalysis.Content = partial.Content
+	llmAnalysis.Status = AnalysisStatusCancelled
+	// Aborted streams report no usage, so it is estimated from the partial content
+	s.recordCompletion(llmAnalysis, prompt, req, partial)
+	prompt.record(llmAnalysis)
+
+	if err := s.DB.Save(llmAnalysis).Error; err != nil {
+		s.Logger.Errorw("Failed to store cancelled LLM analysis", "error", err)
+		return
+	}
+	s.Logger.Infow("Clients disconnected; stored partial LLM analysis as cancelled", "id", llmAnalysis.ID, "chars", len(partial.Content))
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// recordingEncoder is a streamEncoder that records the events it is asked to write
+type recordingEncoder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *recordingEncoder) record(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *recordingEncoder) start(analysisID uint) { e.record("start") }
+
+func (e *recordingEncoder) content(analysisID uint, seq int, delta string) {
+	e.record(fmt.Sprintf("%s:%q", eventID(analysisID, seq), delta))
+}
+
+func (e *recordingEncoder) complete(analysisID uint, cached bool) { e.record("complete") }
+
+func (e *recordingEncoder) fail(errType, message string) { e.record("fail:" + errType) }
+
+func (e *recordingEncoder) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return strings.Join(e.events, " ")
+}
+
+func TestParseEventID(t *testing.T) {
+	tests := []struct {
+		id       string
+		analysis uint
+		seq      int
+		ok       bool
+	}{
+		{"12-3", 12, 3, true},
+		{" 7-0 ", 7, 0, true},
+		{"12", 0, 0, false},
+		{"0-3", 0, 0, false},
+		{"12--1", 0, 0, false},
+		{"x-3", 0, 0, false},
+		{"12-x", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			analysis, seq, ok := parseEventID(tt.id)
+			if analysis != tt.analysis || seq != tt.seq || ok != tt.ok {
+				t.Errorf("parseEventID = %d, %d, %v; want %d, %d, %v", analysis, seq, ok, tt.analysis, tt.seq, tt.ok)
+			}
+		})
+	}
+
+	if analysis, seq, ok := parseEventID(eventID(42, 9)); analysis != 42 || seq != 9 || !ok {
+		t.Errorf("eventID does not round-trip: %d, %d, %v", analysis, seq, ok)
+	}
+}
+
+func TestFollowStreamResumesLiveStream(t *testing.T) {
+	s := NewLLMService(nil, zap.NewNop().Sugar(), nil, LLMSettings{StreamDetachTimeout: time.Minute}, nil)
+	cancelled := false
+	st := &liveStream{analysisID: 5, changed: make(chan struct{}), cancel: func() { cancelled = true }}
+	st.append("The ")
+	st.append("price ")
+
+	// A client that received the first chunk reconnects and follows the rest as it is generated
+	enc := &recordingEncoder{}
+	done := make(chan struct{})
+	go func() {
+		s.followStream(context.Background(), enc, st, 1)
+		close(done)
+	}()
+
+	st.append("rose")
+	st.finish("", "")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("followStream did not return after the stream finished")
+	}
+
+	if want := `5-2:"price " 5-3:"rose" complete`; enc.String() != want {
+		t.Errorf("events = %s, want %s", enc, want)
+	}
+	if cancelled || st.subscribers != 0 {
+		t.Errorf("finished stream cancelled %v with %d subscribers", cancelled, st.subscribers)
+	}
+}
+
+func TestFollowStreamReportsFailure(t *testing.T) {
+	s := NewLLMService(nil, zap.NewNop().Sugar(), nil, LLMSettings{}, nil)
+	st := &liveStream{analysisID: 5, changed: make(chan struct{}), cancel: func() {}}
+	st.append("partial")
+	st.finish(streamErrAPI, "provider failed")
+
+	enc := &recordingEncoder{}
+	s.followStream(context.Background(), enc, st, 3)
+	if want := "fail:" + streamErrAPI; enc.String() != want {
+		t.Errorf("events = %s, want %s", enc, want)
+	}
+}
+
+func TestDetachCancelsAbandonedStream(t *testing.T) {
+	tests := []struct {
+		name          string
+		detachTimeout time.Duration
+		reconnect     bool
+		wantCancelled bool
+	}{
+		{"no detach timeout", 0, false, true},
+		{"no client reconnects", 20 * time.Millisecond, false, true},
+		{"client reconnects in time", 50 * time.Millisecond, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewLLMService(nil, zap.NewNop().Sugar(), nil, LLMSettings{StreamDetachTimeout: tt.detachTimeout}, nil)
+			cancelled := make(chan struct{}, 1)
+			st := &liveStream{analysisID: 1, changed: make(chan struct{}), cancel: func() { cancelled <- struct{}{} }}
+
+			s.attach(st)
+			s.detach(st)
+			if tt.reconnect {
+				s.attach(st)
+			}
+
+			select {
+			case <-cancelled:
+				if !tt.wantCancelled {
+					t.Error("stream was cancelled although a client reconnected")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.wantCancelled {
+					t.Error("abandoned stream was not cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestResumeStoredStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		chunks []string
+		seq    int
+		want   string
+	}{
+		{"completed from stored chunks", AnalysisStatusCompleted, []string{"a ", "b ", "c"}, 1, `9-2:"b " 9-3:"c" complete`},
+		{"content split into words", AnalysisStatusCompleted, nil, 0, `9-1:"stored " 9-2:"content" complete`},
+		{"cancelled", AnalysisStatusCancelled, []string{"a "}, 1, "fail:" + streamErrCancelled},
+		{"interrupted by a restart", AnalysisStatusStreaming, []string{"a ", "b"}, 0, `9-1:"a " 9-2:"b" fail:` + streamErrInterrupted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newStubDB(t, func(q stubQuery) (*stubRows, error) {
+				switch {
+				case strings.Contains(q.SQL, `FROM "llm_analyses"`):
+					return &stubRows{Columns: []string{"id", "content", "status"}, Rows: [][]driver.Value{{int64(9), "stored content", tt.status}}}, nil
+				case strings.Contains(q.SQL, `FROM "analysis_chunks"`):
+					rows := &stubRows{Columns: []string{"id", "llm_analysis_id", "seq", "content"}}
+					for i, chunk := range tt.chunks {
+						rows.Rows = append(rows.Rows, []driver.Value{int64(i + 1), int64(9), int64(i + 1), chunk})
+					}
+					return rows, nil
+				}
+				return nil, nil
+			})
+			s := NewLLMService(db, zap.NewNop().Sugar(), nil, LLMSettings{}, nil)
+
+			enc := &recordingEncoder{}
+			s.resumeStream(context.Background(), enc, 9, tt.seq)
+			if enc.String() != tt.want {
+				t.Errorf("events = %s, want %s", enc, tt.want)
+			}
+		})
+	}
+
+	db, _ := newStubDB(t, nil)
+	enc := &recordingEncoder{}
+	NewLLMService(db, zap.NewNop().Sugar(), nil, LLMSettings{}, nil).resumeStream(context.Background(), enc, 9, 0)
+	if want := "fail:" + streamErrNotFound; enc.String() != want {
+		t.Errorf("events for a missing analysis = %s, want %s", enc, want)
+	}
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"gorm.io/gorm"
+)
+
+// ErrBudgetExceeded is returned when the daily or monthly LLM spending budget is used up
+var ErrBudgetExceeded = errors.New("LLM spending budget exceeded")
+
+// Budget actions
+const (
+	BudgetActionReject    = "reject"
+	BudgetActionDowngrade = "downgrade"
+)
+
+// ModelPrice is the price of a model in USD per million prompt and completion tokens
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// modelPrices maps model name prefixes to their list prices; LLM_PRICES adds to and overrides
+// them. Models without a price, such as local Ollama models, are recorded without a cost.
+var modelPrices = map[string]ModelPrice{
+	"gpt-4":             {Prompt: 30, Completion: 60},
+	"gpt-4-turbo":       {Prompt: 10, Completion: 30},
+	"gpt-4o":            {Prompt: 2.5, Completion: 10},
+	"gpt-4o-mini":       {Prompt: 0.15, Completion: 0.6},
+	"gpt-4.1":           {Prompt: 2, Completion: 8},
+	"gpt-4.1-mini":      {Prompt: 0.4, Completion: 1.6},
+	"gpt-4.1-nano":      {Prompt: 0.1, Completion: 0.4},
+	"gpt-3.5-turbo":     {Prompt: 0.5, Completion: 1.5},
+	"claude-3-5-sonnet": {Prompt: 3, Completion: 15},
+	"claude-3-5-haiku":  {Prompt: 0.8, Completion: 4},
+	"claude-3-opus":     {Prompt: 15, Completion: 75},
+	"claude-3-haiku":    {Prompt: 0.25, Completion: 1.25},
+}
+
+// ParsePriceTable parses model=prompt/completion entries, in USD per million tokens, e.g.
+// gpt-4o=2.5/10
+func ParsePriceTable(entries []string) (map[string]ModelPrice, error) {
+	prices := make(map[string]ModelPrice, len(entries))
+	for _, entry := range entries {
+		model, price, ok := strings.Cut(entry, "=")
+		promptPrice, completionPrice, ok2 := strings.Cut(price, "/")
+		if !ok || !ok2 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("invalid price %q, expected model=prompt/completion", entry)
+		}
+		prompt, err := strconv.ParseFloat(strings.TrimSpace(promptPrice), 64)
+		if err != nil || prompt < 0 {
+			return nil, fmt.Errorf("invalid prompt price in %q", entry)
+		}
+		completion, err := strconv.ParseFloat(strings.TrimSpace(completionPrice), 64)
+		if err != nil || completion < 0 {
+			return nil, fmt.Errorf("invalid completion price in %q", entry)
+		}
+		prices[strings.ToLower(strings.TrimSpace(model))] = ModelPrice{Prompt: prompt, Completion: completion}
+	}
+	return prices, nil
+}
+
+// BudgetSettings caps LLM spending per UTC day and month
+type BudgetSettings struct {
+	// Daily and Monthly are limits in USD; 0 disables a limit
+	Daily   float64
+	Monthly float64
+	// Action is reject (default) or downgrade, which switches requests to DowngradeModel
+	Action         string
+	DowngradeModel string
+}
+
+// priceFor returns the price of the longest matching model prefix among the built-in and
+// configured prices, the configured price winning for the same prefix
+func (s *LLMService) priceFor(model string) (ModelPrice, bool) {
+	prices := make(map[string]ModelPrice, len(modelPrices)+len(s.Settings.Prices))
+	for prefix, price := range modelPrices {
+		prices[prefix] = price
+	}
+	for prefix, price := range s.Settings.Prices {
+		prices[prefix] = price
+	}
+	return longestPrefixMatch(prices, strings.ToLower(model))
+}
+
+// completionUsage returns the token usage of a completion, estimating it from the prompt and the
+// generated text when the provider reported none
+func completionUsage(req CompletionRequest, resp *CompletionResponse) (TokenUsage, bool) {
+	if resp.Usage != nil && resp.Usage.PromptTokens+resp.Usage.CompletionTokens > 0 {
+		return *resp.Usage, false
+	}
+	return TokenUsage{
+		PromptTokens:     estimateMessageTokens(req.Model, req.Messages),
+		CompletionTokens: EstimateTokens(req.Model, resp.Content),
+	}, true
+}
+
+// recordUsage stores token usage and its cost on an analysis. The cost is left unset when the
+// model has no price.
+func (s *LLMService) recordUsage(analysis *models.LLMAnalysis, model string, usage TokenUsage, estimated bool) {
+	analysis.PromptTokens = usage.PromptTokens
+	analysis.CompletionTokens = usage.CompletionTokens
+	analysis.UsageEstimated = estimated
+	if price, ok := s.priceFor(model); ok {
+		cost := (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6
+		analysis.CostUSD = &cost
+	} else {
+		s.Logger.Warnw("No price configured for model; recording usage without cost", "model", model)
+	}
+}
+
+// spentSince returns the cost of the analyses generated since a time
+func (s *LLMService) spentSince(since time.Time) (float64, error) {
+	var spent float64
+	err := s.DB.Model(&models.LLMAnalysis{}).
+		Where("generated_at >= ?", since).
+		Select("COALESCE(SUM(cost_usd), 0)").
+		Scan(&spent).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum LLM spending: %w", err)
+	}
+	return spent, nil
+}
+
+// budgetPeriods returns the start of the current UTC day and month
+func budgetPeriods(now time.Time) (day, month time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
+
+// exceededBudget returns a description of the first budget that is used up, or "" when spending
+// is within budget
+func (s *LLMService) exceededBudget() (string, error) {
+	budget := s.Settings.Budget
+	day, month := budgetPeriods(time.Now())
+	limits := []struct {
+		name  string
+		limit float64
+		since time.Time
+	}{
+		{"daily", budget.Daily, day},
+		{"monthly", budget.Monthly, month},
+	}
+	for _, l := range limits {
+		if l.limit <= 0 {
+			continue
+		}
+		spent, err := s.spentSince(l.since)
+		if err != nil {
+			return "", err
+		}
+		if spent >= l.limit {
+			return fmt.Sprintf("%s budget of $%.2f used ($%.2f spent)", l.name, l.limit, spent), nil
+		}
+	}
+	return "", nil
+}
+
+// applyBudget rejects a request once a budget is used up, or switches it to the downgrade model.
+// It returns the original model when the request was downgraded.
+func (s *LLMService) applyBudget(params *ModelParams) (string, error) {
+	exceeded, err := s.exceededBudget()
+	if err != nil || exceeded == "" {
+		return "", err
+	}
+
+	downgrade := s.Settings.Budget.DowngradeModel
+	if s.Settings.Budget.Action != BudgetActionDowngrade || downgrade == "" || downgrade == params.Model {
+		return "", fmt.Errorf("%w: %s", ErrBudgetExceeded, exceeded)
+	}
+
+	s.Logger.Warnw("LLM budget exceeded; downgrading model", "budget", exceeded, "from", params.Model, "to", downgrade)
+	original := params.Model
+	params.Model = downgrade
+	return original, nil
+}
+
+// UsageTotals sums the token usage and cost of analyses
+type UsageTotals struct {
+	Analyses         int64   `json:"analyses"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	EstimatedUsage   int64   `json:"estimated_usage"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// DailyUsage is the usage of one UTC day
+type DailyUsage struct {
+	Date string `json:"date"`
+	UsageTotals
+}
+
+// ModelUsage is the usage of the provider and model that served the analyses
+type ModelUsage struct {
+	Provider  string `json:"provider"`
+	ModelName string `json:"model"`
+	UsageTotals
+}
+
+// BudgetStatus is the spending against the configured budgets
+type BudgetStatus struct {
+	DailyLimit     float64 `json:"daily_limit"`
+	DailySpent     float64 `json:"daily_spent"`
+	MonthlyLimit   float64 `json:"monthly_limit"`
+	MonthlySpent   float64 `json:"monthly_spent"`
+	Action         string  `json:"action"`
+	DowngradeModel string  `json:"downgrade_model,omitempty"`
+	Exceeded       bool    `json:"exceeded"`
+}
+
+// UsageReport is the LLM usage within a time range and the current budget status
+type UsageReport struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	Totals  UsageTotals  `json:"totals"`
+	ByDay   []DailyUsage `json:"by_day"`
+	ByModel []ModelUsage `json:"by_model"`
+	Budget  BudgetStatus `json:"budget"`
+}
+
+// usageColumns aggregates usage in report queries
+const usageColumns = "COUNT(*) AS analyses, " +
+	"COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens, " +
+	"COALESCE(SUM(completion_tokens), 0) AS completion_tokens, " +
+	"COUNT(*) FILTER (WHERE usage_estimated) AS estimated_usage, " +
+	"COALESCE(SUM(cost_usd), 0) AS cost_usd"
+
+// Usage reports the token usage and cost of the analyses generated within a time range
+func (s *LLMService) Usage(from, to time.Time) (*UsageReport, error) {
+	report := &UsageReport{From: from, To: to, ByDay: []DailyUsage{}, ByModel: []ModelUsage{}}
+	inRange := func() *gorm.DB {
+		return s.DB.Model(&models.LLMAnalysis{}).Where("generated_at >= ? AND generated_at < ?", from, to)
+	}
+
+	if err := inRange().Select(usageColumns).Scan(&report.Totals).Error; err != nil {
+		return nil, fmt.Errorf("failed to total LLM usage: %w", err)
+	}
+	day := "TO_CHAR(generated_at AT TIME ZONE 'UTC', 'YYYY-MM-DD')"
+	if err := inRange().Select(day + " AS date, " + usageColumns).Group(day).Order("date").Scan(&report.ByDay).Error; err != nil {
+		return nil, fmt.Errorf("failed to group LLM usage by day: %w", err)
+	}
+	// Spend is attributed to the model that served each analysis, which differs from the requested
+	// one after a fallback or downgrade; rows stored before served models were recorded have none.
+	// The groups are positional, as the output names would otherwise resolve to the raw columns.
+	served := "COALESCE(NULLIF(served_provider, ''), provider) AS provider, " +
+		"COALESCE(NULLIF(served_model, ''), model_name) AS model_name, "
+	if err := inRange().Select(served + usageColumns).Group("1, 2").Order("cost_usd desc").Scan(&report.ByModel).Error; err != nil {
+		return nil, fmt.Errorf("failed to group LLM usage by model: %w", err)
+	}
+
+	budget := s.Settings.Budget
+	report.Budget = BudgetStatus{
+		DailyLimit:     budget.Daily,
+		MonthlyLimit:   budget.Monthly,
+		Action:         budget.Action,
+		DowngradeModel: budget.DowngradeModel,
+	}
+	dayStart, monthStart := budgetPeriods(time.Now())
+	var err error
+	if report.Budget.DailySpent, err = s.spentSince(dayStart); err != nil {
+		return nil, err
+	}
+	if report.Budget.MonthlySpent, err = s.spentSince(monthStart); err != nil {
+		return nil, err
+	}
+	report.Budget.Exceeded = budget.Daily > 0 && report.Budget.DailySpent >= budget.Daily ||
+		budget.Monthly > 0 && report.Budget.MonthlySpent >= budget.Monthly
+
+	return report, nil
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Supported aggregations for metric series queries
+const (
+	AggregationAvg   = "avg"
+	AggregationMin   = "min"
+	AggregationMax   = "max"
+	AggregationLast  = "last"
+	AggregationSum   = "sum"
+	AggregationCount = "count"
+)
+
+// maxSeriesBuckets caps the number of buckets a single series query may produce
+const maxSeriesBuckets = 10000
+
+// MetricsService answers time-series queries over stored metric history
+type MetricsService struct {
+	DB     *gorm.DB
+	Logger *zap.SugaredLogger
+
+	// rolledUpTo records when the rollups of each resolution were last refreshed
+	rollupMu   sync.RWMutex
+	rolledUpTo map[string]time.Time
+}
+
+// NewMetricsService creates a new MetricsService instance
+func NewMetricsService(db *gorm.DB, logger *zap.SugaredLogger) *MetricsService {
+	return &MetricsService{
+		DB:         db,
+		Logger:     logger,
+		rolledUpTo: make(map[string]time.Time),
+	}
+}
+
+// SeriesQuery describes a bucketed time-series query over one or more metric keys
+type SeriesQuery struct {
+	Keys        []string
+	From        time.Time
+	To          time.Time
+	Step        time.Duration
+	Aggregation string
+	// Version restricts the query to points written by one processor version; by default the
+	// most recently written point of every observation is used
+	Version string
+	// Resolution is auto (default), raw, hourly or daily. Auto reads the coarsest rollup that
+	// fits the step and 'from', falling back to raw points.
+	Resolution string
+}
+
+// SeriesPoint is a single aggregated bucket in a metric series
+type SeriesPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// Series is the chart-ready result for a single metric key
+type Series struct {
+	Key        string        `json:"key"`
+	Resolution string        `json:"resolution"`
+	Points     []SeriesPoint `json:"points"`
+}
+
+// IsValidAggregation reports whether name is a supported series aggregation
+func IsValidAggregation(name string) bool {
+	switch name {
+	case AggregationAvg, AggregationMin, AggregationMax, AggregationLast, AggregationSum, AggregationCount:
+		return true
+	}
+	return false
+}
+
+// QuerySeries loads the metric history for each requested key, from rollups where the resolution
+// allows, and aggregates it into step-sized buckets
+func (s *MetricsService) QuerySeries(q SeriesQuery) ([]Series, error) {
+	if len(q.Keys) == 0 {
+		return nil, fmt.Errorf("at least one metric key is required")
+	}
+	if !q.To.After(q.From) {
+		return nil, fmt.Errorf("'to' must be after 'from'")
+	}
+	if q.Step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if q.To.Sub(q.From)/q.Step > maxSeriesBuckets {
+		return nil, fmt.Errorf("query would produce more than %d buckets; increase the step", maxSeriesBuckets)
+	}
+	if !IsValidAggregation(q.Aggregation) {
+		return nil, fmt.Errorf("unsupported aggregation: %s", q.Aggregation)
+	}
+
+	resolution, err := seriesResolution(q)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]map[int64]*bucketAccumulator, len(q.Keys))
+	bucketAt := func(key string, t time.Time) *bucketAccumulator {
+		if buckets[key] == nil {
+			buckets[key] = make(map[int64]*bucketAccumulator)
+		}
+		idx := int64(t.Sub(q.From) / q.Step)
+		if buckets[key][idx] == nil {
+			buckets[key][idx] = &bucketAccumulator{}
+		}
+		return buckets[key][idx]
+	}
+
+	// Complete rollup buckets cover the start of the range; raw points cover the rest
+	rawFrom := q.From
+	var rollupStepSize time.Duration
+	var gaps []rollupGap
+	covered := make(map[string]map[int64]bool)
+	if resolution != ResolutionRaw {
+		rollupStepSize, _ = rollupStep(resolution)
+		cutoff := s.rollupCutoff(resolution, rollupStepSize)
+		if end := q.To.Truncate(rollupStepSize); end.Before(cutoff) {
+			cutoff = end
+		}
+
+		if cutoff.After(q.From) {
+			var rollups []models.MetricRollup
+			err := s.DB.
+				Where("key IN ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ?", q.Keys, resolution, q.From, cutoff).
+				Find(&rollups).Error
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve metric rollups: %w", err)
+			}
+			for _, r := range rollups {
+				bucketAt(r.Key, r.BucketStart).merge(r.Min, r.Max, r.Sum, r.Count, r.Last, r.LastObservedAt)
+				if covered[r.Key] == nil {
+					covered[r.Key] = make(map[int64]bool)
+				}
+				covered[r.Key][r.BucketStart.UnixNano()] = true
+			}
+			// Buckets without a rollup row, e.g. written while the rollup job was not running,
+			// are read from raw points
+			gaps = rollupGaps(q.Keys, covered, q.From, cutoff, rollupStepSize)
+			rawFrom = cutoff
+		} else {
+			resolution = ResolutionRaw
+		}
+	}
+
+	if q.To.After(rawFrom) || len(gaps) > 0 {
+		var points []models.MetricPoint
+		window := s.DB.Where("key IN ? AND observed_at >= ? AND observed_at < ?", q.Keys, rawFrom, q.To)
+		for _, gap := range gaps {
+			window = window.Or("key = ? AND observed_at >= ? AND observed_at < ?", gap.key, gap.from, gap.to)
+		}
+		latest := latestMetricPoints(s.DB, q.Version).Where(window)
+		err := s.DB.Table("(?) AS p", latest).
+			Order("observed_at asc").
+			Find(&points).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve metric points: %w", err)
+		}
+		for _, p := range points {
+			if p.ObservedAt.Before(rawFrom) && covered[p.Key][p.ObservedAt.Truncate(rollupStepSize).UnixNano()] {
+				continue
+			}
+			bucketAt(p.Key, p.ObservedAt).add(p.Value, p.ObservedAt)
+		}
+	}
+
+	result := make([]Series, 0, len(q.Keys))
+	for _, key := range q.Keys {
+		series := Series{Key: key, Resolution: resolution, Points: []SeriesPoint{}}
+
+		indexes := make([]int64, 0, len(buckets[key]))
+		for idx := range buckets[key] {
+			indexes = append(indexes, idx)
+		}
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+		for _, idx := range indexes {
+			series.Points = append(series.Points, SeriesPoint{
+				Timestamp: q.From.Add(time.Duration(idx) * q.Step),
+				Value:     buckets[key][idx].value(q.Aggregation),
+			})
+		}
+		result = append(result, series)
+	}
+
+	return result, nil
+}
+
+// rollupGap is a range of rollup buckets of a metric that is read from raw points
+type rollupGap struct {
+	key      string
+	from, to time.Time
+}
+
+// rollupGaps returns, for every key, the range from its first rollup bucket in [from, cutoff)
+// without a rollup row up to the cutoff. Covered buckets within the range are skipped when the
+// raw points are aggregated, and buckets that are empty have no raw points to read.
+func rollupGaps(keys []string, covered map[string]map[int64]bool, from, cutoff time.Time, step time.Duration) []rollupGap {
+	var gaps []rollupGap
+	for _, key := range keys {
+		for t := from; t.Before(cutoff); t = t.Add(step) {
+			if !covered[key][t.UnixNano()] {
+				gaps = append(gaps, rollupGap{key: key, from: t, to: cutoff})
+				break
+			}
+		}
+	}
+	return gaps
+}
+
+// aggregateValues reduces the chronologically ordered values of a bucket with the given aggregation
+func aggregateValues(values []float64, aggregation string) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	switch aggregation {
+	case AggregationMin:
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	case AggregationMax:
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	case AggregationLast:
+		return values[len(values)-1]
+	case AggregationCount:
+		return float64(len(values))
+	}
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	if aggregation == AggregationSum {
+		return sum
+	}
+	return sum / float64(len(values))
+}
+
+// numericMetrics returns every combined and derived metric of a processed result that holds a number
+func numericMetrics(result *ProcessedResult) map[string]float64 {
+	metrics := make(map[string]float64, len(result.CombinedMetrics)+len(result.DerivedMetrics))
+	for key, value := range result.CombinedMetrics {
+		if f, ok := toFloat(value); ok {
+			metrics[key] = f
+		}
+	}
+	for key, value := range result.DerivedMetrics {
+		metrics[key] = value
+	}
+	return metrics
+}
+
+// metricPointsFromResult extracts every numeric metric of a processed result as a storable point
+func metricPointsFromResult(processedDataID uint, result *ProcessedResult) []models.MetricPoint {
+	metrics := numericMetrics(result)
+	points := make([]models.MetricPoint, 0, len(metrics))
+	for key, value := range metrics {
+		points = append(points, models.MetricPoint{
+			ProcessedDataID:  processedDataID,
+			Key:              key,
+			Value:            value,
+			ObservedAt:       result.SnapshotAt,
+			ProcessorVersion: ProcessorVersion,
+		})
+	}
+	return points
+}
+
+// latestMetricPoints selects one point per metric and observation time, preferring the most
+// recently written one so that reprocessed runs supersede the points of earlier processor versions
+func latestMetricPoints(db *gorm.DB, version string) *gorm.DB {
+	query := db.Model(&models.MetricPoint{}).
+		Select("DISTINCT ON (key, observed_at) *").
+		Order("key, observed_at, id desc")
+	if version != "" {
+		query = query.Where("processor_version = ?", version)
+	}
+	return query
+}
+
+// toFloat converts a decoded JSON value to a float64 when it holds a number or a numeric string
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return f, true
+	}
+	return 0, false
+}
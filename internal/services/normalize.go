@@ -0,0 +1,148 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnitRule declares the unit of every metric matching a glob pattern. Values are converted to the
+// canonical unit of that dimension (e.g. fahrenheit to celsius) unless KeepUnit is set.
+type UnitRule struct {
+	// Metric is a glob pattern matched against metric keys, e.g. "WeatherAPI_current_temp_f"
+	Metric string `json:"metric"`
+	// Unit is the unit the source reports the metric in, e.g. "fahrenheit" or "mph"
+	Unit string `json:"unit"`
+	// KeepUnit records the unit without converting the value
+	KeepUnit bool `json:"keep_unit,omitempty"`
+}
+
+// unitConversion converts a value from a unit to the canonical unit of its dimension
+type unitConversion struct {
+	canonical string
+	convert   func(float64) float64
+}
+
+func identity(v float64) float64 { return v }
+
+// unitConversions maps every known unit to its canonical unit
+var unitConversions = map[string]unitConversion{
+	// Temperature
+	"celsius":    {"celsius", identity},
+	"fahrenheit": {"celsius", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"kelvin":     {"celsius", func(v float64) float64 { return v - 273.15 }},
+	// Speed
+	"kph":   {"kph", identity},
+	"mph":   {"kph", func(v float64) float64 { return v * 1.609344 }},
+	"mps":   {"kph", func(v float64) float64 { return v * 3.6 }},
+	"knots": {"kph", func(v float64) float64 { return v * 1.852 }},
+	// Distance
+	"km":    {"km", identity},
+	"miles": {"km", func(v float64) float64 { return v * 1.609344 }},
+	// Precipitation
+	"mm": {"mm", identity},
+	"in": {"mm", func(v float64) float64 { return v * 25.4 }},
+	// Pressure
+	"mb":   {"mb", identity},
+	"hpa":  {"mb", identity},
+	"inhg": {"mb", func(v float64) float64 { return v * 33.8639 }},
+}
+
+// unitSuffixes infers the unit of a metric from a well-known key suffix. Inferred units are only
+// recorded; conversion requires an explicit unit rule.
+var unitSuffixes = map[string]string{
+	"_c":     "celsius",
+	"_f":     "fahrenheit",
+	"_kph":   "kph",
+	"_mph":   "mph",
+	"_km":    "km",
+	"_miles": "miles",
+	"_mm":    "mm",
+	"_mb":    "mb",
+}
+
+// timestampLayouts are the string formats recognized as timestamps during coercion
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02",
+}
+
+func (r UnitRule) validate() error {
+	if r.Metric == "" {
+		return fmt.Errorf("metric pattern is required")
+	}
+	if _, ok := unitConversions[strings.ToLower(r.Unit)]; !ok && !r.KeepUnit {
+		return fmt.Errorf("unknown unit %q; set keep_unit to record it without conversion", r.Unit)
+	}
+	return nil
+}
+
+// coerceValue parses numeric strings, booleans and timestamps into typed values
+func coerceValue(value interface{}) interface{} {
+	str, ok := value.(string)
+	if !ok {
+		return value
+	}
+	trimmed := strings.TrimSpace(str)
+
+	if f, err := strconv.ParseFloat(trimmed, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f
+	}
+	if b, err := strconv.ParseBool(trimmed); err == nil && len(trimmed) > 1 {
+		return b
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, trimmed); err == nil {
+			return t
+		}
+	}
+	return value
+}
+
+// normalizeMetrics coerces every metric value to its type and converts numeric metrics to their
+// canonical unit. It returns the unit applied to each metric that has one.
+func normalizeMetrics(metrics map[string]interface{}, rules []UnitRule) map[string]string {
+	units := make(map[string]string)
+
+	for key, value := range metrics {
+		value = coerceValue(value)
+		metrics[key] = value
+
+		f, isNumber := value.(float64)
+		if !isNumber {
+			continue
+		}
+
+		if rule, ok := matchUnitRule(rules, key); ok {
+			unit := strings.ToLower(rule.Unit)
+			if conversion, known := unitConversions[unit]; known && !rule.KeepUnit {
+				metrics[key] = conversion.convert(f)
+				unit = conversion.canonical
+			}
+			units[key] = unit
+			continue
+		}
+
+		for suffix, unit := range unitSuffixes {
+			if strings.HasSuffix(key, suffix) {
+				units[key] = unit
+				break
+			}
+		}
+	}
+
+	return units
+}
+
+// matchUnitRule returns the first unit rule whose pattern matches key
+func matchUnitRule(rules []UnitRule, key string) (UnitRule, bool) {
+	for _, rule := range rules {
+		if matchGlob(rule.Metric, key) {
+			return rule, true
+		}
+	}
+	return UnitRule{}, false
+}
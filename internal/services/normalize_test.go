@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCoerceValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"number", " 42.5 ", 42.5},
+		{"integer string", "7", 7.0},
+		{"NaN stays a string", "NaN", "NaN"},
+		{"infinity stays a string", "Inf", "Inf"},
+		{"boolean", "true", true},
+		{"single letter is not a boolean", "t", "t"},
+		{"RFC 3339 timestamp", "2024-05-01T12:00:00Z", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"date", "2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"plain string", "BTC", "BTC"},
+		{"non-string", 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coerceValue(tt.value)
+			if fmt.Sprintf("%T %v", got, got) != fmt.Sprintf("%T %v", tt.want, tt.want) {
+				t.Errorf("coerceValue(%v) = %T %v, want %T %v", tt.value, got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeMetrics(t *testing.T) {
+	rules := []UnitRule{
+		{Metric: "*_temp_f", Unit: "Fahrenheit"},
+		{Metric: "*_wind", Unit: "mph"},
+		{Metric: "*_pressure", Unit: "psi", KeepUnit: true},
+		{Metric: "*_temp_f", Unit: "kelvin"},
+	}
+
+	tests := []struct {
+		key       string
+		value     interface{}
+		wantValue float64
+		wantUnit  string
+	}{
+		{"Weather_temp_f", "212", 100, "celsius"},
+		{"Weather_wind", 10.0, 16.09344, "kph"},
+		{"Weather_pressure", 14.7, 14.7, "psi"},
+		// Inferred units are recorded without converting
+		{"Weather_current_temp_c", 21.0, 21, "celsius"},
+		{"Weather_current_feels_f", 70.0, 70, "fahrenheit"},
+		{"Crypto_price", "5", 5, ""},
+	}
+
+	metrics := make(map[string]interface{})
+	for _, tt := range tests {
+		metrics[tt.key] = tt.value
+	}
+	metrics["Crypto_symbol"] = "BTC"
+	units := normalizeMetrics(metrics, rules)
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got, ok := metrics[tt.key].(float64); !ok || math.Abs(got-tt.wantValue) > 1e-9 {
+				t.Errorf("value = %v, want %g", metrics[tt.key], tt.wantValue)
+			}
+			if units[tt.key] != tt.wantUnit {
+				t.Errorf("unit = %q, want %q", units[tt.key], tt.wantUnit)
+			}
+		})
+	}
+	if metrics["Crypto_symbol"] != "BTC" || units["Crypto_symbol"] != "" {
+		t.Errorf("string metric changed to %v with unit %q", metrics["Crypto_symbol"], units["Crypto_symbol"])
+	}
+}
+
+func TestUnitRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule    UnitRule
+		wantErr bool
+	}{
+		{UnitRule{Metric: "*_f", Unit: "fahrenheit"}, false},
+		{UnitRule{Metric: "*_f", Unit: "KNOTS"}, false},
+		{UnitRule{Metric: "*_p", Unit: "psi", KeepUnit: true}, false},
+		{UnitRule{Metric: "*_p", Unit: "psi"}, true},
+		{UnitRule{Unit: "mph"}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.rule.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, want error %v", tt.rule, err, tt.wantErr)
+		}
+	}
+}
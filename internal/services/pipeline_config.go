@@ -0,0 +1,140 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// PipelineConfig holds the structured per-metric and per-source settings of the data pipeline.
+// It is loaded from the JSON file referenced by PIPELINE_CONFIG_FILE.
+type PipelineConfig struct {
+	AnomalyRules []AnomalyRule `json:"anomaly_rules"`
+	UnitRules    []UnitRule    `json:"unit_rules"`
+	QualityRules []QualityRule `json:"quality_rules"`
+	// Flatten holds flattening options per source name; the "default" entry applies to other sources
+	Flatten map[string]FlattenOptions `json:"flatten"`
+	// Correlations lists the metric pairs correlated across history
+	Correlations []CorrelationPair `json:"correlations"`
+	// CorrelationFactThreshold is the absolute coefficient at which a correlation is reported to the LLM
+	CorrelationFactThreshold float64 `json:"correlation_fact_threshold,omitempty"`
+	// CorrelationMinSamples is the number of aligned points a correlation needs to be reported to the LLM
+	CorrelationMinSamples int `json:"correlation_min_samples,omitempty"`
+	// Transformers is the ordered transformer chain; defaults to flatten followed by coerce
+	Transformers []TransformerStep `json:"transformers"`
+	// Forecasts lists the metrics forecast after each processing run
+	Forecasts []ForecastSpec `json:"forecasts"`
+	// Alignment joins sources by their event timestamps; when unset, observations are combined as fetched
+	Alignment *AlignmentConfig `json:"alignment,omitempty"`
+}
+
+// minPositivePrice guards the default configuration against zero or negative prices
+var minPositivePrice = 0.000001
+
+// DefaultPipelineConfig returns the configuration used when no pipeline config file is provided
+func DefaultPipelineConfig() *PipelineConfig {
+	return &PipelineConfig{
+		AnomalyRules: []AnomalyRule{
+			{Metric: "*", Method: AnomalyMethodZScore},
+		},
+		// The default rule only warns: a rule matching no metric fails, and the key changes with the
+		// flatten separator and the adapt transformer
+		QualityRules: []QualityRule{
+			{Name: "btc_price_positive", Metric: "CryptoAPI_data_priceUsd", Check: QualityCheckRange, Min: &minPositivePrice, Severity: QualitySeverityWarn},
+		},
+	}
+}
+
+// LoadPipelineConfig reads the pipeline configuration from a JSON file, falling back to the
+// defaults when path is empty
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	if path == "" {
+		return DefaultPipelineConfig(), nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline config: %w", err)
+	}
+
+	cfg := &PipelineConfig{}
+	if err := json.Unmarshal(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+
+	for i, rule := range cfg.AnomalyRules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid anomaly rule %d: %w", i, err)
+		}
+	}
+	for i, rule := range cfg.UnitRules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid unit rule %d: %w", i, err)
+		}
+	}
+	for source, opts := range cfg.Flatten {
+		if err := opts.validate(); err != nil {
+			return nil, fmt.Errorf("invalid flatten options for %s: %w", source, err)
+		}
+	}
+	for i, pair := range cfg.Correlations {
+		if err := pair.validate(); err != nil {
+			return nil, fmt.Errorf("invalid correlation pair %d: %w", i, err)
+		}
+	}
+	if cfg.CorrelationFactThreshold < 0 || cfg.CorrelationFactThreshold > 1 {
+		return nil, fmt.Errorf("correlation_fact_threshold must be between 0 and 1")
+	}
+	if cfg.CorrelationMinSamples < 0 {
+		return nil, fmt.Errorf("correlation_min_samples must not be negative")
+	}
+	for i, spec := range cfg.Forecasts {
+		if err := spec.validate(); err != nil {
+			return nil, fmt.Errorf("invalid forecast %d: %w", i, err)
+		}
+	}
+	if cfg.Alignment != nil {
+		if err := cfg.Alignment.validate(); err != nil {
+			return nil, fmt.Errorf("invalid alignment: %w", err)
+		}
+	}
+	for i, rule := range cfg.QualityRules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid quality rule %d: %w", i, err)
+		}
+	}
+
+	if _, err := buildTransformerChain(cfg.Transformers); err != nil {
+		return nil, fmt.Errorf("invalid transformer chain: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Hash returns a short fingerprint of the configuration, used to tell apart processed data
+// produced under different settings
+func (c *PipelineConfig) Hash() string {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// flattenOptions returns the flattening options configured for a source
+func (c *PipelineConfig) flattenOptions(source string) FlattenOptions {
+	if opts, ok := c.Flatten[source]; ok {
+		return opts.withDefaults()
+	}
+	return c.Flatten["default"].withDefaults()
+}
+
+// matchGlob reports whether a metric key matches a glob pattern such as "CryptoAPI_*"
+func matchGlob(pattern, key string) bool {
+	matched, err := path.Match(pattern, key)
+	return err == nil && matched
+}
@@ -3,24 +3,39 @@ package services
 import (
 	"encoding/json"
 	"fmt"
+	"path"
+	"strconv"
 	"time"
-	
+
 	"github.com/arkouda/PipelineIQ/internal/models"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
+// LatestProcessedOrder orders processed data newest source data first, so reprocessed historical
+// runs do not count as the latest data
+const LatestProcessedOrder = "observed_at desc, id desc"
+
+// ProcessorVersion identifies the processing logic that produced a ProcessedData row. Bump it
+// whenever combineAndTransform or a built-in transformer changes its output.
+const ProcessorVersion = "1.0.0"
+
 // DataProcessorService handles transforming raw data into processed insights
 type DataProcessorService struct {
 	DB     *gorm.DB
 	Logger *zap.SugaredLogger
+	Config *PipelineConfig
+	// ConfigHash fingerprints the pipeline config every processed row is stamped with
+	ConfigHash string
 }
 
 // NewDataProcessorService creates a new DataProcessorService instance
-func NewDataProcessorService(db *gorm.DB, logger *zap.SugaredLogger) *DataProcessorService {
+func NewDataProcessorService(db *gorm.DB, logger *zap.SugaredLogger, config *PipelineConfig) *DataProcessorService {
 	return &DataProcessorService{
-		DB:     db,
-		Logger: logger,
+		DB:         db,
+		Logger:     logger,
+		Config:     config,
+		ConfigHash: config.Hash(),
 	}
 }
 
@@ -33,10 +48,20 @@ type APIData struct {
 
 // ProcessedResult represents the combined and transformed data
 type ProcessedResult struct {
-	Timestamp        time.Time              `json:"timestamp"`
-	CombinedMetrics  map[string]interface{} `json:"combined_metrics"`
-	DerivedMetrics   map[string]float64     `json:"derived_metrics"`
-	DataSources      []string               `json:"data_sources"`
+	Timestamp time.Time `json:"timestamp"`
+	// ObservedAt is when the run's data was fetched; freshness and change checks are judged
+	// against it, so equally stale sources cannot pass by agreeing with each other
+	ObservedAt time.Time `json:"observed_at"`
+	// SnapshotAt is the time the metrics describe: the latest source event time when sources are
+	// aligned, otherwise ObservedAt. Metric points are stored at this time.
+	SnapshotAt      time.Time              `json:"snapshot_at"`
+	CombinedMetrics map[string]interface{} `json:"combined_metrics"`
+	DerivedMetrics  map[string]float64     `json:"derived_metrics"`
+	DataSources     []string               `json:"data_sources"`
+	Units           map[string]string      `json:"units"`
+	Anomalies       []Anomaly              `json:"anomalies"`
+	Diagnostics     []Diagnostic           `json:"diagnostics"`
+	Alignment       *Alignment             `json:"alignment,omitempty"`
 }
 
 // ProcessData retrieves the latest raw data and processes it
@@ -44,22 +69,79 @@ func (s *DataProcessorService) ProcessData() (*models.ProcessedData, error) {
 	s.Logger.Info("Starting data processing")
 
 	// Retrieve the latest raw data entries
-	var rawDataEntries []models.RawData
-	if err := s.DB.Order("fetched_at desc").Limit(2).Find(&rawDataEntries).Error; err != nil {
-		return nil, fmt.Errorf("failed to retrieve raw data: %w", err)
+	runID, rawDataEntries, err := s.latestRawRun()
+	if err != nil {
+		return nil, err
 	}
 
-	if len(rawDataEntries) == 0 {
-		return nil, fmt.Errorf("no raw data available for processing")
+	s.Logger.Infow("Retrieved raw data for processing", "count", len(rawDataEntries), "run_id", runID)
+	return s.processRun(runID, rawDataEntries)
+}
+
+// latestRawRun returns the raw data entries of the most recent ingestion run
+func (s *DataProcessorService) latestRawRun() (string, []models.RawData, error) {
+	var latest models.RawData
+	if err := s.DB.Order("fetched_at desc").Limit(1).Find(&latest).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to retrieve raw data: %w", err)
 	}
+	if latest.ID == 0 {
+		return "", nil, fmt.Errorf("no raw data available for processing")
+	}
+
+	// Entries fetched before runs were recorded are paired by recency
+	var rawDataEntries []models.RawData
+	query := s.DB.Order("fetched_at desc")
+	if latest.RunID != "" {
+		query = query.Where("run_id = ?", latest.RunID)
+	} else {
+		query = query.Limit(2)
+	}
+	if err := query.Find(&rawDataEntries).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to retrieve raw data: %w", err)
+	}
+
+	return latest.RunID, rawDataEntries, nil
+}
 
-	s.Logger.Infow("Retrieved raw data for processing", "count", len(rawDataEntries))
+// processRun transforms the raw data entries of one ingestion run and stores the result stamped
+// with the current processor version and config hash
+func (s *DataProcessorService) processRun(runID string, rawDataEntries []models.RawData) (*models.ProcessedData, error) {
+	// Join the source observations by their event times
+	rawDataEntries, alignment, err := s.alignRun(rawDataEntries)
+	if err != nil {
+		return nil, fmt.Errorf("source alignment failed: %w", err)
+	}
 
 	// Process and combine the data
 	combinedResult, err := s.combineAndTransform(rawDataEntries)
 	if err != nil {
 		return nil, fmt.Errorf("data transformation failed: %w", err)
 	}
+	if alignment != nil {
+		combinedResult.Alignment = alignment
+		combinedResult.SnapshotAt = alignment.SnapshotTime
+		for key, value := range alignmentMetrics(alignment) {
+			combinedResult.CombinedMetrics[key] = value
+		}
+	}
+
+	// Compare this run's metrics with their history before recording them
+	combinedResult.Anomalies, err = s.detectAnomalies(numericMetrics(combinedResult), combinedResult.ObservedAt)
+	if err != nil {
+		return nil, fmt.Errorf("anomaly detection failed: %w", err)
+	}
+	if len(combinedResult.Anomalies) > 0 {
+		s.Logger.Infow("Detected metric anomalies", "count", len(combinedResult.Anomalies))
+	}
+
+	// Evaluate data-quality rules; a failing check blocks LLM analysis of this run
+	qualityChecks, qualityStatus, err := s.evaluateQualityRules(combinedResult)
+	if err != nil {
+		return nil, fmt.Errorf("quality checks failed to run: %w", err)
+	}
+	if qualityStatus != QualityStatusPassed {
+		s.Logger.Warnw("Processed data did not pass all quality checks", "status", qualityStatus)
+	}
 
 	// Convert the processed result to JSON
 	resultJSON, err := json.Marshal(combinedResult)
@@ -69,15 +151,44 @@ func (s *DataProcessorService) ProcessData() (*models.ProcessedData, error) {
 
 	// Store the processed data
 	processedData := models.ProcessedData{
-		Content:     string(resultJSON),
-		ProcessedAt: time.Now(),
+		Content:          string(resultJSON),
+		ProcessedAt:      time.Now(),
+		ObservedAt:       combinedResult.ObservedAt,
+		QualityStatus:    qualityStatus,
+		RawData:          rawDataEntries,
+		ProcessorVersion: ProcessorVersion,
+		ConfigHash:       s.ConfigHash,
+		SourceRunID:      runID,
 	}
 
-	if err := s.DB.Create(&processedData).Error; err != nil {
+	// Link the raw payloads without rewriting them
+	if err := s.DB.Omit("RawData.*").Create(&processedData).Error; err != nil {
 		return nil, fmt.Errorf("failed to store processed data: %w", err)
 	}
 
-	s.Logger.Infow("Data processing completed successfully", "id", processedData.ID)
+	// Record the numeric metrics of this run so they can be queried as history
+	points := metricPointsFromResult(processedData.ID, combinedResult)
+	if len(points) > 0 {
+		if err := s.DB.CreateInBatches(&points, 100).Error; err != nil {
+			return nil, fmt.Errorf("failed to store metric points: %w", err)
+		}
+	}
+
+	if len(combinedResult.Anomalies) > 0 {
+		records := anomalyRecords(processedData.ID, combinedResult.Timestamp, combinedResult.Anomalies)
+		if err := s.DB.Create(&records).Error; err != nil {
+			return nil, fmt.Errorf("failed to store anomalies: %w", err)
+		}
+	}
+
+	if len(qualityChecks) > 0 {
+		records := qualityCheckRecords(processedData.ID, processedData.ProcessedAt, qualityChecks)
+		if err := s.DB.Create(&records).Error; err != nil {
+			return nil, fmt.Errorf("failed to store quality checks: %w", err)
+		}
+	}
+
+	s.Logger.Infow("Data processing completed successfully", "id", processedData.ID, "processor_version", ProcessorVersion)
 	return &processedData, nil
 }
 
@@ -86,12 +197,23 @@ func (s *DataProcessorService) combineAndTransform(rawDataEntries []models.RawDa
 	// Initialize result
 	result := &ProcessedResult{
 		Timestamp:       time.Now(),
+		ObservedAt:      latestFetchedAt(rawDataEntries),
+		SnapshotAt:      latestFetchedAt(rawDataEntries),
 		CombinedMetrics: make(map[string]interface{}),
 		DerivedMetrics:  make(map[string]float64),
 		DataSources:     []string{},
+		Units:           make(map[string]string),
+		Anomalies:       []Anomaly{},
+	}
+
+	// Build the transformer chain for this run
+	chain, err := buildTransformerChain(s.Config.Transformers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build transformer chain: %w", err)
 	}
 
-	// Process each raw data entry
+	// Start the chain with each source's payload under its source name
+	metrics := MetricSet{}
 	for _, entry := range rawDataEntries {
 		// Parse the JSON content as a generic map first to handle different API structures
 		var rawJSON map[string]interface{}
@@ -102,19 +224,28 @@ func (s *DataProcessorService) combineAndTransform(rawDataEntries []models.RawDa
 
 		// Add source to the list
 		result.DataSources = append(result.DataSources, entry.SourceName)
+		metrics[entry.SourceName] = rawJSON
+	}
 
-		// Process the JSON data based on its structure
-		flattenedData := make(map[string]interface{})
-		
-		// Flatten the JSON structure for easier processing
-		flattenJSON("", rawJSON, flattenedData)
-		
-		// Add all flattened data to combined metrics
-		for key, value := range flattenedData {
-			result.CombinedMetrics[fmt.Sprintf("%s_%s", entry.SourceName, key)] = value
-		}
+	ctx := &RunContext{
+		Timestamp: result.Timestamp,
+		Sources:   result.DataSources,
+		RawData:   rawDataEntries,
+		Config:    s.Config,
+		Logger:    s.Logger,
+		Units:     result.Units,
 	}
 
+	// Flatten, coerce and otherwise transform the metrics through the configured chain
+	metrics, result.Diagnostics, err = runTransformerChain(ctx, chain, metrics)
+	for _, d := range result.Diagnostics {
+		s.Logger.Infow("Transformer diagnostic", "transformer", d.Transformer, "level", d.Level, "message", d.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.CombinedMetrics = metrics
+
 	// Calculate derived metrics
 	// This is a placeholder - in a real application, this would implement domain-specific logic
 	// to calculate meaningful derived metrics based on the combined data
@@ -129,32 +260,192 @@ func (s *DataProcessorService) combineAndTransform(rawDataEntries []models.RawDa
 	return result, nil
 }
 
+// latestFetchedAt returns the time the most recent of the raw data entries was fetched
+func latestFetchedAt(rawDataEntries []models.RawData) time.Time {
+	var latest time.Time
+	for _, entry := range rawDataEntries {
+		if entry.FetchedAt.After(latest) {
+			latest = entry.FetchedAt
+		}
+	}
+	return latest
+}
+
+// Supported array handling modes for flattening
+const (
+	ArrayModeExpand = "expand"
+	ArrayModeCount  = "count"
+	ArrayModeFirstN = "first_n"
+	ArrayModeStats  = "stats"
+)
+
+// FlattenOptions controls how a source's nested JSON is flattened into metric keys
+type FlattenOptions struct {
+	// Separator joins the path segments of a key; defaults to "_"
+	Separator string `json:"separator,omitempty"`
+	// MaxDepth limits how many levels are flattened; deeper values are stored as JSON strings.
+	// Zero means unlimited.
+	MaxDepth int `json:"max_depth,omitempty"`
+	// ArrayMode is one of expand (default), count, first_n or stats
+	ArrayMode string `json:"array_mode,omitempty"`
+	// ArrayLimit is the number of elements kept by first_n; defaults to 5
+	ArrayLimit int `json:"array_limit,omitempty"`
+	// Include and Exclude are glob patterns matched against flattened keys without the source prefix
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func (o FlattenOptions) validate() error {
+	switch o.ArrayMode {
+	case "", ArrayModeExpand, ArrayModeCount, ArrayModeFirstN, ArrayModeStats:
+	default:
+		return fmt.Errorf("unsupported array_mode: %s", o.ArrayMode)
+	}
+	if o.MaxDepth < 0 || o.ArrayLimit < 0 {
+		return fmt.Errorf("max_depth and array_limit must not be negative")
+	}
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// withDefaults fills in the separator, array mode and array limit when unset
+func (o FlattenOptions) withDefaults() FlattenOptions {
+	if o.Separator == "" {
+		o.Separator = "_"
+	}
+	if o.ArrayMode == "" {
+		o.ArrayMode = ArrayModeExpand
+	}
+	if o.ArrayLimit == 0 {
+		o.ArrayLimit = 5
+	}
+	return o
+}
+
+// join appends a segment to a key prefix using the configured separator
+func (o FlattenOptions) join(prefix, segment string) string {
+	if prefix == "" {
+		return segment
+	}
+	return prefix + o.Separator + segment
+}
+
+// store records a flattened value unless its key is filtered out by the include/exclude globs
+func (o FlattenOptions) store(result map[string]interface{}, key string, value interface{}) {
+	if len(o.Include) > 0 && !matchAnyGlob(o.Include, key) {
+		return
+	}
+	if matchAnyGlob(o.Exclude, key) {
+		return
+	}
+	result[key] = value
+}
+
 // flattenJSON recursively flattens a nested JSON structure into a single-level map
 // with keys representing the path to each value
-func flattenJSON(prefix string, data map[string]interface{}, result map[string]interface{}) {
+func flattenJSON(prefix string, data map[string]interface{}, result map[string]interface{}, opts FlattenOptions, depth int) {
 	for k, v := range data {
-		key := k
-		if prefix != "" {
-			key = prefix + "_" + k
-		}
+		key := opts.join(prefix, k)
 
 		switch val := v.(type) {
 		case map[string]interface{}:
-			// Recursively flatten nested maps
-			flattenJSON(key, val, result)
-		case []interface{}:
-			// For arrays, store a count and process each item with index
-			result[key+"_count"] = len(val)
-			for i, item := range val {
-				if mapItem, ok := item.(map[string]interface{}); ok {
-					flattenJSON(fmt.Sprintf("%s_%d", key, i), mapItem, result)
-				} else {
-					result[fmt.Sprintf("%s_%d", key, i)] = item
-				}
+			// Recursively flatten nested maps until the maximum depth is reached
+			if opts.MaxDepth > 0 && depth+1 >= opts.MaxDepth {
+				opts.store(result, key, encodeJSONValue(val))
+				continue
 			}
+			flattenJSON(key, val, result, opts, depth+1)
+		case []interface{}:
+			flattenArray(key, val, result, opts, depth)
 		default:
 			// Store primitive values directly
-			result[key] = val
+			opts.store(result, key, val)
+		}
+	}
+}
+
+// flattenArray stores an array's element count and then its elements according to the array mode
+func flattenArray(key string, items []interface{}, result map[string]interface{}, opts FlattenOptions, depth int) {
+	opts.store(result, opts.join(key, "count"), len(items))
+
+	switch opts.ArrayMode {
+	case ArrayModeCount:
+		return
+	case ArrayModeStats:
+		storeArrayStats(key, items, result, opts)
+		return
+	case ArrayModeFirstN:
+		if len(items) > opts.ArrayLimit {
+			items = items[:opts.ArrayLimit]
+		}
+	}
+
+	for i, item := range items {
+		itemKey := opts.join(key, strconv.Itoa(i))
+		switch it := item.(type) {
+		case map[string]interface{}:
+			if opts.MaxDepth > 0 && depth+1 >= opts.MaxDepth {
+				opts.store(result, itemKey, encodeJSONValue(it))
+				continue
+			}
+			flattenJSON(itemKey, it, result, opts, depth+1)
+		default:
+			opts.store(result, itemKey, item)
+		}
+	}
+}
+
+// storeArrayStats aggregates the numeric values of an array into min, max, avg and sum metrics.
+// Arrays of objects are aggregated per flattened field.
+func storeArrayStats(key string, items []interface{}, result map[string]interface{}, opts FlattenOptions) {
+	values := make(map[string][]float64)
+	fieldOpts := FlattenOptions{Separator: opts.Separator, ArrayMode: ArrayModeCount}
+
+	for _, item := range items {
+		if mapItem, ok := item.(map[string]interface{}); ok {
+			fields := make(map[string]interface{})
+			flattenJSON("", mapItem, fields, fieldOpts, 0)
+			for field, value := range fields {
+				if f, ok := toFloat(value); ok {
+					values[field] = append(values[field], f)
+				}
+			}
+		} else if f, ok := toFloat(item); ok {
+			values[""] = append(values[""], f)
+		}
+	}
+
+	for field, vals := range values {
+		fieldKey := opts.join(key, field)
+		if field == "" {
+			fieldKey = key
+		}
+		opts.store(result, opts.join(fieldKey, "min"), aggregateValues(vals, AggregationMin))
+		opts.store(result, opts.join(fieldKey, "max"), aggregateValues(vals, AggregationMax))
+		opts.store(result, opts.join(fieldKey, "avg"), aggregateValues(vals, AggregationAvg))
+		opts.store(result, opts.join(fieldKey, "sum"), aggregateValues(vals, AggregationSum))
+	}
+}
+
+// encodeJSONValue serializes a nested value that is stored as a single metric
+func encodeJSONValue(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// matchAnyGlob reports whether key matches at least one of the glob patterns
+func matchAnyGlob(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, key) {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,596 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Prompt reduction strategies, applied in this order until the data fits the budget
+const (
+	TruncationDropLowPriority  = "drop_low_priority"
+	TruncationSummarizeArrays  = "summarize_arrays"
+	TruncationDropMetrics      = "drop_metrics"
+	TruncationDropDerived      = "drop_derived"
+	TruncationDropAnomalyInput = "drop_anomaly_metrics"
+	TruncationDropAnomalies    = "drop_anomalies"
+	TruncationTruncateText     = "truncate_text"
+)
+
+// defaultContextWindow is assumed for models missing from modelContextWindows
+const defaultContextWindow = 8192
+
+// defaultOutputReserve is kept free for the response when a request sets no max_tokens
+const defaultOutputReserve = 1024
+
+// messageOverheadTokens covers the per-message framing the provider adds around the prompt
+const messageOverheadTokens = 16
+
+// arraySummaryKeep is the number of leading elements kept when an expanded array is summarized
+const arraySummaryKeep = 3
+
+// maxReportedKeys caps the number of dropped keys listed in a truncation report
+const maxReportedKeys = 100
+
+// modelContextWindows maps model name prefixes to context window sizes in tokens; the longest
+// matching prefix wins
+var modelContextWindows = map[string]int{
+	"gpt-4":         8192,
+	"gpt-4-32k":     32768,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-3.5-turbo": 16385,
+	"o1":            200000,
+	"o3":            200000,
+	"claude":        200000,
+	"llama3":        8192,
+	"llama3.1":      131072,
+	"llama3.2":      131072,
+	"mistral":       32768,
+	"qwen2.5":       32768,
+}
+
+// modelCharsPerToken maps model name prefixes to the average number of characters per token of
+// JSON-heavy prompts. The ratios err low so estimates err high.
+var modelCharsPerToken = map[string]float64{
+	"gpt-4o":  3.6,
+	"gpt-4.1": 3.6,
+	"o1":      3.6,
+	"o3":      3.6,
+	"claude":  3.2,
+	"llama":   3.4,
+	"mistral": 3.2,
+	"qwen":    3.4,
+}
+
+// defaultCharsPerToken is used for models missing from modelCharsPerToken
+const defaultCharsPerToken = 3.3
+
+// longestPrefixMatch returns the value of the longest key that prefixes model
+func longestPrefixMatch[V any](table map[string]V, model string) (V, bool) {
+	var value V
+	best := -1
+	for prefix, v := range table {
+		if strings.HasPrefix(model, prefix) && len(prefix) > best {
+			value, best = v, len(prefix)
+		}
+	}
+	return value, best >= 0
+}
+
+// ContextWindow returns the context window of a model in tokens
+func ContextWindow(model string) int {
+	if window, ok := longestPrefixMatch(modelContextWindows, strings.ToLower(model)); ok {
+		return window
+	}
+	return defaultContextWindow
+}
+
+// charsPerToken returns the average number of characters per token of a model
+func charsPerToken(model string) float64 {
+	if ratio, ok := longestPrefixMatch(modelCharsPerToken, strings.ToLower(model)); ok {
+		return ratio
+	}
+	return defaultCharsPerToken
+}
+
+// EstimateTokens approximates the number of tokens a model uses for text
+func EstimateTokens(model, text string) int {
+	return int(math.Ceil(float64(len(text)) / charsPerToken(model)))
+}
+
+// estimateMessageTokens approximates the prompt tokens of chat messages
+func estimateMessageTokens(model string, messages []Message) int {
+	tokens := 0
+	for _, m := range messages {
+		tokens += EstimateTokens(model, m.Content) + messageOverheadTokens
+	}
+	return tokens
+}
+
+// promptBudget returns the number of prompt tokens available to a request: the configured budget,
+// or the model's context window less the tokens reserved for the response
+func (s *LLMService) promptBudget(params ModelParams) (budget, window int) {
+	window = s.Settings.ContextWindow
+	if window <= 0 {
+		window = ContextWindow(params.Model)
+	}
+	if s.Settings.PromptBudget > 0 {
+		return s.Settings.PromptBudget, window
+	}
+
+	reserve := params.MaxTokens
+	if reserve <= 0 {
+		reserve = defaultOutputReserve
+	}
+	return window - reserve, window
+}
+
+// promptLimit is the room one model leaves for a prompt rendered around frame
+type promptLimit struct {
+	model      string
+	budget     int
+	window     int
+	dataBudget int
+}
+
+// servingModels returns every model a request may be served by: the requested model, the model a
+// used-up budget downgrades to and the fallback chain
+func (s *LLMService) servingModels(model string) []string {
+	models := []string{model}
+	if budget := s.Settings.Budget; budget.Action == BudgetActionDowngrade && budget.DowngradeModel != "" {
+		models = append(models, budget.DowngradeModel)
+	}
+	for _, target := range s.Settings.Fallbacks {
+		if target.Model != "" {
+			models = append(models, target.Model)
+		}
+	}
+	return models
+}
+
+// tightestPromptLimit returns the limit leaving the least room for data among the models a
+// request may be served by. Room is compared in characters, as models tokenize differently, so
+// data fitted to the tightest limit fits whichever model ends up serving the request.
+func (s *LLMService) tightestPromptLimit(params ModelParams, frame []Message) promptLimit {
+	var tightest promptLimit
+	tightestChars := 0.0
+	for i, model := range s.servingModels(params.Model) {
+		p := params
+		p.Model = model
+		budget, window := s.promptBudget(p)
+		limit := promptLimit{model: model, budget: budget, window: window,
+			dataBudget: budget - estimateMessageTokens(model, frame)}
+		if chars := float64(limit.dataBudget) * charsPerToken(model); i == 0 || chars < tightestChars {
+			tightest, tightestChars = limit, chars
+		}
+	}
+	return tightest
+}
+
+// ArraySummary replaces the elements of an expanded array beyond the first few
+type ArraySummary struct {
+	Elements int `json:"elements"`
+	Kept     int `json:"kept"`
+	// Fields holds min, max and avg of each numeric element field across all elements; the key
+	// is the field path within an element, or "value" for arrays of numbers
+	Fields map[string]map[string]float64 `json:"fields,omitempty"`
+}
+
+// PromptTruncation reports how processed data was reduced to fit the prompt budget
+type PromptTruncation struct {
+	OriginalTokens int      `json:"original_tokens"`
+	Tokens         int      `json:"tokens"`
+	BudgetTokens   int      `json:"budget_tokens"`
+	Strategies     []string `json:"strategies"`
+	// SummarizedArrays maps array key prefixes to the number of elements summarized
+	SummarizedArrays map[string]int `json:"summarized_arrays,omitempty"`
+	// DroppedKeys lists up to 100 dropped combined and derived metric keys; DroppedKeyCount is the total
+	DroppedKeys        []string `json:"dropped_keys,omitempty"`
+	DroppedKeyCount    int      `json:"dropped_key_count,omitempty"`
+	DroppedAnomalies   int      `json:"dropped_anomalies,omitempty"`
+	DroppedDiagnostics int      `json:"dropped_diagnostics,omitempty"`
+	TruncatedChars     int      `json:"truncated_chars,omitempty"`
+}
+
+func (t *PromptTruncation) applied(strategy string) {
+	if len(t.Strategies) == 0 || t.Strategies[len(t.Strategies)-1] != strategy {
+		t.Strategies = append(t.Strategies, strategy)
+	}
+}
+
+func (t *PromptTruncation) dropKey(key string) {
+	t.DroppedKeyCount++
+	if len(t.DroppedKeys) < maxReportedKeys {
+		t.DroppedKeys = append(t.DroppedKeys, key)
+	}
+}
+
+// promptOmissions is the compact account of a truncation included in the data sent to the model
+type promptOmissions struct {
+	Strategies         []string `json:"strategies"`
+	SummarizedArrays   int      `json:"summarized_arrays,omitempty"`
+	DroppedKeys        int      `json:"dropped_keys,omitempty"`
+	DroppedAnomalies   int      `json:"dropped_anomalies,omitempty"`
+	DroppedDiagnostics int      `json:"dropped_diagnostics,omitempty"`
+}
+
+// promptPayload is the processed data as sent to the model once reduced; Omitted tells the model
+// what is missing
+type promptPayload struct {
+	ProcessedResult
+	ArraySummaries map[string]ArraySummary `json:"array_summaries,omitempty"`
+	Omitted        *promptOmissions        `json:"omitted,omitempty"`
+}
+
+// fitPromptData returns the processed data content reduced to fit within budget tokens, and a
+// report of what was omitted when it had to be reduced
+func fitPromptData(content, model string, budget int, lowPriority []string) (string, *PromptTruncation) {
+	original := EstimateTokens(model, content)
+	if original <= budget {
+		return content, nil
+	}
+
+	report := &PromptTruncation{OriginalTokens: original, BudgetTokens: budget}
+	var result ProcessedResult
+	if err := json.Unmarshal([]byte(content), &result); err != nil || result.CombinedMetrics == nil {
+		return truncateText(content, model, budget, report), report
+	}
+
+	reducer := &promptReducer{
+		payload:     promptPayload{ProcessedResult: result},
+		model:       model,
+		budget:      budget,
+		lowPriority: lowPriority,
+		report:      report,
+	}
+	data, fits := reducer.reduce()
+	if !fits {
+		data = truncateText(data, model, budget, report)
+	}
+	report.Tokens = EstimateTokens(model, data)
+	return data, report
+}
+
+// truncateText cuts text to the budget as a last resort
+func truncateText(text, model string, budget int, report *PromptTruncation) string {
+	report.applied(TruncationTruncateText)
+	limit := len(text)
+	for limit > 0 && EstimateTokens(model, text[:limit]) > budget {
+		limit = limit * 9 / 10
+	}
+	report.TruncatedChars = len(text) - limit
+	report.Tokens = EstimateTokens(model, text[:limit])
+	return text[:limit]
+}
+
+// promptReducer removes content from a processed result in priority order, keeping anomalies and
+// derived metrics longest
+type promptReducer struct {
+	payload     promptPayload
+	model       string
+	budget      int
+	lowPriority []string
+	report      *PromptTruncation
+}
+
+func (r *promptReducer) encode() string {
+	r.payload.Omitted = &promptOmissions{
+		Strategies:         r.report.Strategies,
+		SummarizedArrays:   len(r.report.SummarizedArrays),
+		DroppedKeys:        r.report.DroppedKeyCount,
+		DroppedAnomalies:   r.report.DroppedAnomalies,
+		DroppedDiagnostics: r.report.DroppedDiagnostics,
+	}
+	encoded, err := json.Marshal(r.payload)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+func (r *promptReducer) fits() (string, bool) {
+	data := r.encode()
+	return data, EstimateTokens(r.model, data) <= r.budget
+}
+
+func (r *promptReducer) reduce() (string, bool) {
+	steps := []func() bool{
+		r.dropLowPriority,
+		r.summarizeArrays,
+		r.dropMetrics,
+		r.dropDerived,
+		r.dropAnomalyMetrics,
+		r.dropAnomalies,
+	}
+	for _, step := range steps {
+		if done := step(); done {
+			return r.fits()
+		}
+	}
+	return r.fits()
+}
+
+// dropLowPriority removes diagnostics and the combined metrics matching the low-priority globs
+func (r *promptReducer) dropLowPriority() bool {
+	changed := false
+	if n := len(r.payload.Diagnostics); n > 0 {
+		r.report.DroppedDiagnostics = n
+		r.payload.Diagnostics = nil
+		changed = true
+	}
+	for _, key := range sortedKeys(r.payload.CombinedMetrics) {
+		if matchAnyGlob(r.lowPriority, key) {
+			r.dropCombined(key)
+			changed = true
+		}
+	}
+	if changed {
+		r.report.applied(TruncationDropLowPriority)
+	}
+	_, ok := r.fits()
+	return ok
+}
+
+// summarizeArrays keeps the first elements of every array expanded by flattening and replaces
+// the rest with per-field statistics
+func (r *promptReducer) summarizeArrays() bool {
+	type element struct {
+		key   string
+		index int
+		field string
+	}
+	arrays := map[string][]element{}
+	for key := range r.payload.CombinedMetrics {
+		prefix, index, field, ok := splitArrayKey(key, r.payload.CombinedMetrics)
+		if ok {
+			arrays[prefix] = append(arrays[prefix], element{key, index, field})
+		}
+	}
+
+	for _, prefix := range sortedMapKeys(arrays) {
+		elements := arrays[prefix]
+		count := 0
+		fields := map[string][]float64{}
+		for _, e := range elements {
+			if e.index+1 > count {
+				count = e.index + 1
+			}
+			if f, ok := toFloat(r.payload.CombinedMetrics[e.key]); ok {
+				fields[e.field] = append(fields[e.field], f)
+			}
+		}
+		if count <= arraySummaryKeep {
+			continue
+		}
+
+		summary := ArraySummary{Elements: count, Kept: arraySummaryKeep, Fields: map[string]map[string]float64{}}
+		for field, values := range fields {
+			name := field
+			if name == "" {
+				name = "value"
+			}
+			summary.Fields[name] = map[string]float64{
+				"min": aggregateValues(values, AggregationMin),
+				"max": aggregateValues(values, AggregationMax),
+				"avg": aggregateValues(values, AggregationAvg),
+			}
+		}
+		for _, e := range elements {
+			if e.index >= arraySummaryKeep {
+				delete(r.payload.CombinedMetrics, e.key)
+				delete(r.payload.Units, e.key)
+			}
+		}
+
+		if r.payload.ArraySummaries == nil {
+			r.payload.ArraySummaries = map[string]ArraySummary{}
+		}
+		r.payload.ArraySummaries[prefix] = summary
+		if r.report.SummarizedArrays == nil {
+			r.report.SummarizedArrays = map[string]int{}
+		}
+		r.report.SummarizedArrays[prefix] = count - arraySummaryKeep
+		r.report.applied(TruncationSummarizeArrays)
+	}
+	_, ok := r.fits()
+	return ok
+}
+
+// splitArrayKey splits a flattened key such as "data_items_3_price" into its array prefix, element
+// index and field. The separator is the run of punctuation before the index, so keys flattened
+// with any configured separator are recognized, e.g. "WeatherAPI.forecast.days.3.temp_c". Only
+// prefixes with a "<prefix><separator>count" metric, as stored by flattening, count as arrays.
+func splitArrayKey(key string, metrics map[string]interface{}) (string, int, string, bool) {
+	isDigit := func(i int) bool { return key[i] >= '0' && key[i] <= '9' }
+	isSeparator := func(i int) bool { return !isDigit(i) && !unicode.IsLetter(rune(key[i])) && key[i] < utf8.RuneSelf }
+
+	for start := 1; start < len(key); start++ {
+		if !isDigit(start) || !isSeparator(start-1) {
+			continue
+		}
+		end := start
+		for end < len(key) && isDigit(end) {
+			end++
+		}
+		sepStart := start - 1
+		for sepStart > 0 && isSeparator(sepStart-1) {
+			sepStart--
+		}
+		prefix, sep, rest := key[:sepStart], key[sepStart:start], key[end:]
+		if prefix == "" || rest != "" && !strings.HasPrefix(rest, sep) {
+			continue
+		}
+		if _, ok := metrics[prefix+sep+"count"]; !ok {
+			continue
+		}
+		index, err := strconv.Atoi(key[start:end])
+		if err != nil {
+			continue
+		}
+		return prefix, index, strings.TrimPrefix(rest, sep), true
+	}
+	return "", 0, "", false
+}
+
+// dropMetrics removes combined metrics that no anomaly refers to, largest first
+func (r *promptReducer) dropMetrics() bool {
+	anomalous := r.anomalyMetrics()
+	return r.dropLargest(r.payload.CombinedMetrics, func(key string) bool { return !anomalous[key] },
+		TruncationDropMetrics, r.dropCombined)
+}
+
+// dropDerived removes derived metrics, largest first
+func (r *promptReducer) dropDerived() bool {
+	derived := make(map[string]interface{}, len(r.payload.DerivedMetrics))
+	for key, value := range r.payload.DerivedMetrics {
+		derived[key] = value
+	}
+	return r.dropLargest(derived, func(string) bool { return true }, TruncationDropDerived, func(key string) {
+		delete(r.payload.DerivedMetrics, key)
+		r.report.dropKey(key)
+	})
+}
+
+// dropAnomalyMetrics removes the remaining combined metrics; anomalies still carry their values
+func (r *promptReducer) dropAnomalyMetrics() bool {
+	return r.dropLargest(r.payload.CombinedMetrics, func(string) bool { return true },
+		TruncationDropAnomalyInput, r.dropCombined)
+}
+
+// dropAnomalies removes anomalies, lowest severity and score first
+func (r *promptReducer) dropAnomalies() bool {
+	rank := map[string]int{SeverityLow: 0, SeverityMedium: 1, SeverityHigh: 2}
+	anomalies := r.payload.Anomalies
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		if rank[anomalies[i].Severity] != rank[anomalies[j].Severity] {
+			return rank[anomalies[i].Severity] > rank[anomalies[j].Severity]
+		}
+		return math.Abs(anomalies[i].Score) > math.Abs(anomalies[j].Score)
+	})
+
+	for len(r.payload.Anomalies) > 0 {
+		if _, ok := r.fits(); ok {
+			return true
+		}
+		r.payload.Anomalies = r.payload.Anomalies[:len(r.payload.Anomalies)-1]
+		r.report.DroppedAnomalies++
+		r.report.applied(TruncationDropAnomalies)
+	}
+	_, ok := r.fits()
+	return ok
+}
+
+// dropLargest drops the eligible entries of metrics, largest encoded size first, until the payload
+// fits. Sizes are tracked incrementally and re-checked against the encoded payload.
+func (r *promptReducer) dropLargest(metrics map[string]interface{}, eligible func(string) bool, strategy string, drop func(string)) bool {
+	type entry struct {
+		key  string
+		size int
+	}
+	var entries []entry
+	for key, value := range metrics {
+		if !eligible(key) {
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		entries = append(entries, entry{key, len(key) + len(encoded) + 4})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].size != entries[j].size {
+			return entries[i].size > entries[j].size
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	data, ok := r.fits()
+	excess := len(data) - r.budgetChars()
+	for _, e := range entries {
+		if ok {
+			return true
+		}
+		drop(e.key)
+		r.report.applied(strategy)
+		excess -= e.size
+		if excess <= 0 {
+			_, ok = r.fits()
+			excess = 1
+		}
+	}
+	_, ok = r.fits()
+	return ok
+}
+
+// budgetChars converts the token budget to an approximate character count
+func (r *promptReducer) budgetChars() int {
+	ratio, ok := longestPrefixMatch(modelCharsPerToken, strings.ToLower(r.model))
+	if !ok {
+		ratio = defaultCharsPerToken
+	}
+	return int(float64(r.budget) * ratio)
+}
+
+func (r *promptReducer) dropCombined(key string) {
+	delete(r.payload.CombinedMetrics, key)
+	delete(r.payload.Units, key)
+	r.report.dropKey(key)
+}
+
+func (r *promptReducer) anomalyMetrics() map[string]bool {
+	metrics := make(map[string]bool, len(r.payload.Anomalies))
+	for _, a := range r.payload.Anomalies {
+		metrics[a.Metric] = true
+	}
+	return metrics
+}
+
+// sortedMapKeys returns the keys of a map in sorted order
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AnalysisMetadata records how an analysis prompt was built
+type AnalysisMetadata struct {
+	PromptTokens  int               `json:"prompt_tokens_estimate"`
+	PromptBudget  int               `json:"prompt_budget"`
+	ContextWindow int               `json:"context_window"`
+	Truncation    *PromptTruncation `json:"truncation,omitempty"`
+	// BudgetModel is the downgrade or fallback model the prompt was fitted to when its context
+	// window is tighter than the requested model's
+	BudgetModel string `json:"budget_model,omitempty"`
+	// Attempts and ValidationErrors record the retries of a structured analysis
+	Attempts         int      `json:"attempts,omitempty"`
+	ValidationErrors []string `json:"validation_errors,omitempty"`
+	// DowngradedFrom is the requested model when a used-up budget switched the request to a
+	// cheaper one
+	DowngradedFrom string `json:"downgraded_from,omitempty"`
+	// FailedCalls are the provider calls that failed before one succeeded
+	FailedCalls []string `json:"failed_calls,omitempty"`
+}
+
+// budgetModel returns the model a prompt was fitted to when it is not the requested model
+func budgetModel(fitted, requested string) string {
+	if fitted == requested {
+		return ""
+	}
+	return fitted
+}
+
+func (m AnalysisMetadata) encode() string {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf(`{"error": %q}`, err.Error())
+	}
+	return string(encoded)
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestContextWindowAndEstimate(t *testing.T) {
+	tests := []struct {
+		model  string
+		window int
+		ratio  float64
+	}{
+		{"gpt-4o-mini", 128000, 3.6},
+		{"gpt-4", 8192, defaultCharsPerToken},
+		{"gpt-4-32k-0613", 32768, defaultCharsPerToken},
+		{"llama3.1:8b", 131072, 3.4},
+		{"Claude-3-5-Sonnet-Latest", 200000, 3.2},
+		{"unknown-model", defaultContextWindow, defaultCharsPerToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := ContextWindow(tt.model); got != tt.window {
+				t.Errorf("ContextWindow = %d, want %d", got, tt.window)
+			}
+			if got := charsPerToken(tt.model); got != tt.ratio {
+				t.Errorf("charsPerToken = %g, want %g", got, tt.ratio)
+			}
+		})
+	}
+
+	if got := EstimateTokens("claude-3-5-haiku", strings.Repeat("x", 33)); got != 11 {
+		t.Errorf("EstimateTokens rounds %d, want 11", got)
+	}
+}
+
+func TestSplitArrayKey(t *testing.T) {
+	metrics := map[string]interface{}{
+		"data_items_count":                  5.0,
+		"WeatherAPI.forecast.days.count":    3.0,
+		"Source::values::count":             2.0,
+		"CryptoAPI_data_rank":               1.0,
+		"WeatherAPI_current_temp_c":         1.0,
+		"WeatherAPI.forecast.days.2.temp_c": 1.0,
+	}
+
+	tests := []struct {
+		key    string
+		prefix string
+		index  int
+		field  string
+		ok     bool
+	}{
+		{"data_items_3_price", "data_items", 3, "price", true},
+		{"data_items_12", "data_items", 12, "", true},
+		{"WeatherAPI.forecast.days.2.temp_c", "WeatherAPI.forecast.days", 2, "temp_c", true},
+		{"Source::values::1", "Source::values", 1, "", true},
+		{"Source::values::1::x", "Source::values", 1, "x", true},
+		// No count metric, so not an array
+		{"CryptoAPI_data_rank_1", "", 0, "", false},
+		{"WeatherAPI_current_temp_c", "", 0, "", false},
+		// The separator after the index must match the one before it
+		{"data_items_3.price", "", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			prefix, index, field, ok := splitArrayKey(tt.key, metrics)
+			if ok != tt.ok || prefix != tt.prefix || index != tt.index || field != tt.field {
+				t.Errorf("splitArrayKey = %q, %d, %q, %v; want %q, %d, %q, %v",
+					prefix, index, field, ok, tt.prefix, tt.index, tt.field, tt.ok)
+			}
+		})
+	}
+}
+
+// promptContent encodes a processed result with an array of items, an anomaly and diagnostics
+func promptContent(t *testing.T, items int) string {
+	t.Helper()
+	result := ProcessedResult{
+		CombinedMetrics: map[string]interface{}{
+			"CryptoAPI_data_priceUsd":    67000.5,
+			"CryptoAPI_data_symbol":      "BTC",
+			"WeatherAPI_current_temp_c":  21.5,
+			"CryptoAPI_data_items_count": float64(items),
+		},
+		DerivedMetrics: map[string]float64{"data_sources_count": 2},
+		Units:          map[string]string{},
+		DataSources:    []string{"CryptoAPI", "WeatherAPI"},
+		Anomalies: []Anomaly{
+			{Metric: "CryptoAPI_data_priceUsd", Method: AnomalyMethodZScore, Value: 67000.5, Score: 4, Severity: SeverityHigh},
+		},
+		Diagnostics: []Diagnostic{{Transformer: "scale", Level: "warning", Message: strings.Repeat("slow source response ", 20)}},
+	}
+	for i := 0; i < items; i++ {
+		result.CombinedMetrics[fmt.Sprintf("CryptoAPI_data_items_%d_price", i)] = float64(100 + i)
+		result.CombinedMetrics[fmt.Sprintf("CryptoAPI_data_items_%d_name", i)] = fmt.Sprintf("item with a long descriptive name %d", i)
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("failed to encode result: %v", err)
+	}
+	return string(encoded)
+}
+
+func TestFitPromptData(t *testing.T) {
+	const model = "gpt-4o"
+	content := promptContent(t, 40)
+	original := EstimateTokens(model, content)
+
+	tests := []struct {
+		name           string
+		budget         int
+		lowPriority    []string
+		wantStrategies []string
+		wantKept       []string
+		wantDropped    []string
+	}{
+		{"fits unchanged", original, nil, nil, nil, nil},
+		{"low-priority metrics and diagnostics go first", original - 60, []string{"WeatherAPI_*"},
+			[]string{TruncationDropLowPriority}, []string{"CryptoAPI_data_items_39_name"}, []string{"WeatherAPI_current_temp_c"}},
+		{"arrays are summarized", original / 3, nil,
+			[]string{TruncationDropLowPriority, TruncationSummarizeArrays},
+			[]string{"CryptoAPI_data_items_2_price", `"array_summaries"`, "data_sources_count"}, []string{"CryptoAPI_data_items_3_price"}},
+		{"anomalous metrics outlive the rest", 220, nil,
+			[]string{TruncationDropLowPriority, TruncationSummarizeArrays, TruncationDropMetrics},
+			[]string{`"CryptoAPI_data_priceUsd":67000.5`, `"anomalies":[{`}, []string{"CryptoAPI_data_items_0_name", "CryptoAPI_data_items_0_price"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, report := fitPromptData(content, model, tt.budget, tt.lowPriority)
+			if tt.budget >= original {
+				if data != content || report != nil {
+					t.Fatalf("content within budget was changed (report %+v)", report)
+				}
+				return
+			}
+
+			if report == nil {
+				t.Fatal("reduced content has no truncation report")
+			}
+			if got := EstimateTokens(model, data); got > tt.budget || report.Tokens != got {
+				t.Errorf("reduced to %d tokens (reported %d), budget %d", got, report.Tokens, tt.budget)
+			}
+			if report.OriginalTokens != original || report.BudgetTokens != tt.budget {
+				t.Errorf("report = %+v, want original %d and budget %d", report, original, tt.budget)
+			}
+			if tt.wantStrategies != nil && strings.Join(report.Strategies, ",") != strings.Join(tt.wantStrategies, ",") {
+				t.Errorf("strategies = %v, want %v", report.Strategies, tt.wantStrategies)
+			}
+			for _, want := range tt.wantKept {
+				if !strings.Contains(data, want) {
+					t.Errorf("reduced data lost %s", want)
+				}
+			}
+			for _, key := range tt.wantDropped {
+				if strings.Contains(data, `"`+key+`"`) {
+					t.Errorf("reduced data still contains %s", key)
+				}
+			}
+			if !json.Valid([]byte(data)) {
+				t.Errorf("reduced data is not valid JSON: %s", data)
+			}
+		})
+	}
+}
+
+func TestFitPromptDataTruncatesText(t *testing.T) {
+	content := strings.Repeat("not a processed result ", 100)
+	data, report := fitPromptData(content, "gpt-4o", 50, nil)
+	if report == nil || strings.Join(report.Strategies, ",") != TruncationTruncateText {
+		t.Fatalf("report = %+v, want text truncation", report)
+	}
+	if EstimateTokens("gpt-4o", data) > 50 || report.TruncatedChars != len(content)-len(data) {
+		t.Errorf("truncated to %d chars, reported %d dropped of %d", len(data), report.TruncatedChars, len(content))
+	}
+}
+
+func TestTightestPromptLimit(t *testing.T) {
+	s := newStubLLMService(&stubProvider{name: ProviderOpenAI}, LLMSettings{
+		Fallbacks: []FallbackTarget{{Provider: &stubProvider{name: ProviderOllama}, Model: "llama3"}},
+	})
+
+	limit := s.tightestPromptLimit(ModelParams{Model: "gpt-4o", MaxTokens: 500}, nil)
+	if limit.model != "llama3" || limit.window != 8192 || limit.budget != 8192-500 {
+		t.Errorf("limit = %+v, want the llama3 window less the output reserve", limit)
+	}
+
+	s.Settings.Fallbacks = nil
+	limit = s.tightestPromptLimit(ModelParams{Model: "gpt-4o"}, []Message{{Role: "system", Content: strings.Repeat("x", 360)}})
+	if limit.model != "gpt-4o" || limit.dataBudget != 128000-defaultOutputReserve-100-messageOverheadTokens {
+		t.Errorf("limit = %+v, want the gpt-4o budget less the frame", limit)
+	}
+}
@@ -0,0 +1,477 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Analysis types; each has a default prompt template
+const (
+	// AnalysisTypeInsights is the plain analysis generated after every pipeline run
+	AnalysisTypeInsights = "insights"
+	// AnalysisTypeReport is the Markdown report streamed to clients
+	AnalysisTypeReport = "report"
+	// AnalysisTypeStructured is the schema-validated JSON analysis
+	AnalysisTypeStructured = "structured"
+)
+
+// AnalysisTypes lists the supported analysis types
+var AnalysisTypes = []string{AnalysisTypeInsights, AnalysisTypeReport, AnalysisTypeStructured}
+
+// ErrPromptTemplateNotFound is returned when a requested prompt template or version does not exist
+var ErrPromptTemplateNotFound = errors.New("prompt template not found")
+
+// ErrInvalidPromptTemplate is returned when a prompt template fails validation
+var ErrInvalidPromptTemplate = errors.New("invalid prompt template")
+
+// promptSchemaNotes describes the processed data layout to the model
+const promptSchemaNotes = `The data structure includes:
+- timestamp: When the data was processed
+- combined_metrics: All metrics from different data sources with source name as prefix
+- derived_metrics: Calculated metrics based on combined data
+- data_sources: List of data sources
+- anomalies: Metrics flagged as unusual compared to their history, with method, score and severity`
+
+// builtinPromptTemplates are seeded as version 1 of the default template of each analysis type
+var builtinPromptTemplates = []models.PromptTemplate{
+	{
+		Name:         "default-insights",
+		AnalysisType: AnalysisTypeInsights,
+		Description:  "Numbered summary, trends and recommendations",
+		System:       "You are a data analyst that provides insightful analysis of metrics and trends.",
+		User: `Analyze the following JSON data and provide insights:
+
+{{.Data}}
+
+{{.SchemaNotes}}
+
+Please provide:
+1. A summary of the key metrics from each data source
+2. Notable trends or patterns if any are apparent, calling out any flagged anomalies
+3. Potential actions or recommendations based on the data
+{{.Correlations}}{{.Forecasts}}`,
+	},
+	{
+		Name:         "default-report",
+		AnalysisType: AnalysisTypeReport,
+		Description:  "Markdown report with summary, trends and recommendations sections",
+		System:       "You are a data analyst that provides insightful analysis of metrics and trends.",
+		User: `Analyze the following JSON data and provide insights:
+
+{{.Data}}
+
+{{.SchemaNotes}}
+
+Please provide a detailed analysis with the following sections, using Markdown formatting:
+
+## Summary of Key Metrics
+Summarize the key metrics from each data source with bullet points or paragraphs.
+
+## Trends and Patterns
+Analyze any notable trends or patterns in the data, and explain any flagged anomalies.
+
+## Recommendations
+Provide actionable recommendations based on the data analysis.
+
+IMPORTANT: Format your response using Markdown with proper headings, lists, and emphasis to highlight important points. Use tables if appropriate for data comparison.
+{{.Correlations}}{{.Forecasts}}`,
+	},
+	{
+		Name:         "default-structured",
+		AnalysisType: AnalysisTypeStructured,
+		Description:  "JSON summary, per-source findings, trends, anomalies and prioritized recommendations",
+		System:       "You are a data analyst that provides insightful analysis of metrics and trends. You respond only with a single JSON object and no other text.",
+		User: `Analyze the following JSON data:
+
+{{.Data}}
+
+{{.SchemaNotes}}
+{{.Correlations}}{{.Forecasts}}
+Respond with a JSON object matching this JSON schema:
+
+{{.OutputSchema}}
+
+- summary: two or three sentences on the overall state of the data
+- sources: the key findings for each data source
+- trends: notable trends, with the metric key, a direction of up, down, flat or volatile, and a description
+- anomalies: an explanation of each flagged anomaly, with the metric key and a severity of low, medium or high
+- recommendations: actionable recommendations, each with a rationale, a priority of low, medium or high, and a confidence between 0 and 1
+Use empty arrays where there is nothing to report.`,
+	},
+}
+
+// PromptRunContext describes the processed data being analyzed
+type PromptRunContext struct {
+	ProcessedDataID  uint
+	ProcessedAt      time.Time
+	QualityStatus    string
+	ProcessorVersion string
+	ConfigHash       string
+	SourceRunID      string
+	AnalysisType     string
+}
+
+// PromptData holds the variables available to prompt templates
+type PromptData struct {
+	// Data is the processed data JSON
+	Data string
+	// SchemaNotes describes the layout of Data
+	SchemaNotes string
+	// Run identifies the processed data and analysis
+	Run PromptRunContext
+	// Correlations and Forecasts are the fact blocks for strong correlations and forecasts marked
+	// for the prompt; each is empty or starts with a newline
+	Correlations string
+	Forecasts    string
+	// OutputSchema is the JSON schema structured analyses must match
+	OutputSchema string
+}
+
+// PromptRef selects a prompt template by name and optionally version; an empty name selects the
+// default of the analysis type and version 0 selects the latest version
+type PromptRef struct {
+	Name    string
+	Version int
+}
+
+// PromptService stores and renders versioned prompt templates
+type PromptService struct {
+	DB     *gorm.DB
+	Logger *zap.SugaredLogger
+}
+
+// NewPromptService creates a new PromptService instance
+func NewPromptService(db *gorm.DB, logger *zap.SugaredLogger) *PromptService {
+	return &PromptService{
+		DB:     db,
+		Logger: logger,
+	}
+}
+
+// SeedDefaults stores the built-in templates that do not exist yet and makes each the default of
+// its analysis type when the type has no default
+func (s *PromptService) SeedDefaults() error {
+	for _, builtin := range builtinPromptTemplates {
+		var count int64
+		// A built-in template that was deleted stays deleted
+		if err := s.DB.Unscoped().Model(&models.PromptTemplate{}).Where("name = ?", builtin.Name).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to check prompt template %s: %w", builtin.Name, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		var defaults int64
+		if err := s.DB.Model(&models.PromptTemplate{}).
+			Where("analysis_type = ? AND is_default = ?", builtin.AnalysisType, true).
+			Count(&defaults).Error; err != nil {
+			return fmt.Errorf("failed to check default prompt template for %s: %w", builtin.AnalysisType, err)
+		}
+
+		tmpl := builtin
+		tmpl.Version = 1
+		tmpl.IsDefault = defaults == 0
+		if err := s.DB.Create(&tmpl).Error; err != nil {
+			return fmt.Errorf("failed to seed prompt template %s: %w", builtin.Name, err)
+		}
+		s.Logger.Infow("Seeded prompt template", "name", tmpl.Name, "analysis_type", tmpl.AnalysisType, "default", tmpl.IsDefault)
+	}
+	return nil
+}
+
+// List returns the latest version of every template, or every version when all is set
+func (s *PromptService) List(all bool) ([]models.PromptTemplate, error) {
+	query := s.DB.Order("name asc, version desc")
+	if !all {
+		query = query.Where("version = (SELECT MAX(p.version) FROM prompt_templates p WHERE p.name = prompt_templates.name AND p.deleted_at IS NULL)")
+	}
+
+	var templates []models.PromptTemplate
+	if err := query.Find(&templates).Error; err != nil {
+		return nil, fmt.Errorf("failed to list prompt templates: %w", err)
+	}
+	return templates, nil
+}
+
+// Versions returns every version of a template, newest first
+func (s *PromptService) Versions(name string) ([]models.PromptTemplate, error) {
+	var templates []models.PromptTemplate
+	if err := s.DB.Where("name = ?", name).Order("version desc").Find(&templates).Error; err != nil {
+		return nil, fmt.Errorf("failed to load prompt template %s: %w", name, err)
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPromptTemplateNotFound, name)
+	}
+	return templates, nil
+}
+
+// Get returns a template version, or the latest version when version is 0
+func (s *PromptService) Get(name string, version int) (*models.PromptTemplate, error) {
+	query := s.DB.Where("name = ?", name)
+	if version > 0 {
+		query = query.Where("version = ?", version)
+	}
+
+	var tmpl models.PromptTemplate
+	if err := query.Order("version desc").Limit(1).Find(&tmpl).Error; err != nil {
+		return nil, fmt.Errorf("failed to load prompt template %s: %w", name, err)
+	}
+	if tmpl.ID == 0 {
+		if version > 0 {
+			return nil, fmt.Errorf("%w: %s version %d", ErrPromptTemplateNotFound, name, version)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrPromptTemplateNotFound, name)
+	}
+	return &tmpl, nil
+}
+
+// Create stores the first version of a new template. A name whose versions were all deleted
+// continues from the highest deleted version.
+func (s *PromptService) Create(tmpl models.PromptTemplate) (*models.PromptTemplate, error) {
+	if err := validatePromptTemplate(&tmpl); err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := s.DB.Model(&models.PromptTemplate{}).Where("name = ?", tmpl.Name).Count(&count).Error; err != nil {
+		return nil, fmt.Errorf("failed to check prompt template %s: %w", tmpl.Name, err)
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s already exists", ErrInvalidPromptTemplate, tmpl.Name)
+	}
+
+	tmpl.ID = 0
+	tmpl.Version = 1
+	if deleted, err := s.latestIncludingDeleted(tmpl.Name); err == nil {
+		tmpl.Version = deleted.Version + 1
+	}
+	return s.store(tmpl)
+}
+
+// Update stores a new version of an existing template. Fields left empty are copied from the
+// latest version; the analysis type cannot change.
+func (s *PromptService) Update(name string, tmpl models.PromptTemplate) (*models.PromptTemplate, error) {
+	latest, err := s.Get(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	highest, err := s.latestIncludingDeleted(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl.AnalysisType != "" && tmpl.AnalysisType != latest.AnalysisType {
+		return nil, fmt.Errorf("%w: analysis type of %s cannot change from %s", ErrInvalidPromptTemplate, name, latest.AnalysisType)
+	}
+	tmpl.Name = name
+	tmpl.AnalysisType = latest.AnalysisType
+	if tmpl.System == "" {
+		tmpl.System = latest.System
+	}
+	if tmpl.User == "" {
+		tmpl.User = latest.User
+	}
+	if tmpl.Description == "" {
+		tmpl.Description = latest.Description
+	}
+	if err := validatePromptTemplate(&tmpl); err != nil {
+		return nil, err
+	}
+
+	tmpl.ID = 0
+	tmpl.Version = highest.Version + 1
+	return s.store(tmpl)
+}
+
+// latestIncludingDeleted returns the highest version of a template, so versions stay unique
+// after a version is deleted
+func (s *PromptService) latestIncludingDeleted(name string) (*models.PromptTemplate, error) {
+	var latest models.PromptTemplate
+	if err := s.DB.Unscoped().Where("name = ?", name).Order("version desc").Limit(1).Find(&latest).Error; err != nil {
+		return nil, fmt.Errorf("failed to load prompt template %s: %w", name, err)
+	}
+	if latest.ID == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPromptTemplateNotFound, name)
+	}
+	return &latest, nil
+}
+
+// store creates a template version and, if it is marked default, clears the previous default of
+// its analysis type
+func (s *PromptService) store(tmpl models.PromptTemplate) (*models.PromptTemplate, error) {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if tmpl.IsDefault {
+			if err := clearDefaultPrompt(tx, tmpl.AnalysisType); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&tmpl).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store prompt template %s: %w", tmpl.Name, err)
+	}
+	return &tmpl, nil
+}
+
+// SetDefault makes a template version the default of its analysis type
+func (s *PromptService) SetDefault(name string, version int) (*models.PromptTemplate, error) {
+	tmpl, err := s.Get(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := clearDefaultPrompt(tx, tmpl.AnalysisType); err != nil {
+			return err
+		}
+		return tx.Model(tmpl).Update("is_default", true).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set default prompt template: %w", err)
+	}
+	return tmpl, nil
+}
+
+func clearDefaultPrompt(tx *gorm.DB, analysisType string) error {
+	return tx.Model(&models.PromptTemplate{}).
+		Where("analysis_type = ? AND is_default = ?", analysisType, true).
+		Update("is_default", false).Error
+}
+
+// Delete removes a template version, or every version when version is 0. Default templates
+// cannot be deleted until another default is chosen.
+func (s *PromptService) Delete(name string, version int) (int64, error) {
+	query := s.DB.Where("name = ?", name)
+	if version > 0 {
+		query = query.Where("version = ?", version)
+	}
+
+	var templates []models.PromptTemplate
+	if err := query.Find(&templates).Error; err != nil {
+		return 0, fmt.Errorf("failed to load prompt template %s: %w", name, err)
+	}
+	if len(templates) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrPromptTemplateNotFound, name)
+	}
+	for _, tmpl := range templates {
+		if tmpl.IsDefault {
+			return 0, fmt.Errorf("%w: %s version %d is the default for %s", ErrInvalidPromptTemplate, name, tmpl.Version, tmpl.AnalysisType)
+		}
+	}
+
+	result := s.DB.Delete(&templates)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to delete prompt template %s: %w", name, result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// Resolve returns the template selected by ref for an analysis type, falling back to the type's
+// default and then to the built-in template
+func (s *PromptService) Resolve(analysisType string, ref PromptRef) (*models.PromptTemplate, error) {
+	if ref.Name != "" {
+		tmpl, err := s.Get(ref.Name, ref.Version)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl.AnalysisType != analysisType {
+			return nil, fmt.Errorf("%w: %s is a %s template, not %s", ErrInvalidPromptTemplate, tmpl.Name, tmpl.AnalysisType, analysisType)
+		}
+		return tmpl, nil
+	}
+
+	var tmpl models.PromptTemplate
+	err := s.DB.Where("analysis_type = ? AND is_default = ?", analysisType, true).Limit(1).Find(&tmpl).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default prompt template for %s: %w", analysisType, err)
+	}
+	if tmpl.ID != 0 {
+		return &tmpl, nil
+	}
+
+	s.Logger.Warnw("No default prompt template stored, using built-in", "analysis_type", analysisType)
+	for _, builtin := range builtinPromptTemplates {
+		if builtin.AnalysisType == analysisType {
+			tmpl = builtin
+			tmpl.Version = 1
+			return &tmpl, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no template for analysis type %s", ErrPromptTemplateNotFound, analysisType)
+}
+
+// Render executes a template's system and user parts into chat messages
+func (s *PromptService) Render(tmpl *models.PromptTemplate, data PromptData) ([]Message, error) {
+	if data.SchemaNotes == "" {
+		data.SchemaNotes = promptSchemaNotes
+	}
+
+	var messages []Message
+	for _, part := range []struct{ role, text string }{{"system", tmpl.System}, {"user", tmpl.User}} {
+		if strings.TrimSpace(part.text) == "" {
+			continue
+		}
+		content, err := renderPromptPart(tmpl.Name+"."+part.role, part.text, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render prompt template %s version %d: %w", tmpl.Name, tmpl.Version, err)
+		}
+		messages = append(messages, Message{Role: part.role, Content: content})
+	}
+	return messages, nil
+}
+
+func renderPromptPart(name, text string, data PromptData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// validatePromptTemplate checks required fields and that both parts parse and render against
+// sample data
+func validatePromptTemplate(tmpl *models.PromptTemplate) error {
+	tmpl.Name = strings.TrimSpace(tmpl.Name)
+	if tmpl.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidPromptTemplate)
+	}
+	if !isAnalysisType(tmpl.AnalysisType) {
+		return fmt.Errorf("%w: analysis_type must be one of %s", ErrInvalidPromptTemplate, strings.Join(AnalysisTypes, ", "))
+	}
+	if strings.TrimSpace(tmpl.User) == "" {
+		return fmt.Errorf("%w: user template is required", ErrInvalidPromptTemplate)
+	}
+
+	sample := PromptData{
+		Data:        "{}",
+		SchemaNotes: promptSchemaNotes,
+		Run:         PromptRunContext{ProcessedDataID: 1, ProcessedAt: time.Now(), AnalysisType: tmpl.AnalysisType},
+	}
+	for _, part := range []struct{ role, text string }{{"system", tmpl.System}, {"user", tmpl.User}} {
+		if _, err := renderPromptPart(part.role, part.text, sample); err != nil {
+			return fmt.Errorf("%w: %s template: %v", ErrInvalidPromptTemplate, part.role, err)
+		}
+	}
+	return nil
+}
+
+func isAnalysisType(analysisType string) bool {
+	for _, t := range AnalysisTypes {
+		if t == analysisType {
+			return true
+		}
+	}
+	return false
+}
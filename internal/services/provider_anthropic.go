@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// anthropicVersion is the Messages API version sent with every request
+const anthropicVersion = "2023-06-01"
+
+// anthropicJSONPrefill starts the assistant turn of JSON requests, as the Messages API has no JSON
+// mode; the schema itself is described in the prompt
+const anthropicJSONPrefill = "{"
+
+// anthropicDefaultMaxTokens is sent when a request does not limit its output, as the Messages API
+// requires a limit
+const anthropicDefaultMaxTokens = 4096
+
+// anthropicRequest is an Anthropic Messages API request; the system prompt is a separate field
+type anthropicRequest struct {
+	Model         string    `json:"model"`
+	System        string    `json:"system,omitempty"`
+	Messages      []Message `json:"messages"`
+	MaxTokens     int       `json:"max_tokens"`
+	Stream        bool      `json:"stream,omitempty"`
+	Temperature   *float64  `json:"temperature,omitempty"`
+	TopP          *float64  `json:"top_p,omitempty"`
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+}
+
+// anthropicUsage is the token usage of a Messages API response
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicResponse is an Anthropic Messages API response
+type anthropicResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+// anthropicStreamEvent covers the fields used from Messages API stream events
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	// Usage carries the output tokens on message_delta events
+	Usage anthropicUsage `json:"usage"`
+	Delta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicProvider talks to the Anthropic Messages API
+type anthropicProvider struct {
+	url     string
+	apiKey  string
+	client  *http.Client
+	timeout time.Duration
+}
+
+func (p *anthropicProvider) Name() string { return ProviderAnthropic }
+
+func (p *anthropicProvider) request(req CompletionRequest, stream bool) anthropicRequest {
+	r := anthropicRequest{
+		Model:         req.Model,
+		MaxTokens:     req.MaxTokens,
+		Stream:        stream,
+		Temperature:   req.Temperature,
+		TopP:          req.TopP,
+		StopSequences: req.Stop,
+	}
+	if r.MaxTokens <= 0 {
+		r.MaxTokens = anthropicDefaultMaxTokens
+	}
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			r.System = strings.TrimSpace(r.System + "\n" + m.Content)
+			continue
+		}
+		r.Messages = append(r.Messages, m)
+	}
+	if req.JSONSchema != nil {
+		r.Messages = append(r.Messages, Message{Role: "assistant", Content: anthropicJSONPrefill})
+	}
+	return r
+}
+
+func (p *anthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+}
+
+func (p *anthropicProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	if p.apiKey == "" {
+		return nil, fmt.Errorf("anthropic API key is not set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	resp, err := postJSON(ctx, p.client, p.url, p.request(req, false), p.headers())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse API response: %w", err)
+	}
+
+	var content strings.Builder
+	if req.JSONSchema != nil {
+		content.WriteString(anthropicJSONPrefill)
+	}
+	for _, block := range response.Content {
+		if block.Type == "text" {
+			content.WriteString(block.Text)
+		}
+	}
+	return &CompletionResponse{
+		Content: content.String(),
+		Model:   response.Model,
+		Usage:   &TokenUsage{PromptTokens: response.Usage.InputTokens, CompletionTokens: response.Usage.OutputTokens},
+	}, nil
+}
+
+func (p *anthropicProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResponse, error) {
+	if p.apiKey == "" {
+		return nil, fmt.Errorf("anthropic API key is not set")
+	}
+
+	headers := p.headers()
+	headers["Accept"] = "text/event-stream"
+	resp, err := postJSON(ctx, p.client, p.url, p.request(req, true), headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	if req.JSONSchema != nil {
+		content.WriteString(anthropicJSONPrefill)
+		if err := onDelta(anthropicJSONPrefill); err != nil {
+			return nil, err
+		}
+	}
+	model := ""
+	var usage TokenUsage
+	err = readServerSentEvents(resp.Body, func(event string, data []byte) (bool, error) {
+		var e anthropicStreamEvent
+		if err := json.Unmarshal(data, &e); err != nil {
+			return false, fmt.Errorf("failed to parse stream event: %w", err)
+		}
+
+		switch e.Type {
+		case "message_start":
+			model = e.Message.Model
+			usage.PromptTokens = e.Message.Usage.InputTokens
+		case "message_delta":
+			usage.CompletionTokens = e.Usage.OutputTokens
+		case "content_block_delta":
+			if e.Delta.Type == "text_delta" && e.Delta.Text != "" {
+				content.WriteString(e.Delta.Text)
+				return false, onDelta(e.Delta.Text)
+			}
+		case "message_stop":
+			return true, nil
+		case "error":
+			return false, fmt.Errorf("stream error: %s: %s", e.Error.Type, e.Error.Message)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompletionResponse{Content: content.String(), Model: model, Usage: &usage}, nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ollamaRequest is an Ollama /api/chat request
+type ollamaRequest struct {
+	Model    string        `json:"model"`
+	Messages []Message     `json:"messages"`
+	Stream   bool          `json:"stream"`
+	Options  ollamaOptions `json:"options"`
+	// Format is a JSON schema constraining the response
+	Format map[string]interface{} `json:"format,omitempty"`
+}
+
+// ollamaOptions are the generation options of an Ollama request
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+func newOllamaRequest(req CompletionRequest, stream bool) ollamaRequest {
+	r := ollamaRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Stream:   stream,
+		Options: ollamaOptions{
+			Temperature: req.Temperature,
+			NumPredict:  req.MaxTokens,
+			TopP:        req.TopP,
+			Stop:        req.Stop,
+		},
+	}
+	if req.JSONSchema != nil {
+		r.Format = req.JSONSchema.Schema
+	}
+	return r
+}
+
+// ollamaResponse is an Ollama /api/chat response, or one line of a streamed response
+type ollamaResponse struct {
+	Model   string  `json:"model"`
+	Message Message `json:"message"`
+	Done    bool    `json:"done"`
+	Error   string  `json:"error"`
+	// PromptEvalCount and EvalCount are the prompt and completion tokens, set once done
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+func (r ollamaResponse) usage() *TokenUsage {
+	if !r.Done {
+		return nil
+	}
+	return &TokenUsage{PromptTokens: r.PromptEvalCount, CompletionTokens: r.EvalCount}
+}
+
+// ollamaProvider talks to a local Ollama server
+type ollamaProvider struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+func (p *ollamaProvider) Name() string { return ProviderOllama }
+
+func (p *ollamaProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	resp, err := postJSON(ctx, p.client, p.url, newOllamaRequest(req, false), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse API response: %w", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("API returned error: %s", response.Error)
+	}
+	return &CompletionResponse{Content: response.Message.Content, Model: response.Model, Usage: response.usage()}, nil
+}
+
+func (p *ollamaProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResponse, error) {
+	resp, err := postJSON(ctx, p.client, p.url, newOllamaRequest(req, true), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Ollama streams one JSON object per line
+	var content strings.Builder
+	model := ""
+	var usage *TokenUsage
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var chunk ollamaResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to parse chunk: %w", err)
+		}
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("stream error: %s", chunk.Error)
+		}
+		model = chunk.Model
+
+		if delta := chunk.Message.Content; delta != "" {
+			content.WriteString(delta)
+			if err := onDelta(delta); err != nil {
+				return nil, err
+			}
+		}
+		if chunk.Done {
+			usage = chunk.usage()
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading stream: %w", err)
+	}
+
+	return &CompletionResponse{Content: content.String(), Model: model, Usage: usage}, nil
+}
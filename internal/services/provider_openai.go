@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAI ChatCompletion request structure
+type ChatCompletionRequest struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Stream      bool      `json:"stream,omitempty"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+	TopP        *float64  `json:"top_p,omitempty"`
+	Stop        []string  `json:"stop,omitempty"`
+	// ResponseFormat requests JSON output
+	ResponseFormat map[string]interface{} `json:"response_format,omitempty"`
+	// StreamOptions asks streams to end with a usage chunk
+	StreamOptions *ChatStreamOptions `json:"stream_options,omitempty"`
+}
+
+// OpenAI ChatCompletion stream options
+type ChatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// OpenAI ChatCompletion token usage
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u *ChatCompletionUsage) tokenUsage() *TokenUsage {
+	if u == nil {
+		return nil
+	}
+	return &TokenUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens}
+}
+
+// OpenAI ChatCompletion response structure
+type ChatCompletionResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index   int `json:"index"`
+		Message struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage *ChatCompletionUsage `json:"usage,omitempty"`
+}
+
+// OpenAI ChatCompletion streaming response structure
+type ChatCompletionChunk struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Content string `json:"content,omitempty"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	// Usage is only set on the final chunk of streams that asked for it
+	Usage *ChatCompletionUsage `json:"usage,omitempty"`
+}
+
+// openAIProvider talks to the OpenAI chat completions API or any compatible endpoint, including
+// Azure OpenAI deployments, which differ only in URL and authentication header
+type openAIProvider struct {
+	name       string
+	url        string
+	authHeader string
+	authValue  string
+	apiKey     string
+	client     *http.Client
+	timeout    time.Duration
+	// streamUsage asks streams to report token usage, which Azure only supports from API version
+	// 2024-09-01-preview; without it usage is estimated
+	streamUsage bool
+}
+
+func (p *openAIProvider) Name() string { return p.name }
+
+func (p *openAIProvider) headers() map[string]string {
+	return map[string]string{p.authHeader: p.authValue}
+}
+
+func (p *openAIProvider) checkKey() error {
+	// Local OpenAI-compatible servers usually need no key
+	if p.apiKey == "" && (p.name == ProviderAzure || strings.HasPrefix(p.url, "https://api.openai.com/")) {
+		return fmt.Errorf("%s API key is not set", p.name)
+	}
+	return nil
+}
+
+func (p *openAIProvider) chatCompletionRequest(req CompletionRequest, stream bool) ChatCompletionRequest {
+	r := ChatCompletionRequest{
+		Model:       req.Model,
+		Messages:    req.Messages,
+		Stream:      stream,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		TopP:        req.TopP,
+		Stop:        req.Stop,
+	}
+	if stream && p.streamUsage {
+		r.StreamOptions = &ChatStreamOptions{IncludeUsage: true}
+	}
+	if req.JSONSchema != nil {
+		// Azure's GA API versions only support JSON mode; the schema is described in the prompt
+		if p.name == ProviderAzure {
+			r.ResponseFormat = map[string]interface{}{"type": "json_object"}
+		} else {
+			r.ResponseFormat = map[string]interface{}{
+				"type": "json_schema",
+				"json_schema": map[string]interface{}{
+					"name":   req.JSONSchema.Name,
+					"schema": req.JSONSchema.Schema,
+					"strict": true,
+				},
+			}
+		}
+	}
+	return r
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	if err := p.checkKey(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	resp, err := postJSON(ctx, p.client, p.url, p.chatCompletionRequest(req, false), p.headers())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response ChatCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to parse API response: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("API response contained no choices")
+	}
+
+	return &CompletionResponse{
+		Content: response.Choices[0].Message.Content,
+		Model:   response.Model,
+		Usage:   response.Usage.tokenUsage(),
+	}, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(delta string) error) (*CompletionResponse, error) {
+	if err := p.checkKey(); err != nil {
+		return nil, err
+	}
+
+	headers := p.headers()
+	headers["Accept"] = "text/event-stream"
+	resp, err := postJSON(ctx, p.client, p.url, p.chatCompletionRequest(req, true), headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	model := ""
+	var usage *TokenUsage
+	err = readServerSentEvents(resp.Body, func(event string, data []byte) (bool, error) {
+		if string(data) == "[DONE]" {
+			return true, nil
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return false, fmt.Errorf("failed to parse chunk: %w", err)
+		}
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.tokenUsage()
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			return false, nil
+		}
+
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		return false, onDelta(delta)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompletionResponse{Content: content.String(), Model: model, Usage: usage}, nil
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStubOpenAIProvider starts a stub OpenAI-compatible server and returns a provider talking to it
+func newStubOpenAIProvider(t *testing.T, handler http.HandlerFunc) Provider {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	provider, err := NewProvider(ProviderConfig{Provider: ProviderOpenAI, BaseURL: server.URL, APIKey: "test-key"})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	return provider
+}
+
+// decodeStubRequest checks the path and auth header of a stub request and decodes its body
+func decodeStubRequest(t *testing.T, r *http.Request) ChatCompletionRequest {
+	t.Helper()
+	if r.URL.Path != "/chat/completions" {
+		t.Errorf("path = %q, want /chat/completions", r.URL.Path)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+		t.Errorf("Authorization = %q, want Bearer test-key", got)
+	}
+	var req ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		t.Errorf("failed to decode request: %v", err)
+	}
+	return req
+}
+
+func TestOpenAIProviderComplete(t *testing.T) {
+	provider := newStubOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		req := decodeStubRequest(t, r)
+		if req.Stream {
+			t.Error("complete request asked for a stream")
+		}
+		if req.Model != "gpt-4o" || len(req.Messages) != 1 || req.Messages[0].Content != "Hello" {
+			t.Errorf("unexpected request: %+v", req)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"c1","object":"chat.completion","model":"gpt-4o-2024-08-06",`+
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"Hi there"}}],`+
+			`"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`)
+	})
+
+	resp, err := provider.Complete(context.Background(), CompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []Message{{Role: "user", Content: "Hello"}},
+	})
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if resp.Content != "Hi there" || resp.Model != "gpt-4o-2024-08-06" {
+		t.Errorf("response = %+v", resp)
+	}
+	if resp.Usage == nil || *resp.Usage != (TokenUsage{PromptTokens: 12, CompletionTokens: 3}) {
+		t.Errorf("usage = %+v, want 12 prompt and 3 completion tokens", resp.Usage)
+	}
+}
+
+func TestOpenAIProviderStream(t *testing.T) {
+	provider := newStubOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		req := decodeStubRequest(t, r)
+		if !req.Stream || req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Errorf("stream request without usage: %+v", req)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, data := range []string{
+			`{"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hel"},"finish_reason":null}]}`,
+			`{"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":null}]}`,
+			`{"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			`{"id":"c1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}`,
+			`[DONE]`,
+			// Anything after [DONE] must be ignored
+			`{"id":"c1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"ignored"}}]}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	})
+
+	var deltas []string
+	resp, err := provider.Stream(context.Background(), CompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []Message{{Role: "user", Content: "Hello"}},
+	}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if got := strings.Join(deltas, "|"); got != "Hel|lo" {
+		t.Errorf("deltas = %q, want Hel|lo", got)
+	}
+	if resp.Content != "Hello" || resp.Model != "gpt-4o" {
+		t.Errorf("response = %+v", resp)
+	}
+	if resp.Usage == nil || *resp.Usage != (TokenUsage{PromptTokens: 7, CompletionTokens: 2}) {
+		t.Errorf("usage = %+v, want 7 prompt and 2 completion tokens", resp.Usage)
+	}
+}
+
+func TestOpenAIProviderAPIError(t *testing.T) {
+	provider := newStubOpenAIProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"rate limited"}}`)
+	})
+
+	req := CompletionRequest{Model: "gpt-4o", Messages: []Message{{Role: "user", Content: "Hello"}}}
+	calls := map[string]func() error{
+		"Complete": func() error {
+			_, err := provider.Complete(context.Background(), req)
+			return err
+		},
+		"Stream": func() error {
+			_, err := provider.Stream(context.Background(), req, func(string) error { return nil })
+			return err
+		},
+	}
+	for name, call := range calls {
+		var apiErr *APIError
+		if err := call(); !errors.As(err, &apiErr) {
+			t.Fatalf("%s error = %v, want an APIError", name, err)
+		}
+		if apiErr.StatusCode != http.StatusTooManyRequests || !strings.Contains(apiErr.Body, "rate limited") {
+			t.Errorf("%s APIError = %+v", name, apiErr)
+		}
+		if apiErr.RetryAfter != 3*time.Second {
+			t.Errorf("%s RetryAfter = %s, want 3s", name, apiErr.RetryAfter)
+		}
+	}
+}
+
+func TestAzureStreamUsageByAPIVersion(t *testing.T) {
+	for _, tc := range []struct {
+		apiVersion string
+		wantUsage  bool
+	}{
+		{"", false}, // defaults to 2024-06-01
+		{"2024-08-01-preview", false},
+		{"2024-09-01-preview", true},
+		{"2024-10-21", true},
+	} {
+		var got *ChatStreamOptions
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req ChatCompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("failed to decode request: %v", err)
+			}
+			got = req.StreamOptions
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+		}))
+
+		provider, err := NewProvider(ProviderConfig{Provider: ProviderAzure, BaseURL: server.URL, APIKey: "test-key",
+			AzureDeployment: "gpt-4o", AzureAPIVersion: tc.apiVersion})
+		if err != nil {
+			t.Fatalf("NewProvider: %v", err)
+		}
+		resp, err := provider.Stream(context.Background(), CompletionRequest{Model: "gpt-4o"}, func(string) error { return nil })
+		server.Close()
+		if err != nil {
+			t.Fatalf("api-version %q: Stream: %v", tc.apiVersion, err)
+		}
+
+		if (got != nil) != tc.wantUsage {
+			t.Errorf("api-version %q: stream_options = %+v, want usage requested %v", tc.apiVersion, got, tc.wantUsage)
+		}
+		if resp.Usage != nil {
+			t.Errorf("api-version %q: usage = %+v, want none so it is estimated", tc.apiVersion, resp.Usage)
+		}
+	}
+}
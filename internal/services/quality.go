@@ -0,0 +1,284 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+)
+
+// Supported data-quality checks
+const (
+	QualityCheckNotNull       = "not_null"
+	QualityCheckRange         = "range"
+	QualityCheckAllowedValues = "allowed_values"
+	QualityCheckFreshness     = "freshness"
+	QualityCheckMaxChange     = "max_change"
+)
+
+// Quality check severities
+const (
+	QualitySeverityWarn = "warn"
+	QualitySeverityFail = "fail"
+)
+
+// Overall quality status of a processing run
+const (
+	QualityStatusPassed = "passed"
+	QualityStatusWarn   = "warn"
+	QualityStatusFailed = "failed"
+)
+
+// ErrQualityGateFailed is returned when analysis is requested for a run that failed a quality check
+var ErrQualityGateFailed = errors.New("processed data failed a data-quality check")
+
+// QualityRule declares a data-quality check applied to every metric matching a glob pattern
+type QualityRule struct {
+	// Name identifies the rule in stored results; defaults to "<check>:<metric>"
+	Name string `json:"name,omitempty"`
+	// Metric is a glob pattern matched against metric keys
+	Metric string `json:"metric"`
+	// Check is one of not_null, range, allowed_values, freshness or max_change
+	Check string `json:"check"`
+	// Severity is warn or fail; a failing check blocks LLM analysis of the run
+	Severity string `json:"severity"`
+	// Min and Max bound the value of a range check
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Allowed lists the accepted values of an allowed_values check
+	Allowed []interface{} `json:"allowed,omitempty"`
+	// MaxAge is the maximum age of a source timestamp for a freshness check, e.g. "30m"
+	MaxAge string `json:"max_age,omitempty"`
+	// MaxChangePct is the maximum percent change from the previous run for a max_change check
+	MaxChangePct float64 `json:"max_change_pct,omitempty"`
+}
+
+// QualityCheckResult is the outcome of a single rule evaluated against a single metric
+type QualityCheckResult struct {
+	Rule     string `json:"rule"`
+	Check    string `json:"check"`
+	Metric   string `json:"metric"`
+	Severity string `json:"severity"`
+	Passed   bool   `json:"passed"`
+	Message  string `json:"message"`
+}
+
+func (r QualityRule) validate() error {
+	if r.Metric == "" {
+		return fmt.Errorf("metric pattern is required")
+	}
+	if r.Severity != QualitySeverityWarn && r.Severity != QualitySeverityFail {
+		return fmt.Errorf("severity must be %q or %q", QualitySeverityWarn, QualitySeverityFail)
+	}
+
+	switch r.Check {
+	case QualityCheckNotNull:
+	case QualityCheckRange:
+		if r.Min == nil && r.Max == nil {
+			return fmt.Errorf("range check requires min or max")
+		}
+	case QualityCheckAllowedValues:
+		if len(r.Allowed) == 0 {
+			return fmt.Errorf("allowed_values check requires allowed")
+		}
+	case QualityCheckFreshness:
+		if _, err := time.ParseDuration(r.MaxAge); err != nil {
+			return fmt.Errorf("freshness check requires a valid max_age: %w", err)
+		}
+	case QualityCheckMaxChange:
+		if r.MaxChangePct <= 0 {
+			return fmt.Errorf("max_change check requires a positive max_change_pct")
+		}
+	default:
+		return fmt.Errorf("unsupported check: %s", r.Check)
+	}
+	return nil
+}
+
+func (r QualityRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Check + ":" + r.Metric
+}
+
+// evaluateQualityRules runs every configured quality rule against the metrics of a run and
+// returns the individual results together with the overall status of the run
+func (s *DataProcessorService) evaluateQualityRules(result *ProcessedResult) ([]QualityCheckResult, string, error) {
+	metrics := make(map[string]interface{}, len(result.CombinedMetrics)+len(result.DerivedMetrics))
+	for key, value := range result.CombinedMetrics {
+		metrics[key] = value
+	}
+	for key, value := range result.DerivedMetrics {
+		metrics[key] = value
+	}
+
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := []QualityCheckResult{}
+	status := QualityStatusPassed
+
+	for _, rule := range s.Config.QualityRules {
+		matched := false
+		for _, key := range keys {
+			if !matchGlob(rule.Metric, key) {
+				continue
+			}
+			matched = true
+
+			check, err := s.evaluateQualityRule(rule, key, metrics[key], result.ObservedAt)
+			if err != nil {
+				return nil, "", err
+			}
+			results = append(results, check)
+		}
+
+		// A rule whose metric is missing cannot pass, so a source that dropped out of the run
+		// does not slip through its range or change checks
+		if !matched {
+			results = append(results, QualityCheckResult{
+				Rule:     rule.name(),
+				Check:    rule.Check,
+				Metric:   rule.Metric,
+				Severity: rule.Severity,
+				Message:  fmt.Sprintf("no metric matches %s", rule.Metric),
+			})
+		}
+	}
+
+	for _, check := range results {
+		if check.Passed {
+			continue
+		}
+		if check.Severity == QualitySeverityFail {
+			status = QualityStatusFailed
+			break
+		}
+		status = QualityStatusWarn
+	}
+
+	return results, status, nil
+}
+
+// evaluateQualityRule applies a single rule to a single metric value. Freshness and change are
+// judged relative to the time the run's data was observed.
+func (s *DataProcessorService) evaluateQualityRule(rule QualityRule, key string, value interface{}, observedAt time.Time) (QualityCheckResult, error) {
+	check := QualityCheckResult{
+		Rule:     rule.name(),
+		Check:    rule.Check,
+		Metric:   key,
+		Severity: rule.Severity,
+	}
+
+	switch rule.Check {
+	case QualityCheckNotNull:
+		check.Passed = value != nil && value != ""
+		if !check.Passed {
+			check.Message = fmt.Sprintf("%s is null or empty", key)
+		}
+
+	case QualityCheckRange:
+		f, ok := toFloat(value)
+		switch {
+		case !ok:
+			check.Message = fmt.Sprintf("%s is not numeric: %v", key, value)
+		case rule.Min != nil && f < *rule.Min:
+			check.Message = fmt.Sprintf("%s = %g is below the minimum of %g", key, f, *rule.Min)
+		case rule.Max != nil && f > *rule.Max:
+			check.Message = fmt.Sprintf("%s = %g is above the maximum of %g", key, f, *rule.Max)
+		default:
+			check.Passed = true
+		}
+
+	case QualityCheckAllowedValues:
+		for _, allowed := range rule.Allowed {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				check.Passed = true
+				break
+			}
+		}
+		if !check.Passed {
+			check.Message = fmt.Sprintf("%s = %v is not one of %v", key, value, rule.Allowed)
+		}
+
+	case QualityCheckFreshness:
+		maxAge, _ := time.ParseDuration(rule.MaxAge)
+		observed, ok := toTime(value)
+		if !ok {
+			check.Message = fmt.Sprintf("%s is not a timestamp: %v", key, value)
+			break
+		}
+		age := observedAt.Sub(observed)
+		check.Passed = age <= maxAge
+		if !check.Passed {
+			check.Message = fmt.Sprintf("%s is %s old, exceeding the maximum age of %s", key, age.Round(time.Second), maxAge)
+		}
+
+	case QualityCheckMaxChange:
+		f, ok := toFloat(value)
+		if !ok {
+			check.Message = fmt.Sprintf("%s is not numeric: %v", key, value)
+			break
+		}
+		history, err := s.metricHistory(key, 1, observedAt)
+		if err != nil {
+			return check, err
+		}
+		if len(history) == 0 || history[0] == 0 {
+			check.Passed = true
+			break
+		}
+		change := (f - history[0]) / math.Abs(history[0]) * 100
+		check.Passed = math.Abs(change) <= rule.MaxChangePct
+		if !check.Passed {
+			check.Message = fmt.Sprintf("%s changed by %.2f%% since the previous run, exceeding %.2f%%", key, change, rule.MaxChangePct)
+		}
+	}
+
+	return check, nil
+}
+
+// toTime interprets a metric value as a timestamp. Numbers are treated as Unix epochs in
+// seconds, or milliseconds when too large to be seconds.
+func toTime(value interface{}) (time.Time, bool) {
+	if t, ok := value.(time.Time); ok {
+		return t, true
+	}
+	if f, ok := toFloat(value); ok {
+		if f > 1e12 {
+			return time.UnixMilli(int64(f)), true
+		}
+		return time.Unix(int64(f), 0), true
+	}
+	if str, ok := value.(string); ok {
+		if t, ok := coerceValue(str).(time.Time); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// qualityCheckRecords converts quality check results into rows linked to a processed data entry
+func qualityCheckRecords(processedDataID uint, checkedAt time.Time, checks []QualityCheckResult) []models.QualityCheck {
+	records := make([]models.QualityCheck, len(checks))
+	for i, c := range checks {
+		records[i] = models.QualityCheck{
+			ProcessedDataID: processedDataID,
+			Rule:            c.Rule,
+			Check:           c.Check,
+			Metric:          c.Metric,
+			Severity:        c.Severity,
+			Passed:          c.Passed,
+			Message:         c.Message,
+			CheckedAt:       checkedAt,
+		}
+	}
+	return records
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func float64Ptr(f float64) *float64 { return &f }
+
+func TestEvaluateQualityRule(t *testing.T) {
+	observedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := &DataProcessorService{}
+
+	tests := []struct {
+		name  string
+		rule  QualityRule
+		value interface{}
+		want  bool
+	}{
+		{"not_null value", QualityRule{Check: QualityCheckNotNull}, 1.5, true},
+		{"not_null nil", QualityRule{Check: QualityCheckNotNull}, nil, false},
+		{"not_null empty string", QualityRule{Check: QualityCheckNotNull}, "", false},
+		{"range within", QualityRule{Check: QualityCheckRange, Min: float64Ptr(0), Max: float64Ptr(10)}, 5.0, true},
+		{"range below", QualityRule{Check: QualityCheckRange, Min: float64Ptr(0)}, -1.0, false},
+		{"range above", QualityRule{Check: QualityCheckRange, Max: float64Ptr(10)}, 11.0, false},
+		{"range numeric string", QualityRule{Check: QualityCheckRange, Min: float64Ptr(0)}, "42.5", true},
+		{"range not numeric", QualityRule{Check: QualityCheckRange, Min: float64Ptr(0)}, "n/a", false},
+		{"allowed value", QualityRule{Check: QualityCheckAllowedValues, Allowed: []interface{}{"BTC", "ETH"}}, "BTC", true},
+		{"allowed number", QualityRule{Check: QualityCheckAllowedValues, Allowed: []interface{}{1.0}}, 1, true},
+		{"disallowed value", QualityRule{Check: QualityCheckAllowedValues, Allowed: []interface{}{"BTC"}}, "DOGE", false},
+		{"fresh timestamp", QualityRule{Check: QualityCheckFreshness, MaxAge: "15m"}, observedAt.Add(-10 * time.Minute), true},
+		{"stale timestamp", QualityRule{Check: QualityCheckFreshness, MaxAge: "15m"}, observedAt.Add(-20 * time.Minute), false},
+		{"fresh epoch", QualityRule{Check: QualityCheckFreshness, MaxAge: "15m"}, float64(observedAt.Add(-time.Minute).Unix()), true},
+		{"freshness not a timestamp", QualityRule{Check: QualityCheckFreshness, MaxAge: "15m"}, "yesterday", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Metric = "metric"
+			tt.rule.Severity = QualitySeverityFail
+			check, err := s.evaluateQualityRule(tt.rule, "metric", tt.value, observedAt)
+			if err != nil {
+				t.Fatalf("evaluateQualityRule: %v", err)
+			}
+			if check.Passed != tt.want {
+				t.Errorf("passed = %v, want %v (message %q)", check.Passed, tt.want, check.Message)
+			}
+			if !check.Passed && check.Message == "" {
+				t.Error("failed check has no message")
+			}
+		})
+	}
+}
+
+func TestEvaluateQualityRules(t *testing.T) {
+	result := &ProcessedResult{
+		ObservedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		CombinedMetrics: map[string]interface{}{
+			"CryptoAPI_data_priceUsd": 67000.0,
+			"WeatherAPI_temp_c":       nil,
+		},
+		DerivedMetrics: map[string]float64{"data_sources_count": 2},
+	}
+
+	tests := []struct {
+		name       string
+		rules      []QualityRule
+		wantStatus string
+		wantChecks int
+	}{
+		{"no rules", nil, QualityStatusPassed, 0},
+		{"passing rule", []QualityRule{
+			{Metric: "CryptoAPI_*", Check: QualityCheckRange, Min: float64Ptr(0), Severity: QualitySeverityFail},
+		}, QualityStatusPassed, 1},
+		{"derived metrics are checked", []QualityRule{
+			{Metric: "data_sources_count", Check: QualityCheckRange, Min: float64Ptr(3), Severity: QualitySeverityWarn},
+		}, QualityStatusWarn, 1},
+		{"warning", []QualityRule{
+			{Metric: "WeatherAPI_*", Check: QualityCheckNotNull, Severity: QualitySeverityWarn},
+		}, QualityStatusWarn, 1},
+		{"failure outranks warning", []QualityRule{
+			{Metric: "WeatherAPI_*", Check: QualityCheckNotNull, Severity: QualitySeverityWarn},
+			{Metric: "CryptoAPI_data_priceUsd", Check: QualityCheckRange, Max: float64Ptr(1000), Severity: QualitySeverityFail},
+		}, QualityStatusFailed, 2},
+		{"missing metric fails a range rule", []QualityRule{
+			{Metric: "CryptoAPI.data.priceUsd", Check: QualityCheckRange, Min: float64Ptr(0), Severity: QualitySeverityFail},
+		}, QualityStatusFailed, 1},
+		{"missing metric warns at warn severity", []QualityRule{
+			{Metric: "btc_price_usd", Check: QualityCheckRange, Min: float64Ptr(0), Severity: QualitySeverityWarn},
+		}, QualityStatusWarn, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &DataProcessorService{Config: &PipelineConfig{QualityRules: tt.rules}}
+			checks, status, err := s.evaluateQualityRules(result)
+			if err != nil {
+				t.Fatalf("evaluateQualityRules: %v", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("status = %q, want %q (checks %+v)", status, tt.wantStatus, checks)
+			}
+			if len(checks) != tt.wantChecks {
+				t.Errorf("got %d checks, want %d", len(checks), tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestDefaultQualityRulesDoNotGateMissingKeys(t *testing.T) {
+	// With a custom separator or the adapt transformer the default rule's key does not exist
+	result := &ProcessedResult{CombinedMetrics: map[string]interface{}{"btc_price_usd": 67000.0}}
+	s := &DataProcessorService{Config: DefaultPipelineConfig()}
+	_, status, err := s.evaluateQualityRules(result)
+	if err != nil {
+		t.Fatalf("evaluateQualityRules: %v", err)
+	}
+	if status == QualityStatusFailed {
+		t.Error("default quality rules failed a run without the CryptoAPI key")
+	}
+}
+
+func TestToTime(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+		ok    bool
+	}{
+		{"time", want, true},
+		{"epoch seconds", float64(want.Unix()), true},
+		{"epoch seconds int", int(want.Unix()), true},
+		{"epoch milliseconds", float64(want.UnixMilli()), true},
+		{"epoch string", "1714564800", true},
+		{"RFC3339 string", "2024-05-01T12:00:00Z", true},
+		{"not a timestamp", "soon", false},
+		{"nil", nil, false},
+		{"bool", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := toTime(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && !got.Equal(want) {
+				t.Errorf("toTime(%v) = %s, want %s", tt.value, got, want)
+			}
+		})
+	}
+}
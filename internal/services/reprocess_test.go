@@ -0,0 +1,131 @@
+package services
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"gorm.io/gorm"
+)
+
+func runEntry(id uint, runID, source string, fetchedAt time.Time) models.RawData {
+	return models.RawData{Model: gorm.Model{ID: id}, SourceName: source, FetchedAt: fetchedAt, RunID: runID}
+}
+
+// describeRuns lists the ids and entry ids of runs, e.g. "a:1,2 legacy-3:3"
+func describeRuns(runs []rawRun) string {
+	var parts []string
+	for _, run := range runs {
+		var ids []string
+		for _, e := range run.entries {
+			ids = append(ids, fmt.Sprint(e.ID))
+		}
+		parts = append(parts, run.id+":"+strings.Join(ids, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestGroupRawRuns(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return t0.Add(time.Duration(seconds) * time.Second) }
+
+	tests := []struct {
+		name    string
+		entries []models.RawData
+		want    string
+	}{
+		{"recorded runs", []models.RawData{
+			runEntry(1, "a", "CryptoAPI", at(0)),
+			runEntry(2, "b", "CryptoAPI", at(5)),
+			runEntry(3, "a", "WeatherAPI", at(10)),
+		}, "a:1,3 b:2"},
+		{"legacy runs split by gap", []models.RawData{
+			runEntry(1, "", "CryptoAPI", at(0)),
+			runEntry(2, "", "WeatherAPI", at(30)),
+			runEntry(3, "", "CryptoAPI", at(300)),
+		}, "legacy-1:1,2 legacy-3:3"},
+		{"legacy runs split by repeated source", []models.RawData{
+			runEntry(1, "", "CryptoAPI", at(0)),
+			runEntry(2, "", "CryptoAPI", at(10)),
+			runEntry(3, "", "WeatherAPI", at(20)),
+		}, "legacy-1:1 legacy-2:2,3"},
+		{"recorded and legacy runs ordered by fetch time", []models.RawData{
+			runEntry(1, "", "CryptoAPI", at(0)),
+			runEntry(2, "a", "CryptoAPI", at(600)),
+			runEntry(3, "", "CryptoAPI", at(1200)),
+		}, "legacy-1:1 a:2 legacy-3:3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeRuns(groupRawRuns(tt.entries)); got != tt.want {
+				t.Errorf("runs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunsInRange(t *testing.T) {
+	from := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	// Recorded runs are loaded whole, so one straddling the range is kept with all its entries
+	entries := []models.RawData{
+		runEntry(1, "", "CryptoAPI", from.Add(-40*time.Second)),
+		runEntry(2, "straddling", "CryptoAPI", from.Add(-10*time.Second)),
+		runEntry(3, "straddling", "WeatherAPI", from.Add(10*time.Second)),
+		runEntry(4, "", "CryptoAPI", from.Add(-5*time.Second)),
+		runEntry(5, "", "WeatherAPI", from.Add(20*time.Second)),
+		runEntry(6, "", "CryptoAPI", from.Add(30*time.Minute)),
+		runEntry(7, "", "WeatherAPI", from.Add(30*time.Minute+10*time.Second)),
+		runEntry(8, "", "CryptoAPI", to.Add(-10*time.Second)),
+		runEntry(9, "", "WeatherAPI", to.Add(20*time.Second)),
+		runEntry(10, "", "CryptoAPI", to.Add(50*time.Second)),
+	}
+
+	runs, partial := runsInRange(groupRawRuns(entries), from, to)
+	if got, want := describeRuns(runs), "straddling:2,3 legacy-6:6,7"; got != want {
+		t.Errorf("runs = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(partial, " "), "legacy-4 legacy-8"; got != want {
+		t.Errorf("partial = %q, want %q", got, want)
+	}
+}
+
+func TestReprocessLoadsWholeRuns(t *testing.T) {
+	from := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	s, stub := newStubProcessor(t, DefaultPipelineConfig(), func(q stubQuery) (*stubRows, error) {
+		switch {
+		case strings.Contains(q.SQL, `FROM "raw_data"`):
+			return rawDataRows(
+				runEntry(1, "a", "CryptoAPI", from.Add(-10*time.Second)),
+				runEntry(2, "a", "WeatherAPI", from.Add(10*time.Second)),
+			), nil
+		case strings.Contains(q.SQL, "count("):
+			// Every run was already processed by this version
+			return &stubRows{Columns: []string{"count"}, Rows: [][]driver.Value{{int64(1)}}}, nil
+		}
+		return nil, nil
+	})
+
+	summary, err := s.Reprocess(from, to)
+	if err != nil {
+		t.Fatalf("Reprocess: %v", err)
+	}
+	if summary.Runs != 1 || summary.Skipped != 1 || len(summary.Partial) != 0 {
+		t.Errorf("summary = %+v, want one skipped run", summary)
+	}
+
+	queries := stub.statements(`FROM "raw_data"`)
+	if len(queries) != 1 {
+		t.Fatalf("%d raw_data queries, want 1", len(queries))
+	}
+	if !strings.Contains(queries[0].SQL, "run_id IN (SELECT DISTINCT") {
+		t.Errorf("raw data is not loaded by run: %s", queries[0].SQL)
+	}
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"gorm.io/gorm/clause"
+)
+
+// Series resolutions. Hourly and daily series are read from rollups maintained by RunRollups.
+const (
+	ResolutionAuto   = "auto"
+	ResolutionRaw    = "raw"
+	ResolutionHourly = "hourly"
+	ResolutionDaily  = "daily"
+)
+
+// rollupSteps maps each rollup resolution to its bucket size, coarsest first
+var rollupSteps = []struct {
+	resolution string
+	step       time.Duration
+}{
+	{ResolutionDaily, 24 * time.Hour},
+	{ResolutionHourly, time.Hour},
+}
+
+// rollupStep returns the bucket size of a rollup resolution
+func rollupStep(resolution string) (time.Duration, bool) {
+	for _, r := range rollupSteps {
+		if r.resolution == resolution {
+			return r.step, true
+		}
+	}
+	return 0, false
+}
+
+// bucketAccumulator incrementally aggregates the values of a bucket from raw points or rollups
+type bucketAccumulator struct {
+	min, max, sum float64
+	count         int64
+	last          float64
+	lastAt        time.Time
+}
+
+func (a *bucketAccumulator) add(value float64, observedAt time.Time) {
+	a.merge(value, value, value, 1, value, observedAt)
+}
+
+func (a *bucketAccumulator) merge(min, max, sum float64, count int64, last float64, lastAt time.Time) {
+	if a.count == 0 || min < a.min {
+		a.min = min
+	}
+	if a.count == 0 || max > a.max {
+		a.max = max
+	}
+	if a.count == 0 || !lastAt.Before(a.lastAt) {
+		a.last, a.lastAt = last, lastAt
+	}
+	a.sum += sum
+	a.count += count
+}
+
+func (a *bucketAccumulator) value(aggregation string) float64 {
+	switch aggregation {
+	case AggregationMin:
+		return a.min
+	case AggregationMax:
+		return a.max
+	case AggregationLast:
+		return a.last
+	case AggregationSum:
+		return a.sum
+	case AggregationCount:
+		return float64(a.count)
+	}
+	if a.count == 0 {
+		return 0
+	}
+	return a.sum / float64(a.count)
+}
+
+// Rollup recomputes the rollups of a resolution for every bucket overlapping [from, to) from the
+// stored metric points. Existing rollups are replaced, so the job can be re-run after late or
+// reprocessed data arrives. It returns the number of rollups written.
+func (s *MetricsService) Rollup(resolution string, from, to time.Time) (int, error) {
+	step, ok := rollupStep(resolution)
+	if !ok {
+		return 0, fmt.Errorf("unsupported rollup resolution: %s", resolution)
+	}
+
+	from = from.Truncate(step)
+	end := to.Truncate(step)
+	if end.Before(to) {
+		end = end.Add(step)
+	}
+
+	var points []models.MetricPoint
+	latest := latestMetricPoints(s.DB, "").Where("observed_at >= ? AND observed_at < ?", from, end)
+	if err := s.DB.Table("(?) AS p", latest).Order("observed_at asc").Find(&points).Error; err != nil {
+		return 0, fmt.Errorf("failed to retrieve metric points: %w", err)
+	}
+
+	type bucketKey struct {
+		key   string
+		start int64
+	}
+	buckets := make(map[bucketKey]*bucketAccumulator)
+	var order []bucketKey
+	for _, p := range points {
+		k := bucketKey{key: p.Key, start: p.ObservedAt.Truncate(step).UnixNano()}
+		if buckets[k] == nil {
+			buckets[k] = &bucketAccumulator{}
+			order = append(order, k)
+		}
+		buckets[k].add(p.Value, p.ObservedAt)
+	}
+
+	rollups := make([]models.MetricRollup, 0, len(order))
+	for _, k := range order {
+		b := buckets[k]
+		rollups = append(rollups, models.MetricRollup{
+			Key:            k.key,
+			Resolution:     resolution,
+			BucketStart:    time.Unix(0, k.start).UTC(),
+			Min:            b.min,
+			Max:            b.max,
+			Avg:            b.value(AggregationAvg),
+			Sum:            b.sum,
+			Last:           b.last,
+			Count:          b.count,
+			LastObservedAt: b.lastAt,
+		})
+	}
+
+	if len(rollups) > 0 {
+		err := s.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}, {Name: "resolution"}, {Name: "bucket_start"}},
+			DoUpdates: clause.AssignmentColumns([]string{"min", "max", "avg", "sum", "last", "count", "last_observed_at", "updated_at"}),
+		}).CreateInBatches(&rollups, 500).Error
+		if err != nil {
+			return 0, fmt.Errorf("failed to store %s rollups: %w", resolution, err)
+		}
+	}
+
+	return len(rollups), nil
+}
+
+// rollupChunk is the longest range whose points are rolled up at once during backfills
+const rollupChunk = 7 * 24 * time.Hour
+
+// rollupInChunks recomputes the rollups of [from, to) one chunk at a time, bounding the points
+// held in memory, and returns the number of rollups written
+func (s *MetricsService) rollupInChunks(resolution string, from, to time.Time) (int, error) {
+	count := 0
+	for start := from; start.Before(to); start = start.Add(rollupChunk) {
+		end := start.Add(rollupChunk)
+		if end.After(to) {
+			end = to
+		}
+		n, err := s.Rollup(resolution, start, end)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// RunRollups refreshes the hourly and daily rollups of the last lookback period. Only buckets that
+// were complete when a run started are served from rollups; later data is read from raw points.
+// The first run of a process also backfills everything since the latest stored rollup, so
+// downtime longer than the lookback leaves no buckets behind.
+func (s *MetricsService) RunRollups(lookback time.Duration) error {
+	now := time.Now()
+	for _, r := range rollupSteps {
+		from := now.Add(-lookback)
+
+		s.rollupMu.RLock()
+		_, refreshed := s.rolledUpTo[r.resolution]
+		s.rollupMu.RUnlock()
+		if !refreshed {
+			backfillFrom, err := s.rollupBackfillStart(r.resolution)
+			if err != nil {
+				return err
+			}
+			if !backfillFrom.IsZero() && backfillFrom.Before(from) {
+				from = backfillFrom
+			}
+		}
+
+		count, err := s.rollupInChunks(r.resolution, from, now)
+		if err != nil {
+			return err
+		}
+
+		s.rollupMu.Lock()
+		s.rolledUpTo[r.resolution] = now
+		s.rollupMu.Unlock()
+
+		s.Logger.Infow("Metric rollups refreshed", "resolution", r.resolution, "from", from, "rollups", count)
+	}
+	return nil
+}
+
+// rollupBackfillStart returns the start of the latest stored rollup bucket of a resolution, or the
+// time of the earliest metric point when there are no rollups yet. It returns the zero time when
+// there is no metric history.
+func (s *MetricsService) rollupBackfillStart(resolution string) (time.Time, error) {
+	var latest models.MetricRollup
+	err := s.DB.Where("resolution = ?", resolution).Order("bucket_start desc").Limit(1).Find(&latest).Error
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to retrieve the latest %s rollup: %w", resolution, err)
+	}
+	if latest.ID != 0 {
+		return latest.BucketStart, nil
+	}
+
+	var earliest models.MetricPoint
+	if err := s.DB.Order("observed_at asc").Limit(1).Find(&earliest).Error; err != nil {
+		return time.Time{}, fmt.Errorf("failed to retrieve the earliest metric point: %w", err)
+	}
+	return earliest.ObservedAt, nil
+}
+
+// RollupProcessed recomputes the hourly and daily rollups of every bucket holding points of the
+// given processed rows, e.g. after reprocessing history older than the rollup lookback. It returns
+// the number of rollups written per resolution.
+func (s *MetricsService) RollupProcessed(processedDataIDs []uint) (map[string]int, error) {
+	counts := make(map[string]int, len(rollupSteps))
+	if len(processedDataIDs) == 0 {
+		return counts, nil
+	}
+
+	var span struct {
+		From time.Time
+		To   time.Time
+	}
+	err := s.DB.Model(&models.MetricPoint{}).
+		Select("MIN(observed_at) AS \"from\", MAX(observed_at) AS \"to\"").
+		Where("processed_data_id IN ?", processedDataIDs).
+		Scan(&span).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the range of reprocessed points: %w", err)
+	}
+	if span.From.IsZero() {
+		return counts, nil
+	}
+
+	for _, r := range rollupSteps {
+		// Rollups cover [from, to), so the bucket of the last point is included explicitly
+		count, err := s.rollupInChunks(r.resolution, span.From, span.To.Add(time.Nanosecond))
+		if err != nil {
+			return nil, err
+		}
+		counts[r.resolution] = count
+	}
+	return counts, nil
+}
+
+// StartRollups runs RunRollups immediately and then every interval in the background. A
+// non-positive interval disables the job.
+func (s *MetricsService) StartRollups(interval, lookback time.Duration) {
+	if interval <= 0 {
+		s.Logger.Info("Metric rollups are disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.RunRollups(lookback); err != nil {
+				s.Logger.Errorw("Error refreshing metric rollups", "error", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// rollupCutoff returns the end of the last bucket of a resolution that was complete when the
+// rollups were last refreshed, or the zero time if they have not been refreshed yet
+func (s *MetricsService) rollupCutoff(resolution string, step time.Duration) time.Time {
+	s.rollupMu.RLock()
+	defer s.rollupMu.RUnlock()
+
+	rolledUpTo, ok := s.rolledUpTo[resolution]
+	if !ok {
+		return time.Time{}
+	}
+	return rolledUpTo.Truncate(step)
+}
+
+// seriesResolution picks the resolution a series query is answered from. Rollups are only used
+// when every rollup bucket falls entirely within one series bucket.
+func seriesResolution(q SeriesQuery) (string, error) {
+	fits := func(step time.Duration) bool {
+		return q.Step%step == 0 && q.From.Truncate(step).Equal(q.From)
+	}
+
+	switch q.Resolution {
+	case "", ResolutionAuto:
+		if q.Version != "" {
+			return ResolutionRaw, nil
+		}
+		for _, r := range rollupSteps {
+			if fits(r.step) {
+				return r.resolution, nil
+			}
+		}
+		return ResolutionRaw, nil
+	case ResolutionRaw:
+		return ResolutionRaw, nil
+	}
+
+	step, ok := rollupStep(q.Resolution)
+	if !ok {
+		return "", fmt.Errorf("unsupported resolution: %s", q.Resolution)
+	}
+	if q.Version != "" {
+		return "", fmt.Errorf("rollups are not kept per processor version; use the raw resolution")
+	}
+	if !fits(step) {
+		return "", fmt.Errorf("%s resolution requires a step that is a multiple of %s and a 'from' aligned to it", q.Resolution, step)
+	}
+	return q.Resolution, nil
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newStubMetricsService returns a metrics service on a stub database
+func newStubMetricsService(t *testing.T, handler func(q stubQuery) (*stubRows, error)) (*MetricsService, *stubDB) {
+	t.Helper()
+	db, stub := newStubDB(t, handler)
+	return NewMetricsService(db, zap.NewNop().Sugar()), stub
+}
+
+type testPoint struct {
+	key   string
+	value float64
+	at    time.Time
+}
+
+func pointRows(points ...testPoint) *stubRows {
+	rows := &stubRows{Columns: []string{"id", "created_at", "updated_at", "deleted_at", "processed_data_id", "key", "value", "observed_at", "processor_version"}}
+	for i, p := range points {
+		rows.Rows = append(rows.Rows, []driver.Value{int64(i + 1), p.at, p.at, nil, int64(i + 1), p.key, p.value, p.at, ProcessorVersion})
+	}
+	return rows
+}
+
+type testRollup struct {
+	key                 string
+	resolution          string
+	start               time.Time
+	min, max, sum, last float64
+	count               int64
+}
+
+func rollupRows(rollups ...testRollup) *stubRows {
+	rows := &stubRows{Columns: []string{"id", "created_at", "updated_at", "deleted_at", "key", "resolution", "bucket_start", "min", "max", "avg", "sum", "last", "count", "last_observed_at"}}
+	for i, r := range rollups {
+		rows.Rows = append(rows.Rows, []driver.Value{int64(i + 1), r.start, r.start, nil, r.key, r.resolution, r.start,
+			r.min, r.max, r.sum / float64(r.count), r.sum, r.last, r.count, r.start.Add(30 * time.Minute)})
+	}
+	return rows
+}
+
+// describeSeries formats the points of a series as "hour:value" pairs relative to from
+func describeSeries(series Series, from time.Time) string {
+	var parts []string
+	for _, p := range series.Points {
+		parts = append(parts, fmt.Sprintf("%d:%g", int(p.Timestamp.Sub(from)/time.Hour), p.Value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestQuerySeriesAcrossRollupCutoff(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	hour := func(h float64) time.Time { return from.Add(time.Duration(h * float64(time.Hour))) }
+
+	tests := []struct {
+		name           string
+		rolledUpTo     time.Time
+		wantResolution string
+		want           string
+		wantGap        bool
+	}{
+		// Hours 0 and 2 are rolled up; hour 1 has no rollup row and is read from raw points, as is
+		// everything from the cutoff at hour 3
+		{"gap before the cutoff is read from raw points", hour(3.5), ResolutionHourly, "0:10 1:7 2:4 3:9 4:11", true},
+		{"rollups not refreshed yet", time.Time{}, ResolutionRaw, "0:1 1:7 2:2 3:9 4:11", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, stub := newStubMetricsService(t, func(q stubQuery) (*stubRows, error) {
+				switch {
+				case strings.Contains(q.SQL, `FROM "metric_rollups"`):
+					return rollupRows(
+						testRollup{key: "price", resolution: ResolutionHourly, start: hour(0), min: 5, max: 15, sum: 20, last: 15, count: 2},
+						testRollup{key: "price", resolution: ResolutionHourly, start: hour(2), min: 4, max: 4, sum: 4, last: 4, count: 1},
+					), nil
+				case strings.Contains(q.SQL, `"metric_points"`):
+					// Raw points of covered buckets are returned too and must not be counted twice
+					return pointRows(
+						testPoint{"price", 1, hour(0.2)},
+						testPoint{"price", 7, hour(1.2)},
+						testPoint{"price", 2, hour(2.5)},
+						testPoint{"price", 9, hour(3.5)},
+						testPoint{"price", 11, hour(4.1)},
+					), nil
+				}
+				return nil, nil
+			})
+			if !tt.rolledUpTo.IsZero() {
+				s.rolledUpTo[ResolutionHourly] = tt.rolledUpTo
+			}
+
+			series, err := s.QuerySeries(SeriesQuery{Keys: []string{"price"}, From: from, To: hour(5), Step: time.Hour, Aggregation: AggregationAvg})
+			if err != nil {
+				t.Fatalf("QuerySeries: %v", err)
+			}
+			if series[0].Resolution != tt.wantResolution {
+				t.Errorf("resolution = %q, want %q", series[0].Resolution, tt.wantResolution)
+			}
+			if got := describeSeries(series[0], from); got != tt.want {
+				t.Errorf("series = %q, want %q", got, tt.want)
+			}
+
+			raw := stub.statements(`"metric_points"`)
+			if len(raw) != 1 {
+				t.Fatalf("%d raw point queries, want 1", len(raw))
+			}
+			if gap := strings.Contains(raw[0].SQL, " OR "); gap != tt.wantGap {
+				t.Errorf("raw query reads a gap = %v, want %v: %s", gap, tt.wantGap, raw[0].SQL)
+			}
+		})
+	}
+}
+
+func TestRollupGaps(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := from.Add(4 * time.Hour)
+	covered := map[string]map[int64]bool{
+		"full":    {from.UnixNano(): true, from.Add(time.Hour).UnixNano(): true, from.Add(2 * time.Hour).UnixNano(): true, from.Add(3 * time.Hour).UnixNano(): true},
+		"partial": {from.UnixNano(): true, from.Add(2 * time.Hour).UnixNano(): true},
+	}
+
+	gaps := rollupGaps([]string{"full", "partial", "missing"}, covered, from, cutoff, time.Hour)
+	var got []string
+	for _, g := range gaps {
+		got = append(got, fmt.Sprintf("%s:%d-%d", g.key, int(g.from.Sub(from)/time.Hour), int(g.to.Sub(from)/time.Hour)))
+	}
+	if want := "partial:1-4 missing:0-4"; strings.Join(got, " ") != want {
+		t.Errorf("gaps = %v, want %s", got, want)
+	}
+}
+
+func TestRollupUpsertKeepsDeletedAt(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	s, stub := newStubMetricsService(t, func(q stubQuery) (*stubRows, error) {
+		if strings.Contains(q.SQL, `"metric_points"`) {
+			return pointRows(testPoint{"price", 5, at}, testPoint{"price", 7, at.Add(10 * time.Minute)}), nil
+		}
+		return &stubRows{Columns: []string{"id"}, Rows: [][]driver.Value{{int64(1)}}}, nil
+	})
+
+	count, err := s.Rollup(ResolutionHourly, at, at.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Rollup: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("wrote %d rollups, want 1", count)
+	}
+
+	inserts := stub.statements(`INSERT INTO "metric_rollups"`)
+	if len(inserts) != 1 {
+		t.Fatalf("%d rollup inserts, want 1", len(inserts))
+	}
+	if !strings.Contains(inserts[0].SQL, "ON CONFLICT") || strings.Contains(inserts[0].SQL, `"deleted_at"="excluded"."deleted_at"`) {
+		t.Errorf("rollup upsert must not overwrite deleted_at: %s", inserts[0].SQL)
+	}
+}
+
+func TestRunRollupsBackfillsOnFirstRun(t *testing.T) {
+	now := time.Now()
+	s, stub := newStubMetricsService(t, func(q stubQuery) (*stubRows, error) {
+		if strings.Contains(q.SQL, `FROM "metric_rollups"`) {
+			// The latest stored rollup is ten days old, as after downtime longer than the lookback
+			return rollupRows(testRollup{key: "price", resolution: ResolutionHourly, start: now.Add(-240 * time.Hour), sum: 1, count: 1}), nil
+		}
+		return nil, nil
+	})
+
+	if err := s.RunRollups(48 * time.Hour); err != nil {
+		t.Fatalf("RunRollups: %v", err)
+	}
+	// Ten days are rolled up in two chunks for each resolution
+	if got := len(stub.statements(`"metric_points"`)); got != 2*len(rollupSteps) {
+		t.Errorf("first run read points %d times, want %d", got, 2*len(rollupSteps))
+	}
+	if got := stub.statements(`"metric_points"`)[0].Args; !got[0].(time.Time).Before(now.Add(-239 * time.Hour)) {
+		t.Errorf("first run starts at %v, want the latest stored rollup", got[0])
+	}
+
+	before := len(stub.statements(`"metric_points"`))
+	if err := s.RunRollups(48 * time.Hour); err != nil {
+		t.Fatalf("RunRollups: %v", err)
+	}
+	if got := len(stub.statements(`"metric_points"`)) - before; got != len(rollupSteps) {
+		t.Errorf("later run read points %d times, want %d", got, len(rollupSteps))
+	}
+	if got := len(stub.statements(`FROM "metric_rollups"`)); got != len(rollupSteps) {
+		t.Errorf("looked up the latest rollup %d times, want only on the first run", got)
+	}
+}
+
+func TestRollupProcessed(t *testing.T) {
+	from := time.Date(2023, 1, 10, 6, 30, 0, 0, time.UTC)
+	s, stub := newStubMetricsService(t, func(q stubQuery) (*stubRows, error) {
+		if strings.Contains(q.SQL, "MIN(observed_at)") {
+			return &stubRows{Columns: []string{"from", "to"}, Rows: [][]driver.Value{{from, from.Add(5 * time.Hour)}}}, nil
+		}
+		return nil, nil
+	})
+
+	counts, err := s.RollupProcessed(nil)
+	if err != nil || len(counts) != 0 || len(stub.statements("")) != 0 {
+		t.Fatalf("RollupProcessed(nil) = %v, %v with %d queries, want no work", counts, err, len(stub.statements("")))
+	}
+
+	if _, err := s.RollupProcessed([]uint{4, 5}); err != nil {
+		t.Fatalf("RollupProcessed: %v", err)
+	}
+	points := stub.statements(`"metric_points" WHERE (observed_at >=`)
+	if len(points) != len(rollupSteps) {
+		t.Fatalf("%d rollup point queries, want one per resolution", len(points))
+	}
+	for _, q := range points {
+		start, end := q.Args[0].(time.Time), q.Args[1].(time.Time)
+		if start.After(from) || !end.After(from.Add(5*time.Hour)) {
+			t.Errorf("rolled up [%s, %s), want it to cover the reprocessed points", start, end)
+		}
+	}
+}
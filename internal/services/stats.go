@@ -0,0 +1,112 @@
+package services
+
+import (
+	"math"
+	"sort"
+)
+
+// mean returns the arithmetic mean of values
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// stddev returns the sample standard deviation of values
+func stddev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+// quantile returns the q-th quantile (0 <= q <= 1) of values using linear interpolation
+func quantile(values []float64, q float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// pearson returns the Pearson correlation coefficient of two equally long samples
+func pearson(x, y []float64) (float64, bool) {
+	if len(x) != len(y) || len(x) < 3 {
+		return 0, false
+	}
+	mx, my := mean(x), mean(y)
+	var cov, vx, vy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		cov += dx * dy
+		vx += dx * dx
+		vy += dy * dy
+	}
+	if vx == 0 || vy == 0 {
+		return 0, false
+	}
+	return cov / math.Sqrt(vx*vy), true
+}
+
+// correlationPValue returns the two-sided p-value of a correlation coefficient over n samples
+// using the Fisher transformation, Bonferroni-corrected for the number of coefficients it was
+// selected from
+func correlationPValue(r float64, n, tests int) float64 {
+	if n <= 3 {
+		return 1
+	}
+	if math.Abs(r) >= 1 {
+		return 0
+	}
+	z := math.Atanh(math.Abs(r)) * math.Sqrt(float64(n-3))
+	return math.Min(1, math.Erfc(z/math.Sqrt2)*float64(tests))
+}
+
+// spearman returns the Spearman rank correlation coefficient of two equally long samples
+func spearman(x, y []float64) (float64, bool) {
+	if len(x) != len(y) {
+		return 0, false
+	}
+	return pearson(ranks(x), ranks(y))
+}
+
+// ranks returns the 1-based ranks of values, averaging the ranks of ties
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return values[order[a]] < values[order[b]] })
+
+	result := make([]float64, len(values))
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && values[order[j+1]] == values[order[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			result[order[k]] = rank
+		}
+		i = j + 1
+	}
+	return result
+}
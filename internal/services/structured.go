@@ -0,0 +1,391 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+)
+
+// Analysis formats
+const (
+	AnalysisFormatMarkdown   = "markdown"
+	AnalysisFormatStructured = "structured"
+)
+
+// Analysis insight kinds
+const (
+	InsightKindFinding        = "finding"
+	InsightKindTrend          = "trend"
+	InsightKindAnomaly        = "anomaly"
+	InsightKindRecommendation = "recommendation"
+)
+
+// Trend directions
+const (
+	TrendUp       = "up"
+	TrendDown     = "down"
+	TrendFlat     = "flat"
+	TrendVolatile = "volatile"
+)
+
+// Recommendation priorities share the anomaly severity levels
+const (
+	PriorityLow    = SeverityLow
+	PriorityMedium = SeverityMedium
+	PriorityHigh   = SeverityHigh
+)
+
+// errInvalidStructuredOutput marks a response that does not match the insights schema
+var errInvalidStructuredOutput = errors.New("response does not match the insights schema")
+
+// StructuredInsights is the JSON analysis a structured analysis asks the model for
+type StructuredInsights struct {
+	Summary         string                  `json:"summary"`
+	Sources         []SourceFindings        `json:"sources"`
+	Trends          []TrendInsight          `json:"trends"`
+	Anomalies       []AnomalyInsight        `json:"anomalies"`
+	Recommendations []RecommendationInsight `json:"recommendations"`
+}
+
+// SourceFindings lists the key findings about one data source
+type SourceFindings struct {
+	Source   string   `json:"source"`
+	Findings []string `json:"findings"`
+}
+
+// TrendInsight describes a trend in a metric
+type TrendInsight struct {
+	Metric      string `json:"metric"`
+	Direction   string `json:"direction"`
+	Description string `json:"description"`
+}
+
+// AnomalyInsight explains a flagged anomaly
+type AnomalyInsight struct {
+	Metric      string `json:"metric"`
+	Severity    string `json:"severity"`
+	Explanation string `json:"explanation"`
+}
+
+// RecommendationInsight is an action recommended by the analysis
+type RecommendationInsight struct {
+	Action     string  `json:"action"`
+	Rationale  string  `json:"rationale"`
+	Priority   string  `json:"priority"`
+	Confidence float64 `json:"confidence"`
+}
+
+// insightsSchema is the JSON schema of StructuredInsights. Every object lists all its properties
+// as required and forbids others, as strict structured output modes demand.
+var insightsSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"summary": map[string]interface{}{"type": "string"},
+		"sources": arraySchema(objectSchema(map[string]interface{}{
+			"source":   map[string]interface{}{"type": "string"},
+			"findings": arraySchema(map[string]interface{}{"type": "string"}),
+		})),
+		"trends": arraySchema(objectSchema(map[string]interface{}{
+			"metric":      map[string]interface{}{"type": "string"},
+			"direction":   enumSchema(TrendUp, TrendDown, TrendFlat, TrendVolatile),
+			"description": map[string]interface{}{"type": "string"},
+		})),
+		"anomalies": arraySchema(objectSchema(map[string]interface{}{
+			"metric":      map[string]interface{}{"type": "string"},
+			"severity":    enumSchema(SeverityLow, SeverityMedium, SeverityHigh),
+			"explanation": map[string]interface{}{"type": "string"},
+		})),
+		"recommendations": arraySchema(objectSchema(map[string]interface{}{
+			"action":     map[string]interface{}{"type": "string"},
+			"rationale":  map[string]interface{}{"type": "string"},
+			"priority":   enumSchema(PriorityLow, PriorityMedium, PriorityHigh),
+			"confidence": map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1},
+		})),
+	},
+	"required":             []string{"summary", "sources", "trends", "anomalies", "recommendations"},
+	"additionalProperties": false,
+}
+
+func objectSchema(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             sortedMapKeys(properties),
+		"additionalProperties": false,
+	}
+}
+
+func arraySchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func enumSchema(values ...string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": values}
+}
+
+// insightsSchemaText returns the insights schema as indented JSON for prompts
+func insightsSchemaText() string {
+	encoded, _ := json.MarshalIndent(insightsSchema, "", "  ")
+	return string(encoded)
+}
+
+// parseStructuredInsights extracts and validates the insights JSON in a model response
+func parseStructuredInsights(content string) (*StructuredInsights, error) {
+	text := strings.TrimSpace(content)
+	// Tolerate a Markdown code fence or text around the object
+	if start, end := strings.Index(text, "{"), strings.LastIndex(text, "}"); start >= 0 && end > start {
+		text = text[start : end+1]
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	decoder.DisallowUnknownFields()
+	var insights StructuredInsights
+	if err := decoder.Decode(&insights); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON: %v", errInvalidStructuredOutput, err)
+	}
+	if err := insights.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidStructuredOutput, err)
+	}
+	return &insights, nil
+}
+
+func (i *StructuredInsights) validate() error {
+	if strings.TrimSpace(i.Summary) == "" {
+		return fmt.Errorf("summary is required")
+	}
+	for n, source := range i.Sources {
+		if source.Source == "" {
+			return fmt.Errorf("sources[%d].source is required", n)
+		}
+	}
+	for n, trend := range i.Trends {
+		switch trend.Direction {
+		case TrendUp, TrendDown, TrendFlat, TrendVolatile:
+		default:
+			return fmt.Errorf("trends[%d].direction must be up, down, flat or volatile", n)
+		}
+		if trend.Description == "" {
+			return fmt.Errorf("trends[%d].description is required", n)
+		}
+	}
+	for n, anomaly := range i.Anomalies {
+		if !isLevel(anomaly.Severity) {
+			return fmt.Errorf("anomalies[%d].severity must be low, medium or high", n)
+		}
+		if anomaly.Metric == "" || anomaly.Explanation == "" {
+			return fmt.Errorf("anomalies[%d] requires metric and explanation", n)
+		}
+	}
+	for n, rec := range i.Recommendations {
+		if !isLevel(rec.Priority) {
+			return fmt.Errorf("recommendations[%d].priority must be low, medium or high", n)
+		}
+		if rec.Confidence < 0 || rec.Confidence > 1 {
+			return fmt.Errorf("recommendations[%d].confidence must be between 0 and 1", n)
+		}
+		if rec.Action == "" {
+			return fmt.Errorf("recommendations[%d].action is required", n)
+		}
+	}
+	return nil
+}
+
+func isLevel(level string) bool {
+	return level == SeverityLow || level == SeverityMedium || level == SeverityHigh
+}
+
+// Markdown renders the insights as a Markdown report
+func (i *StructuredInsights) Markdown() string {
+	var b strings.Builder
+	b.WriteString("## Summary\n\n")
+	b.WriteString(strings.TrimSpace(i.Summary) + "\n")
+
+	if len(i.Sources) > 0 {
+		b.WriteString("\n## Findings by Source\n")
+		for _, source := range i.Sources {
+			fmt.Fprintf(&b, "\n### %s\n\n", source.Source)
+			for _, finding := range source.Findings {
+				fmt.Fprintf(&b, "- %s\n", finding)
+			}
+		}
+	}
+
+	if len(i.Trends) > 0 {
+		b.WriteString("\n## Trends\n\n")
+		for _, trend := range i.Trends {
+			if trend.Metric != "" {
+				fmt.Fprintf(&b, "- **%s** (%s): %s\n", trend.Metric, trend.Direction, trend.Description)
+			} else {
+				fmt.Fprintf(&b, "- (%s) %s\n", trend.Direction, trend.Description)
+			}
+		}
+	}
+
+	if len(i.Anomalies) > 0 {
+		b.WriteString("\n## Anomalies\n\n")
+		for _, anomaly := range i.Anomalies {
+			fmt.Fprintf(&b, "- **%s** (%s severity): %s\n", anomaly.Metric, anomaly.Severity, anomaly.Explanation)
+		}
+	}
+
+	if len(i.Recommendations) > 0 {
+		b.WriteString("\n## Recommendations\n\n")
+		b.WriteString("| Priority | Action | Rationale | Confidence |\n|---|---|---|---|\n")
+		for _, rec := range i.Recommendations {
+			fmt.Fprintf(&b, "| %s | %s | %s | %.0f%% |\n",
+				strings.ToUpper(rec.Priority), markdownCell(rec.Action), markdownCell(rec.Rationale), rec.Confidence*100)
+		}
+	}
+	return b.String()
+}
+
+// markdownCell escapes text for a Markdown table cell
+func markdownCell(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "|", "\\|"), "\n", " ")
+}
+
+// rows flattens the insights into queryable rows
+func (i *StructuredInsights) rows() []models.AnalysisInsight {
+	var rows []models.AnalysisInsight
+	for _, source := range i.Sources {
+		for _, finding := range source.Findings {
+			rows = append(rows, models.AnalysisInsight{Kind: InsightKindFinding, Source: source.Source, Text: finding})
+		}
+	}
+	for _, trend := range i.Trends {
+		rows = append(rows, models.AnalysisInsight{Kind: InsightKindTrend, Metric: trend.Metric, Direction: trend.Direction, Text: trend.Description})
+	}
+	for _, anomaly := range i.Anomalies {
+		rows = append(rows, models.AnalysisInsight{Kind: InsightKindAnomaly, Metric: anomaly.Metric, Severity: anomaly.Severity, Text: anomaly.Explanation})
+	}
+	for _, rec := range i.Recommendations {
+		confidence := rec.Confidence
+		rows = append(rows, models.AnalysisInsight{
+			Kind:       InsightKindRecommendation,
+			Text:       rec.Action,
+			Rationale:  rec.Rationale,
+			Priority:   rec.Priority,
+			Confidence: &confidence,
+		})
+	}
+	return rows
+}
+
+// GenerateStructuredInsights asks the model for a schema-validated JSON analysis of processed
+// data, the latest when processedDataID is 0. Malformed responses are retried with the
+// validation error; the analysis is stored with Markdown rendered from the structure and one
+// row per insight.
+func (s *LLMService) GenerateStructuredInsights(processedDataID uint, opts AnalysisOptions) (*models.LLMAnalysis, *StructuredInsights, error) {
+	s.Logger.Infow("Starting structured LLM analysis generation", "processed_id", processedDataID)
+
+	processedData, err := s.processedDataForAnalysis(processedDataID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prompt, err := s.analysisPrompt(AnalysisTypeStructured, opts, processedData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Replay an identical recent analysis instead of paying for a new completion
+	req, cached, err := s.prepareCompletion(prompt, &opts, &JSONSchema{Name: "analysis_insights", Schema: insightsSchema})
+	if err != nil {
+		return nil, nil, err
+	}
+	if cached != nil {
+		var insights StructuredInsights
+		if err := json.Unmarshal([]byte(cached.Structured), &insights); err == nil {
+			return cached, &insights, nil
+		}
+	}
+
+	retries := s.Settings.StructuredRetries
+	if retries < 0 {
+		retries = 0
+	}
+	var insights *StructuredInsights
+	// Usage adds up over all attempts, as every attempt is billed
+	var usage TokenUsage
+	usageEstimated := false
+	var served *CompletionResponse
+	for attempt := 0; attempt <= retries; attempt++ {
+		prompt.Metadata.Attempts = attempt + 1
+		resp, err := s.complete(context.Background(), req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("LLM API request failed: %w", err)
+		}
+		attemptUsage, estimated := completionUsage(req, resp)
+		usage.PromptTokens += attemptUsage.PromptTokens
+		usage.CompletionTokens += attemptUsage.CompletionTokens
+		usageEstimated = usageEstimated || estimated
+		served = resp
+		prompt.Metadata.FailedCalls = append(prompt.Metadata.FailedCalls, resp.Failures...)
+
+		insights, err = parseStructuredInsights(resp.Content)
+		if err == nil {
+			break
+		}
+		s.Logger.Warnw("Structured analysis response failed validation", "attempt", attempt+1, "error", err)
+		prompt.Metadata.ValidationErrors = append(prompt.Metadata.ValidationErrors, err.Error())
+
+		// Show the model its response and what was wrong with it
+		req.Messages = append(req.Messages,
+			Message{Role: "assistant", Content: resp.Content},
+			Message{Role: "user", Content: fmt.Sprintf("That response is invalid: %v. Respond again with only a JSON object matching the schema.", err)},
+		)
+	}
+	if insights == nil {
+		return nil, nil, fmt.Errorf("no valid structured analysis after %d attempts: %s",
+			prompt.Metadata.Attempts, prompt.Metadata.ValidationErrors[len(prompt.Metadata.ValidationErrors)-1])
+	}
+
+	structured, _ := json.Marshal(insights)
+	llmAnalysis := models.LLMAnalysis{
+		Content:         insights.Markdown(),
+		GeneratedAt:     time.Now(),
+		ProcessedDataID: &processedData.ID,
+		Format:          AnalysisFormatStructured,
+		Summary:         insights.Summary,
+		Structured:      string(structured),
+		Insights:        insights.rows(),
+	}
+	opts.Params.record(&llmAnalysis, s.Provider.Name())
+	recordServed(&llmAnalysis, served)
+	s.recordUsage(&llmAnalysis, served.Model, usage, usageEstimated)
+	prompt.record(&llmAnalysis)
+
+	// The analysis and its insight rows are created together
+	if err := s.DB.Create(&llmAnalysis).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to store LLM analysis: %w", err)
+	}
+
+	s.Logger.Infow("Structured LLM analysis generated successfully", "id", llmAnalysis.ID, "insights", len(llmAnalysis.Insights), "attempts", prompt.Metadata.Attempts)
+	return &llmAnalysis, insights, nil
+}
+
+// processedDataForAnalysis loads processed data by ID, or the latest when id is 0, and refuses
+// data that failed a quality check
+func (s *LLMService) processedDataForAnalysis(id uint) (*models.ProcessedData, error) {
+	var processedData models.ProcessedData
+	var err error
+	if id > 0 {
+		err = s.DB.First(&processedData, id).Error
+	} else {
+		err = s.DB.Order(LatestProcessedOrder).First(&processedData).Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve processed data: %w", err)
+	}
+
+	if processedData.QualityStatus == QualityStatusFailed {
+		return nil, fmt.Errorf("processed data %d: %w", processedData.ID, ErrQualityGateFailed)
+	}
+	return &processedData, nil
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// stubQuery is a statement sent to the stub database
+type stubQuery struct {
+	SQL  string
+	Args []driver.Value
+}
+
+// stubRows is the result of a stub query; a nil result answers with no rows
+type stubRows struct {
+	Columns []string
+	Rows    [][]driver.Value
+}
+
+// stubDB is a database/sql driver that answers statements with a handler and records them, so
+// services can be tested against GORM without PostgreSQL
+type stubDB struct {
+	mu      sync.Mutex
+	handler func(q stubQuery) (*stubRows, error)
+	queries []stubQuery
+}
+
+// newStubDB returns a GORM database backed by a stub answering statements with handler
+func newStubDB(t *testing.T, handler func(q stubQuery) (*stubRows, error)) (*gorm.DB, *stubDB) {
+	t.Helper()
+	stub := &stubDB{handler: handler}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(stub)}), &gorm.Config{
+		DisableAutomaticPing: true,
+		Logger:               logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("failed to open stub database: %v", err)
+	}
+	return db, stub
+}
+
+// statements returns the recorded statements containing a fragment of SQL
+func (s *stubDB) statements(fragment string) []stubQuery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched []stubQuery
+	for _, q := range s.queries {
+		if strings.Contains(q.SQL, fragment) {
+			matched = append(matched, q)
+		}
+	}
+	return matched
+}
+
+func (s *stubDB) run(query string, args []driver.NamedValue) (*stubRows, error) {
+	q := stubQuery{SQL: query}
+	for _, arg := range args {
+		q.Args = append(q.Args, arg.Value)
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+	if s.handler == nil {
+		return nil, nil
+	}
+	return s.handler(q)
+}
+
+// Connect and Driver implement driver.Connector
+func (s *stubDB) Connect(context.Context) (driver.Conn, error) { return &stubConn{db: s}, nil }
+func (s *stubDB) Driver() driver.Driver                        { return stubDriver{} }
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("stub database must be opened with a connector")
+}
+
+type stubConn struct{ db *stubDB }
+
+func (c *stubConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("stub database does not prepare statements")
+}
+func (c *stubConn) Close() error              { return nil }
+func (c *stubConn) Begin() (driver.Tx, error) { return stubTx{}, nil }
+
+func (c *stubConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &stubRows{}
+	}
+	return &stubRowsIter{result: result}, nil
+}
+
+func (c *stubConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.db.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	affected := int64(0)
+	if result != nil {
+		affected = int64(len(result.Rows))
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+// CheckNamedValue accepts every argument as is, so GORM can pass times and slices
+func (c *stubConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubRowsIter struct {
+	result *stubRows
+	next   int
+}
+
+func (r *stubRowsIter) Columns() []string { return r.result.Columns }
+func (r *stubRowsIter) Close() error      { return nil }
+
+func (r *stubRowsIter) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.Rows[r.next])
+	r.next++
+	return nil
+}
+
+// newStubProcessor returns a data processor on a stub database
+func newStubProcessor(t *testing.T, config *PipelineConfig, handler func(q stubQuery) (*stubRows, error)) (*DataProcessorService, *stubDB) {
+	t.Helper()
+	db, stub := newStubDB(t, handler)
+	return NewDataProcessorService(db, zap.NewNop().Sugar(), config), stub
+}
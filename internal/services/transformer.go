@@ -0,0 +1,200 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arkouda/PipelineIQ/internal/models"
+	"go.uber.org/zap"
+)
+
+// Diagnostic levels reported by transformers
+const (
+	DiagnosticInfo  = "info"
+	DiagnosticWarn  = "warn"
+	DiagnosticError = "error"
+)
+
+// MetricSet is the set of metrics passed along a transformer chain, keyed by metric name.
+// The chain starts with one entry per source holding that source's decoded JSON payload.
+type MetricSet map[string]interface{}
+
+// RunContext carries information about the processing run a transformer chain operates on
+type RunContext struct {
+	Timestamp time.Time
+	Sources   []string
+	RawData   []models.RawData
+	Config    *PipelineConfig
+	Logger    *zap.SugaredLogger
+	// Units records the unit applied to each metric; transformers that convert units update it
+	Units map[string]string
+}
+
+// Diagnostic is a message a transformer reports about a processing run
+type Diagnostic struct {
+	Transformer string `json:"transformer"`
+	Level       string `json:"level"`
+	Message     string `json:"message"`
+}
+
+// Transformer modifies the metric set of a processing run. Implementations may modify and return
+// the metric set they are given or return a new one.
+type Transformer interface {
+	Name() string
+	Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error)
+}
+
+// TransformerFactory builds a transformer from the options of a chain step
+type TransformerFactory func(options json.RawMessage) (Transformer, error)
+
+// Failure policies of a transformer chain step
+const (
+	// OnErrorFail aborts the processing run when the step fails
+	OnErrorFail = "fail"
+	// OnErrorSkip records the failure as a diagnostic and continues with the step's input
+	OnErrorSkip = "skip"
+)
+
+// TransformerStep configures a single step of the transformer chain
+type TransformerStep struct {
+	// Type is the name the transformer was registered under, e.g. "flatten"
+	Type string `json:"type"`
+	// Name labels the step in diagnostics; defaults to the transformer's own name
+	Name string `json:"name,omitempty"`
+	// OnError is the failure policy of the step: fail (default) or skip
+	OnError string `json:"on_error,omitempty"`
+	// Options are passed verbatim to the transformer factory
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// chainStep is an instantiated transformer together with its step settings
+type chainStep struct {
+	transformer Transformer
+	name        string
+	onError     string
+}
+
+var (
+	transformerRegistryMu sync.RWMutex
+	transformerRegistry   = map[string]TransformerFactory{}
+)
+
+// RegisterTransformer makes a transformer type available to the chain configuration. It is meant
+// to be called from init functions and panics if the type is already registered.
+func RegisterTransformer(kind string, factory TransformerFactory) {
+	transformerRegistryMu.Lock()
+	defer transformerRegistryMu.Unlock()
+
+	if _, exists := transformerRegistry[kind]; exists {
+		panic(fmt.Sprintf("transformer %q is already registered", kind))
+	}
+	transformerRegistry[kind] = factory
+}
+
+// RegisteredTransformers returns the sorted names of all registered transformer types
+func RegisteredTransformers() []string {
+	transformerRegistryMu.RLock()
+	defer transformerRegistryMu.RUnlock()
+
+	names := make([]string, 0, len(transformerRegistry))
+	for name := range transformerRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultTransformerSteps reproduces the original processing: flatten every source, then coerce
+// types and units
+var defaultTransformerSteps = []TransformerStep{
+	{Type: "flatten"},
+	{Type: "coerce"},
+}
+
+// buildTransformerChain instantiates the configured steps, or the default chain when none are set
+func buildTransformerChain(steps []TransformerStep) ([]chainStep, error) {
+	if len(steps) == 0 {
+		steps = defaultTransformerSteps
+	}
+
+	transformerRegistryMu.RLock()
+	defer transformerRegistryMu.RUnlock()
+
+	chain := make([]chainStep, 0, len(steps))
+	for i, step := range steps {
+		factory, ok := transformerRegistry[step.Type]
+		if !ok {
+			return nil, fmt.Errorf("step %d: unknown transformer type %q", i, step.Type)
+		}
+
+		onError := step.OnError
+		switch onError {
+		case "":
+			onError = OnErrorFail
+		case OnErrorFail, OnErrorSkip:
+		default:
+			return nil, fmt.Errorf("step %d (%s): unsupported on_error policy %q", i, step.Type, step.OnError)
+		}
+
+		transformer, err := factory(step.Options)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i, step.Type, err)
+		}
+
+		name := step.Name
+		if name == "" {
+			name = transformer.Name()
+		}
+		chain = append(chain, chainStep{transformer: transformer, name: name, onError: onError})
+	}
+	return chain, nil
+}
+
+// runTransformerChain passes the metric set through every step in order, applying each step's
+// failure policy
+func runTransformerChain(ctx *RunContext, chain []chainStep, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	diagnostics := []Diagnostic{}
+
+	for _, step := range chain {
+		out, diags, err := step.transformer.Transform(ctx, metrics)
+		for _, d := range diags {
+			if d.Transformer == "" {
+				d.Transformer = step.name
+			}
+			diagnostics = append(diagnostics, d)
+		}
+
+		if err != nil {
+			if step.onError != OnErrorSkip {
+				return nil, diagnostics, fmt.Errorf("transformer %s failed: %w", step.name, err)
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				Transformer: step.name,
+				Level:       DiagnosticError,
+				Message:     fmt.Sprintf("skipped after error: %v", err),
+			})
+			continue
+		}
+
+		if out == nil {
+			out = MetricSet{}
+		}
+		metrics = out
+	}
+
+	return metrics, diagnostics, nil
+}
+
+// decodeTransformerOptions unmarshals step options into v, leaving v untouched when none are given
+func decodeTransformerOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(options, v); err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits applied to external-process transformers unless configured otherwise
+const (
+	defaultExecTimeout        = 30 * time.Second
+	defaultExecMaxOutputBytes = 10 << 20
+	maxExecStderrBytes        = 4 << 10
+)
+
+func init() {
+	RegisterTransformer("exec", newExecTransformer)
+}
+
+// ExecRequest is written as JSON to the stdin of an external-process transformer
+type ExecRequest struct {
+	Context ExecContext `json:"context"`
+	Metrics MetricSet   `json:"metrics"`
+}
+
+// ExecContext describes the processing run to an external-process transformer
+type ExecContext struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Sources   []string          `json:"sources"`
+	Units     map[string]string `json:"units"`
+}
+
+// ExecResponse is read as JSON from the stdout of an external-process transformer
+type ExecResponse struct {
+	Metrics     MetricSet    `json:"metrics"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// execTransformer runs a local command that transforms the metric set over stdin and stdout
+type execTransformer struct {
+	// Command is the program and its arguments, e.g. ["python3", "transforms/score.py"]
+	Command []string `json:"command"`
+	// Dir is the working directory of the command
+	Dir string `json:"dir,omitempty"`
+	// Timeout bounds the run time of the command; defaults to "30s"
+	Timeout string `json:"timeout,omitempty"`
+	// MaxOutputBytes caps the size of stdout; defaults to 10 MiB
+	MaxOutputBytes int `json:"max_output_bytes,omitempty"`
+	// MaxMemoryMB caps the virtual memory of the command on Unix-like systems
+	MaxMemoryMB int `json:"max_memory_mb,omitempty"`
+
+	timeout time.Duration
+}
+
+func newExecTransformer(options json.RawMessage) (Transformer, error) {
+	t := &execTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	if len(t.Command) == 0 || t.Command[0] == "" {
+		return nil, fmt.Errorf("exec requires a command")
+	}
+
+	t.timeout = defaultExecTimeout
+	if t.Timeout != "" {
+		timeout, err := time.ParseDuration(t.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", t.Timeout)
+		}
+		t.timeout = timeout
+	}
+	if t.MaxOutputBytes < 0 || t.MaxMemoryMB < 0 {
+		return nil, fmt.Errorf("max_output_bytes and max_memory_mb must not be negative")
+	}
+	if t.MaxOutputBytes == 0 {
+		t.MaxOutputBytes = defaultExecMaxOutputBytes
+	}
+	if t.MaxMemoryMB > 0 && runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("max_memory_mb is not supported on windows")
+	}
+
+	return t, nil
+}
+
+func (t *execTransformer) Name() string { return "exec:" + t.Command[0] }
+
+func (t *execTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	input, err := json.Marshal(ExecRequest{
+		Context: ExecContext{
+			Timestamp: ctx.Timestamp,
+			Sources:   ctx.Sources,
+			Units:     ctx.Units,
+		},
+		Metrics: metrics,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to serialize metrics: %w", err)
+	}
+
+	runCtx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	name, args := t.Command[0], t.Command[1:]
+	if t.MaxMemoryMB > 0 {
+		// Apply the memory limit in a shell that then replaces itself with the command
+		args = append([]string{"-c", `ulimit -v "$0" && exec "$@"`, strconv.Itoa(t.MaxMemoryMB * 1024)}, t.Command...)
+		name = "/bin/sh"
+	}
+
+	cmd := exec.CommandContext(runCtx, name, args...)
+	cmd.Dir = t.Dir
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(input)
+
+	stdout := &cappedBuffer{limit: t.MaxOutputBytes, onOverflow: cancel}
+	stderr := &cappedBuffer{limit: maxExecStderrBytes, truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	runErr := cmd.Run()
+
+	var diagnostics []Diagnostic
+	if stderr.Len() > 0 {
+		diagnostics = append(diagnostics, Diagnostic{Level: DiagnosticInfo, Message: "stderr: " + strings.TrimSpace(stderr.String())})
+	}
+
+	switch {
+	case stdout.overflowed():
+		return nil, diagnostics, fmt.Errorf("output exceeded %d bytes", t.MaxOutputBytes)
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		return nil, diagnostics, fmt.Errorf("timed out after %s", t.timeout)
+	case runErr != nil:
+		return nil, diagnostics, fmt.Errorf("command failed: %w", runErr)
+	}
+
+	var response ExecResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, diagnostics, fmt.Errorf("invalid JSON on stdout: %w", err)
+	}
+	if response.Metrics == nil {
+		return nil, diagnostics, fmt.Errorf("response is missing the metrics object")
+	}
+
+	diagnostics = append(diagnostics, response.Diagnostics...)
+	diagnostics = append(diagnostics, Diagnostic{
+		Level:   DiagnosticInfo,
+		Message: fmt.Sprintf("completed in %s with %d metrics", time.Since(start).Round(time.Millisecond), len(response.Metrics)),
+	})
+	return response.Metrics, diagnostics, nil
+}
+
+// cappedBuffer collects process output up to a limit. Once the limit is exceeded it either
+// silently drops the rest (truncate) or fails the write and calls onOverflow.
+type cappedBuffer struct {
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	limit      int
+	truncate   bool
+	overflow   bool
+	onOverflow func()
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if remaining := b.limit - b.buf.Len(); len(p) > remaining {
+		b.buf.Write(p[:max(remaining, 0)])
+		if b.truncate {
+			return len(p), nil
+		}
+		if !b.overflow && b.onOverflow != nil {
+			b.onOverflow()
+		}
+		b.overflow = true
+		return 0, fmt.Errorf("output limit of %d bytes exceeded", b.limit)
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) overflowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.overflow
+}
+
+func (b *cappedBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewExecTransformer(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		wantErr string
+	}{
+		{"defaults", `{"command": ["cat"]}`, ""},
+		{"missing command", `{}`, "requires a command"},
+		{"empty program", `{"command": [""]}`, "requires a command"},
+		{"invalid timeout", `{"command": ["cat"], "timeout": "soon"}`, "invalid timeout"},
+		{"negative timeout", `{"command": ["cat"], "timeout": "-1s"}`, "invalid timeout"},
+		{"negative output limit", `{"command": ["cat"], "max_output_bytes": -1}`, "must not be negative"},
+		{"command as a string", `{"command": "cat"}`, "invalid options"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := newExecTransformer(json.RawMessage(tt.options))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newExecTransformer: %v", err)
+			}
+			exec := transformer.(*execTransformer)
+			if exec.timeout != defaultExecTimeout || exec.MaxOutputBytes != defaultExecMaxOutputBytes {
+				t.Errorf("timeout %s and output limit %d, want the defaults", exec.timeout, exec.MaxOutputBytes)
+			}
+		})
+	}
+}
+
+func TestExecTransformer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec tests use /bin/sh")
+	}
+
+	tests := []struct {
+		name        string
+		script      string
+		options     string
+		wantMetrics string
+		wantErr     string
+		wantStderr  bool
+	}{
+		// The request carries a metrics object, so echoing it back is the identity transform
+		{"identity", "cat", "", `{"price":2}`, "", false},
+		{"reported diagnostics", `echo 'progress' >&2; echo '{"metrics": {"score": 1}, "diagnostics": [{"level": "warn", "message": "clamped"}]}'`,
+			"", `{"score":1}`, "", true},
+		{"failing command", "echo 'boom' >&2; exit 3", "", "", "command failed", true},
+		{"invalid output", "echo 'not json'", "", "", "invalid JSON", false},
+		{"missing metrics", `echo '{"diagnostics": []}'`, "", "", "missing the metrics", false},
+		{"timeout", "sleep 5", `"timeout": "100ms"`, "", "timed out", false},
+		{"output limit", "head -c 4096 /dev/zero", `"max_output_bytes": 100`, "", "exceeded 100 bytes", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, _ := json.Marshal([]string{"/bin/sh", "-c", tt.script})
+			options := `{"command": ` + string(command)
+			if tt.options != "" {
+				options += ", " + tt.options
+			}
+			transformer, err := newExecTransformer(json.RawMessage(options + "}"))
+			if err != nil {
+				t.Fatalf("newExecTransformer: %v", err)
+			}
+
+			ctx := &RunContext{Timestamp: time.Now(), Sources: []string{"CryptoAPI"}, Units: map[string]string{}}
+			start := time.Now()
+			metrics, diagnostics, err := transformer.Transform(ctx, MetricSet{"price": 2.0})
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("transform took %s", elapsed)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Transform: %v", err)
+				}
+				if encoded, _ := json.Marshal(metrics); string(encoded) != tt.wantMetrics {
+					t.Errorf("metrics = %s, want %s", encoded, tt.wantMetrics)
+				}
+			}
+
+			hasStderr := len(diagnostics) > 0 && strings.HasPrefix(diagnostics[0].Message, "stderr: ")
+			if hasStderr != tt.wantStderr {
+				t.Errorf("diagnostics = %v, want stderr reported %v", diagnostics, tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	truncated := &cappedBuffer{limit: 5, truncate: true}
+	if n, err := truncated.Write([]byte("abcdefgh")); n != 8 || err != nil {
+		t.Errorf("truncating write = %d, %v", n, err)
+	}
+	if truncated.String() != "abcde" || truncated.overflowed() {
+		t.Errorf("truncated buffer = %q, overflowed %v", truncated.String(), truncated.overflowed())
+	}
+
+	calls := 0
+	capped := &cappedBuffer{limit: 5, onOverflow: func() { calls++ }}
+	capped.Write([]byte("abc"))
+	for i := 0; i < 2; i++ {
+		if _, err := capped.Write([]byte("def")); err == nil {
+			t.Error("expected a write past the limit to fail")
+		}
+	}
+	if !capped.overflowed() || calls != 1 || capped.String() != "abcde" {
+		t.Errorf("capped buffer = %q, overflowed %v, %d overflow calls", capped.String(), capped.overflowed(), calls)
+	}
+}
@@ -0,0 +1,322 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Built-in transformer types
+func init() {
+	RegisterTransformer("flatten", newFlattenTransformer)
+	RegisterTransformer("filter", newFilterTransformer)
+	RegisterTransformer("rename", newRenameTransformer)
+	RegisterTransformer("coerce", newCoerceTransformer)
+	RegisterTransformer("derive", newDeriveTransformer)
+	RegisterTransformer("enrich", newEnrichTransformer)
+}
+
+// flattenTransformer flattens nested source payloads into source-prefixed metric keys
+type flattenTransformer struct {
+	// override replaces the per-source flatten options of the pipeline config when set
+	override *FlattenOptions
+}
+
+func newFlattenTransformer(options json.RawMessage) (Transformer, error) {
+	t := &flattenTransformer{}
+	if len(options) > 0 {
+		opts := FlattenOptions{}
+		if err := decodeTransformerOptions(options, &opts); err != nil {
+			return nil, err
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		t.override = &opts
+	}
+	return t, nil
+}
+
+func (t *flattenTransformer) Name() string { return "flatten" }
+
+func (t *flattenTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	out := MetricSet{}
+	for source, value := range metrics {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			// Already flat
+			out[source] = value
+			continue
+		}
+
+		opts := ctx.Config.flattenOptions(source)
+		if t.override != nil {
+			opts = t.override.withDefaults()
+		}
+
+		flattened := make(map[string]interface{})
+		flattenJSON("", nested, flattened, opts, 0)
+		for key, v := range flattened {
+			out[opts.join(source, key)] = v
+		}
+	}
+	return out, nil, nil
+}
+
+// filterTransformer keeps only the metrics matching the include globs and not matching the exclude globs
+type filterTransformer struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+func newFilterTransformer(options json.RawMessage) (Transformer, error) {
+	t := &filterTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	if len(t.Include) == 0 && len(t.Exclude) == 0 {
+		return nil, fmt.Errorf("filter requires include or exclude patterns")
+	}
+	return t, nil
+}
+
+func (t *filterTransformer) Name() string { return "filter" }
+
+func (t *filterTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	removed := 0
+	for key := range metrics {
+		if (len(t.Include) > 0 && !matchAnyGlob(t.Include, key)) || matchAnyGlob(t.Exclude, key) {
+			delete(metrics, key)
+			removed++
+		}
+	}
+
+	var diagnostics []Diagnostic
+	if removed > 0 {
+		diagnostics = append(diagnostics, Diagnostic{Level: DiagnosticInfo, Message: fmt.Sprintf("removed %d metrics", removed)})
+	}
+	return metrics, diagnostics, nil
+}
+
+// renameTransformer renames metrics by exact key or by key prefix
+type renameTransformer struct {
+	// Mapping renames exact keys, e.g. {"CryptoAPI_data_priceUsd": "btc_price_usd"}
+	Mapping map[string]string `json:"mapping"`
+	// Prefixes replaces key prefixes, e.g. {"WeatherAPI_current_": "austin_"}
+	Prefixes map[string]string `json:"prefixes"`
+}
+
+func newRenameTransformer(options json.RawMessage) (Transformer, error) {
+	t := &renameTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	if len(t.Mapping) == 0 && len(t.Prefixes) == 0 {
+		return nil, fmt.Errorf("rename requires a mapping or prefixes")
+	}
+	return t, nil
+}
+
+func (t *renameTransformer) Name() string { return "rename" }
+
+func (t *renameTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	// Apply longer prefixes first so the most specific one wins
+	prefixes := make([]string, 0, len(t.Prefixes))
+	for prefix := range t.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	out := make(MetricSet, len(metrics))
+	var diagnostics []Diagnostic
+
+	for key, value := range metrics {
+		renamed := key
+		if target, ok := t.Mapping[key]; ok {
+			renamed = target
+		} else {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					renamed = t.Prefixes[prefix] + strings.TrimPrefix(key, prefix)
+					break
+				}
+			}
+		}
+
+		if _, exists := out[renamed]; exists {
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DiagnosticWarn,
+				Message: fmt.Sprintf("renaming %s to %s overwrote an existing metric", key, renamed),
+			})
+		}
+		out[renamed] = value
+
+		if unit, ok := ctx.Units[key]; ok && renamed != key {
+			delete(ctx.Units, key)
+			ctx.Units[renamed] = unit
+		}
+	}
+
+	return out, diagnostics, nil
+}
+
+// coerceTransformer parses typed values from strings and converts metrics to canonical units
+type coerceTransformer struct {
+	// UnitRules replaces the unit rules of the pipeline config when set
+	UnitRules []UnitRule `json:"unit_rules"`
+}
+
+func newCoerceTransformer(options json.RawMessage) (Transformer, error) {
+	t := &coerceTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	for i, rule := range t.UnitRules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid unit rule %d: %w", i, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *coerceTransformer) Name() string { return "coerce" }
+
+func (t *coerceTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	rules := ctx.Config.UnitRules
+	if len(t.UnitRules) > 0 {
+		rules = t.UnitRules
+	}
+
+	for key, unit := range normalizeMetrics(metrics, rules) {
+		ctx.Units[key] = unit
+	}
+	return metrics, nil, nil
+}
+
+// Supported derive operations
+const (
+	DeriveSum        = "sum"
+	DeriveDifference = "difference"
+	DeriveProduct    = "product"
+	DeriveRatio      = "ratio"
+	DeriveMean       = "mean"
+)
+
+// DerivedMetricSpec computes a new metric from existing numeric metrics
+type DerivedMetricSpec struct {
+	Name   string   `json:"name"`
+	Op     string   `json:"op"`
+	Inputs []string `json:"inputs"`
+}
+
+// deriveTransformer adds metrics computed from other metrics of the set
+type deriveTransformer struct {
+	Metrics []DerivedMetricSpec `json:"metrics"`
+}
+
+func newDeriveTransformer(options json.RawMessage) (Transformer, error) {
+	t := &deriveTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	if len(t.Metrics) == 0 {
+		return nil, fmt.Errorf("derive requires at least one metric")
+	}
+	for _, spec := range t.Metrics {
+		if spec.Name == "" || len(spec.Inputs) == 0 {
+			return nil, fmt.Errorf("derived metrics require a name and inputs")
+		}
+		switch spec.Op {
+		case DeriveSum, DeriveProduct, DeriveMean:
+		case DeriveDifference, DeriveRatio:
+			if len(spec.Inputs) != 2 {
+				return nil, fmt.Errorf("%s of %s requires exactly two inputs", spec.Op, spec.Name)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported derive op %q for %s", spec.Op, spec.Name)
+		}
+	}
+	return t, nil
+}
+
+func (t *deriveTransformer) Name() string { return "derive" }
+
+func (t *deriveTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	var diagnostics []Diagnostic
+
+	for _, spec := range t.Metrics {
+		values := make([]float64, 0, len(spec.Inputs))
+		for _, input := range spec.Inputs {
+			if f, ok := toFloat(metrics[input]); ok {
+				values = append(values, f)
+			}
+		}
+		if len(values) != len(spec.Inputs) {
+			diagnostics = append(diagnostics, Diagnostic{
+				Level:   DiagnosticWarn,
+				Message: fmt.Sprintf("skipped %s: not all inputs are numeric metrics", spec.Name),
+			})
+			continue
+		}
+
+		var result float64
+		switch spec.Op {
+		case DeriveSum:
+			result = aggregateValues(values, AggregationSum)
+		case DeriveMean:
+			result = aggregateValues(values, AggregationAvg)
+		case DeriveProduct:
+			result = 1
+			for _, v := range values {
+				result *= v
+			}
+		case DeriveDifference:
+			result = values[0] - values[1]
+		case DeriveRatio:
+			if values[1] == 0 {
+				diagnostics = append(diagnostics, Diagnostic{
+					Level:   DiagnosticWarn,
+					Message: fmt.Sprintf("skipped %s: division by zero", spec.Name),
+				})
+				continue
+			}
+			result = values[0] / values[1]
+		}
+		metrics[spec.Name] = result
+	}
+
+	return metrics, diagnostics, nil
+}
+
+// enrichTransformer adds static values and run context to the metric set
+type enrichTransformer struct {
+	// Values are added verbatim, e.g. {"location": "Austin"}
+	Values map[string]interface{} `json:"values"`
+	// RunContext adds run_timestamp and run_source_count metrics
+	RunContext bool `json:"run_context"`
+}
+
+func newEnrichTransformer(options json.RawMessage) (Transformer, error) {
+	t := &enrichTransformer{}
+	if err := decodeTransformerOptions(options, t); err != nil {
+		return nil, err
+	}
+	if len(t.Values) == 0 && !t.RunContext {
+		return nil, fmt.Errorf("enrich requires values or run_context")
+	}
+	return t, nil
+}
+
+func (t *enrichTransformer) Name() string { return "enrich" }
+
+func (t *enrichTransformer) Transform(ctx *RunContext, metrics MetricSet) (MetricSet, []Diagnostic, error) {
+	for key, value := range t.Values {
+		metrics[key] = value
+	}
+	if t.RunContext {
+		metrics["run_timestamp"] = ctx.Timestamp
+		metrics["run_source_count"] = float64(len(ctx.Sources))
+	}
+	return metrics, nil, nil
+}